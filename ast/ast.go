@@ -2,13 +2,27 @@ package ast
 
 import (
 	"bytes"
+	"fmt"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/drejca/shift/token"
 )
 
 type Node interface {
 	String() string
+	Span() token.Span
+}
+
+// Spanned is embedded in every node to record the source range it was parsed from
+type Spanned struct {
+	Extent token.Span
+}
+
+// Span returns the source range of the node
+func (s *Spanned) Span() token.Span {
+	return s.Extent
 }
 
 type Statement interface {
@@ -27,21 +41,170 @@ type ProgramError interface {
 }
 
 type Program struct {
+	Spanned
+	Filename   string
 	Statements []Statement
+	Comments   []token.Comment // every comment of the file in source order
+}
+
+// PackageName returns the name from the package clause or "main" when the file has none
+func (p *Program) PackageName() string {
+	for _, stmt := range p.Statements {
+		if pkg, ok := stmt.(*PackageStatement); ok {
+			return pkg.Name
+		}
+	}
+	return "main"
+}
+
+// Imports returns the import paths of the Shift packages imported by the file
+func (p *Program) Imports() []string {
+	var paths []string
+	for _, stmt := range p.Statements {
+		if imp, ok := stmt.(*ImportPackageStatement); ok {
+			paths = append(paths, imp.Path)
+		}
+	}
+	return paths
+}
+
+// Package is a set of files sharing a package clause in one directory
+type Package struct {
+	Name  string
+	Path  string // import path, empty for the root package
+	Files []*Program
 }
 
 func (p *Program) String() string {
 	var out bytes.Buffer
 
+	// comments in blocks and doc comments are written by their statements
+	var comments []token.Comment
+	for _, comment := range p.Comments {
+		if !p.inBody(comment) && !p.isDoc(comment) {
+			comments = append(comments, comment)
+		}
+	}
+
 	for _, stmt := range p.Statements {
-		out.WriteString(stmt.String())
+		var leading, trailing []token.Comment
+		leading, comments = commentsBefore(comments, stmt.Span().Start)
+		trailing, comments = commentsOnLine(comments, stmt.Span().End.Line)
+
+		for _, comment := range leading {
+			out.WriteString("\n")
+			out.WriteString(comment.Text)
+			out.WriteString("\n")
+		}
+		// declarations end with a newline which trailing comments go before
+		out.WriteString(strings.TrimSuffix(stmt.String(), "\n"))
+		for _, comment := range trailing {
+			out.WriteString(" ")
+			out.WriteString(comment.Text)
+		}
+		out.WriteString("\n")
+	}
+	for _, comment := range comments {
+		out.WriteString("\n")
+		out.WriteString(comment.Text)
+		out.WriteString("\n")
 	}
 	return out.String()
 }
 
+// inBody reports whether comment is in the body of a function or test block
+func (p *Program) inBody(comment token.Comment) bool {
+	for _, stmt := range p.Statements {
+		var body *BlockStatement
+		switch stmt := stmt.(type) {
+		case *Function:
+			body = stmt.Body
+		case *TestBlock:
+			body = stmt.Body
+		}
+		if body != nil && body.Span().Contains(comment.Pos.Offset) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDoc reports whether comment is the doc comment of a function
+func (p *Program) isDoc(comment token.Comment) bool {
+	for _, stmt := range p.Statements {
+		if function, ok := stmt.(*Function); ok {
+			for _, doc := range function.Doc {
+				if doc.Pos == comment.Pos {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// commentsBefore splits comments in source order into those starting before pos and the rest
+func commentsBefore(comments []token.Comment, pos token.Position) ([]token.Comment, []token.Comment) {
+	i := 0
+	for i < len(comments) && comments[i].Pos.Offset < pos.Offset {
+		i++
+	}
+	return comments[:i], comments[i:]
+}
+
+// commentsOnLine splits comments in source order into those starting on or before line and the rest
+func commentsOnLine(comments []token.Comment, line int) ([]token.Comment, []token.Comment) {
+	i := 0
+	for i < len(comments) && comments[i].Pos.Line <= line {
+		i++
+	}
+	return comments[:i], comments[i:]
+}
+
+// writeStatements writes stmts on their own lines indented to depth. Comments before
+// a statement go on the lines above it and comments on the line it ends on after it.
+func writeStatements(out *bytes.Buffer, stmts []Statement, comments []token.Comment, depth int) {
+	for _, stmt := range stmts {
+		var leading, trailing []token.Comment
+		leading, comments = commentsBefore(comments, stmt.Span().Start)
+		trailing, comments = commentsOnLine(comments, stmt.Span().End.Line)
+
+		for _, comment := range leading {
+			out.WriteString("\n")
+			out.WriteString(indent(depth))
+			out.WriteString(comment.Text)
+		}
+		out.WriteString("\n")
+		out.WriteString(indent(depth))
+		out.WriteString(stmt.String())
+		for _, comment := range trailing {
+			out.WriteString(" ")
+			out.WriteString(comment.Text)
+		}
+	}
+	for _, comment := range comments {
+		out.WriteString("\n")
+		out.WriteString(indent(depth))
+		out.WriteString(comment.Text)
+	}
+}
+
 type Function struct {
-	Signature *FunctionSignature
-	Body      *BlockStatement
+	Spanned
+	Doc        []token.Comment // line comments directly before the function
+	Attributes []*Attribute
+	Signature  *FunctionSignature
+	Body       *BlockStatement
+}
+
+// Attribute returns the attribute with name or nil when the function does not have it
+func (f *Function) Attribute(name string) *Attribute {
+	for _, attr := range f.Attributes {
+		if attr.Name == name {
+			return attr
+		}
+	}
+	return nil
 }
 
 func (f *Function) statementNode() {}
@@ -49,6 +212,14 @@ func (f *Function) String() string {
 	var out bytes.Buffer
 
 	out.WriteString("\n")
+	for _, comment := range f.Doc {
+		out.WriteString(comment.Text)
+		out.WriteString("\n")
+	}
+	for _, attr := range f.Attributes {
+		out.WriteString(attr.String())
+		out.WriteString("\n")
+	}
 	out.WriteString("fn ")
 
 	out.WriteString(f.Signature.String())
@@ -60,7 +231,51 @@ func (f *Function) String() string {
 	return out.String()
 }
 
+// TestBlock is a named test compiled only into the test module
+type TestBlock struct {
+	Spanned
+	Token token.Token // the 'test' token
+	Name  string
+	Body  *BlockStatement
+}
+
+func (tb *TestBlock) statementNode() {}
+func (tb *TestBlock) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("\ntest ")
+	out.WriteString(quote(tb.Name))
+	out.WriteString(tb.Body.String())
+	out.WriteString("\n")
+	return out.String()
+}
+
+type Attribute struct {
+	Spanned
+	Token     token.Token // The '@' token
+	Name      string
+	Arguments []Expression
+}
+
+func (a *Attribute) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("@")
+	out.WriteString(a.Name)
+	if len(a.Arguments) > 0 {
+		var args []string
+		for _, arg := range a.Arguments {
+			args = append(args, arg.String())
+		}
+		out.WriteString("(")
+		out.WriteString(strings.Join(args, ", "))
+		out.WriteString(")")
+	}
+	return out.String()
+}
+
 type FunctionSignature struct {
+	Spanned
 	Name         string
 	InputParams  []*Parameter
 	ReturnParams []*Parameter
@@ -93,8 +308,10 @@ func (f *FunctionSignature) String() string {
 }
 
 type Parameter struct {
-	Ident *Identifier
-	Type  string
+	Spanned
+	Ident     *Identifier
+	Type      string
+	ErrorType string // error type of a T!E result, empty for plain values
 }
 
 func (p *Parameter) String() string {
@@ -105,13 +322,19 @@ func (p *Parameter) String() string {
 		out.WriteString(" ")
 	}
 	out.WriteString(p.Type)
+	if p.ErrorType != "" {
+		out.WriteString("!")
+		out.WriteString(p.ErrorType)
+	}
 
 	return out.String()
 }
 
 type BlockStatement struct {
+	Spanned
 	FirstToken token.Token
 	Statements []Statement
+	Comments   []token.Comment // comments between the braces outside nested blocks and case clauses
 	Depth      int
 }
 
@@ -120,11 +343,7 @@ func (b *BlockStatement) String() string {
 	var out bytes.Buffer
 
 	out.WriteString(" {")
-	for _, stmt := range b.Statements {
-		out.WriteString("\n")
-		out.WriteString(indent(b.Depth))
-		out.WriteString(stmt.String())
-	}
+	writeStatements(&out, b.Statements, b.Comments, b.Depth)
 	out.WriteString("\n")
 	out.WriteString(indent(b.Depth - 1))
 	out.WriteString("}")
@@ -140,6 +359,7 @@ func indent(depth int) string {
 }
 
 type ReturnStatement struct {
+	Spanned
 	ReturnValue Expression
 }
 
@@ -147,16 +367,122 @@ func (r *ReturnStatement) statementNode() {}
 func (r *ReturnStatement) String() string {
 	var out bytes.Buffer
 
-	out.WriteString("return ")
+	out.WriteString("return")
 
 	if r.ReturnValue != nil {
+		out.WriteString(" ")
 		out.WriteString(r.ReturnValue.String())
 	}
 
 	return out.String()
 }
 
+type PackageStatement struct {
+	Spanned
+	Token token.Token
+	Name  string
+}
+
+func (ps *PackageStatement) statementNode() {}
+func (ps *PackageStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("\n")
+	out.WriteString("package ")
+	out.WriteString(ps.Name)
+	out.WriteString("\n")
+
+	return out.String()
+}
+
+type ImportPackageStatement struct {
+	Spanned
+	Token token.Token
+	Path  string
+}
+
+func (ip *ImportPackageStatement) statementNode() {}
+func (ip *ImportPackageStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("\n")
+	out.WriteString("import ")
+	out.WriteString(`"`)
+	out.WriteString(ip.Path)
+	out.WriteString(`"`)
+	out.WriteString("\n")
+
+	return out.String()
+}
+
+type DeferStatement struct {
+	Spanned
+	Token      token.Token // the 'defer' token
+	Expression Expression
+}
+
+func (ds *DeferStatement) statementNode() {}
+func (ds *DeferStatement) String() string {
+	return "defer " + ds.Expression.String()
+}
+
+type SwitchStatement struct {
+	Spanned
+	Token token.Token // the 'switch' token
+	Value Expression
+	Cases []*CaseClause
+	Depth int
+}
+
+func (ss *SwitchStatement) statementNode() {}
+func (ss *SwitchStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("switch ")
+	out.WriteString(ss.Value.String())
+	out.WriteString(" {")
+	for _, clause := range ss.Cases {
+		out.WriteString("\n")
+		out.WriteString(indent(ss.Depth))
+		out.WriteString(clause.String())
+	}
+	out.WriteString("\n")
+	out.WriteString(indent(ss.Depth))
+	out.WriteString("}")
+	return out.String()
+}
+
+type CaseClause struct {
+	Spanned
+	Token      token.Token  // the 'case' or 'default' token
+	Values     []Expression // nil for the default clause
+	Statements []Statement
+	Comments   []token.Comment // comments after the colon outside nested blocks
+	Depth      int
+}
+
+func (cc *CaseClause) String() string {
+	var out bytes.Buffer
+
+	if cc.Values == nil {
+		out.WriteString("default:")
+	} else {
+		var values []string
+		for _, value := range cc.Values {
+			values = append(values, value.String())
+		}
+		out.WriteString("case ")
+		out.WriteString(strings.Join(values, ", "))
+		out.WriteString(":")
+	}
+	writeStatements(&out, cc.Statements, cc.Comments, cc.Depth)
+	return out.String()
+}
+
 type ImportStatement struct {
+	Spanned
+	Module        string // host module name, empty for the default module
+	Field         string // host field name, empty when it matches the function name
 	FuncSignature *FunctionSignature
 }
 
@@ -165,14 +491,59 @@ func (is *ImportStatement) String() string {
 	var out bytes.Buffer
 
 	out.WriteString("\n")
-	out.WriteString("import fn ")
+	out.WriteString("import ")
+	if is.Module != "" {
+		out.WriteString(`"`)
+		out.WriteString(is.Module)
+		out.WriteString(`" `)
+	}
+	out.WriteString(is.declaration())
+	out.WriteString("\n")
+
+	return out.String()
+}
+
+func (is *ImportStatement) declaration() string {
+	var out bytes.Buffer
+
+	if is.Field != "" {
+		out.WriteString(`"`)
+		out.WriteString(is.Field)
+		out.WriteString(`" `)
+	}
+	out.WriteString("fn ")
 	out.WriteString(is.FuncSignature.String())
+
+	return out.String()
+}
+
+type ImportBlockStatement struct {
+	Spanned
+	Module  string
+	Imports []*ImportStatement
+}
+
+func (ib *ImportBlockStatement) statementNode() {}
+func (ib *ImportBlockStatement) String() string {
+	var out bytes.Buffer
+
 	out.WriteString("\n")
+	out.WriteString("import ")
+	out.WriteString(`"`)
+	out.WriteString(ib.Module)
+	out.WriteString(`" {`)
+	for _, imp := range ib.Imports {
+		out.WriteString("\n")
+		out.WriteString(indent(1))
+		out.WriteString(imp.declaration())
+	}
+	out.WriteString("\n}\n")
 
 	return out.String()
 }
 
 type ExpressionStatement struct {
+	Spanned
 	Token      token.Token // the first token of the expression
 	Expression Expression
 }
@@ -186,6 +557,7 @@ func (es *ExpressionStatement) String() string {
 }
 
 type InitAssignExpression struct {
+	Spanned
 	LeftExp Expression
 	Type    string
 	Value   Expression
@@ -210,6 +582,7 @@ func (ia *InitAssignExpression) String() string {
 }
 
 type CallExpression struct {
+	Spanned
 	Token     token.Token // The '(' token
 	Function  Expression
 	Arguments []Expression
@@ -233,7 +606,9 @@ func (ce *CallExpression) String() string {
 }
 
 type AssignmentExpression struct {
+	Spanned
 	Token      token.Token
+	Operator   string // = or a compound assignment operator such as +=
 	Identifier Expression
 	Expression Expression
 }
@@ -243,16 +618,33 @@ func (as *AssignmentExpression) String() string {
 	var out bytes.Buffer
 
 	out.WriteString(as.Identifier.String())
-	out.WriteString(" = ")
+	out.WriteString(" ")
+	out.WriteString(as.Operator)
+	out.WriteString(" ")
 	if as.Expression != nil {
 		out.WriteString(as.Expression.String())
 	}
 	return out.String()
 }
 
+// IncDecStatement is x++ or x--
+type IncDecStatement struct {
+	Spanned
+	Token    token.Token // the ++ or -- token
+	Operator string
+	Operand  Expression
+}
+
+func (ids *IncDecStatement) statementNode() {}
+func (ids *IncDecStatement) String() string {
+	return ids.Operand.String() + ids.Operator
+}
+
 type IfExpression struct {
-	Condition Expression
-	Body      *BlockStatement
+	Spanned
+	Condition   Expression
+	Body        *BlockStatement
+	Alternative Node // *BlockStatement, *IfExpression for else if or nil without else
 }
 
 func (ie *IfExpression) expressionNode() {}
@@ -263,10 +655,81 @@ func (ie *IfExpression) String() string {
 	out.WriteString(ie.Condition.String())
 	out.WriteString(ie.Body.String())
 
+	switch alternative := ie.Alternative.(type) {
+	case *BlockStatement:
+		out.WriteString(" else")
+		out.WriteString(alternative.String())
+	case *IfExpression:
+		out.WriteString(" else ")
+		out.WriteString(alternative.String())
+	}
+
+	return out.String()
+}
+
+type SelectorExpression struct {
+	Spanned
+	Token token.Token // The '.' token
+	X     Expression
+	Sel   *Identifier
+}
+
+func (se *SelectorExpression) expressionNode() {}
+func (se *SelectorExpression) String() string {
+	return se.X.String() + "." + se.Sel.String()
+}
+
+type TryExpression struct {
+	Spanned
+	Token      token.Token // The '?' token
+	Expression Expression
+}
+
+func (te *TryExpression) expressionNode() {}
+func (te *TryExpression) String() string {
+	return te.Expression.String() + "?"
+}
+
+type IndexExpression struct {
+	Spanned
+	Token token.Token // The '[' token
+	Left  Expression
+	Index Expression
+}
+
+func (ie *IndexExpression) expressionNode() {}
+func (ie *IndexExpression) String() string {
+	return ie.Left.String() + "[" + ie.Index.String() + "]"
+}
+
+type SliceExpression struct {
+	Spanned
+	Token token.Token // The '[' token
+	Left  Expression
+	Low   Expression // nil when omitted
+	High  Expression // nil when omitted
+}
+
+func (se *SliceExpression) expressionNode() {}
+func (se *SliceExpression) String() string {
+	var out bytes.Buffer
+
+	out.WriteString(se.Left.String())
+	out.WriteString("[")
+	if se.Low != nil {
+		out.WriteString(se.Low.String())
+	}
+	out.WriteString(":")
+	if se.High != nil {
+		out.WriteString(se.High.String())
+	}
+	out.WriteString("]")
+
 	return out.String()
 }
 
 type InfixExpression struct {
+	Spanned
 	Token    token.Token // The operator token, e.g. +
 	Left     Expression
 	Operator string
@@ -287,6 +750,7 @@ func (oe *InfixExpression) String() string {
 }
 
 type Identifier struct {
+	Spanned
 	Token token.Token
 	Value string
 }
@@ -295,25 +759,65 @@ func (i *Identifier) expressionNode() {}
 func (i *Identifier) String() string  { return i.Value }
 
 type IntegerLiteral struct {
+	Spanned
 	Token token.Token
 	Value int64
+	Type  string // type suffix of the literal, empty for the default type
 }
 
 func (i *IntegerLiteral) expressionNode() {}
 func (i *IntegerLiteral) String() string  { return i.Token.Lit }
 
 type FloatLiteral struct {
+	Spanned
 	Token token.Token
 	Value float64
+	Type  string // type suffix of the literal, empty for the default type
 }
 
 func (f *FloatLiteral) expressionNode() {}
 func (f *FloatLiteral) String() string  { return f.Token.Lit }
 
 type String struct {
+	Spanned
 	Token token.Token
 	Value string
 }
 
 func (s *String) expressionNode() {}
-func (s *String) String() string  { return `"` + s.Value + `"` }
+func (s *String) String() string  { return quote(s.Value) }
+
+// quote returns a string literal with escape sequences for quotes, backslashes,
+// control characters and bytes that are not valid UTF-8
+func quote(value string) string {
+	var out bytes.Buffer
+
+	out.WriteString(`"`)
+	for i := 0; i < len(value); {
+		r, size := utf8.DecodeRuneInString(value[i:])
+
+		switch {
+		case r == '"' || r == '\\':
+			out.WriteRune('\\')
+			out.WriteRune(r)
+		case r == '\n':
+			out.WriteString(`\n`)
+		case r == '\t':
+			out.WriteString(`\t`)
+		case r == '\r':
+			out.WriteString(`\r`)
+		case r == 0:
+			out.WriteString(`\0`)
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&out, `\x%02x`, value[i])
+		case !unicode.IsPrint(r):
+			fmt.Fprintf(&out, `\u{%x}`, r)
+		default:
+			out.WriteString(value[i : i+size])
+		}
+		i += size
+	}
+	out.WriteString(`"`)
+
+	return out.String()
+}
@@ -0,0 +1,214 @@
+// Package cover reports the statement coverage of modules instrumented by the compiler
+package cover
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/drejca/shift/token"
+	"github.com/drejca/shift/wasm"
+)
+
+// Profile sums how often the statements of an instrumented module ran over
+// all instances the counters were read from
+type Profile struct {
+	coverage *wasm.Coverage
+	counts   []int64
+}
+
+// Function is the coverage of a function
+type Function struct {
+	Name       string
+	Pos        token.Position
+	Hits       int64 // how often the function was entered
+	Statements int
+	Covered    int // statements which ran at least once
+}
+
+// Percent returns the percentage of statements of the function which ran
+func (f Function) Percent() float64 {
+	return percent(f.Covered, f.Statements)
+}
+
+// New returns an empty profile of a module compiled with coverage
+func New(coverage *wasm.Coverage) *Profile {
+	return &Profile{coverage: coverage, counts: make([]int64, len(coverage.Statements))}
+}
+
+// Add adds the counters read from the globals of an instance of the module
+func (p *Profile) Add(globals []int64) {
+	for i := range p.counts {
+		if index := int(p.coverage.Global) + i; index < len(globals) {
+			p.counts[i] += int64(uint32(globals[index]))
+		}
+	}
+}
+
+// Percent returns the percentage of all statements which ran
+func (p *Profile) Percent() float64 {
+	covered := 0
+	for _, count := range p.counts {
+		if count > 0 {
+			covered++
+		}
+	}
+	return percent(covered, len(p.counts))
+}
+
+// Functions returns the coverage of every instrumented function in declaration order
+func (p *Profile) Functions() []Function {
+	var functions []Function
+
+	for _, covered := range p.coverage.Functions {
+		function := Function{Name: covered.Name, Pos: covered.Span.Start}
+		entry := -1
+		for i, stmt := range p.coverage.Statements {
+			if !contains(covered.Span, stmt.Start) {
+				continue
+			}
+			function.Statements++
+			if p.counts[i] > 0 {
+				function.Covered++
+			}
+			if entry == -1 || stmt.Start.Offset < p.coverage.Statements[entry].Start.Offset {
+				entry = i
+			}
+		}
+		if entry != -1 {
+			function.Hits = p.counts[entry]
+		}
+		functions = append(functions, function)
+	}
+	return functions
+}
+
+// Lines returns how often the statements starting on a line ran by file name and line.
+// Lines starting more than one statement take the highest count.
+func (p *Profile) Lines() map[string]map[int]int64 {
+	lines := make(map[string]map[int]int64)
+
+	for i, stmt := range p.coverage.Statements {
+		fileLines, found := lines[stmt.Start.Filename]
+		if !found {
+			fileLines = make(map[int]int64)
+			lines[stmt.Start.Filename] = fileLines
+		}
+		if count, found := fileLines[stmt.Start.Line]; !found || p.counts[i] > count {
+			fileLines[stmt.Start.Line] = p.counts[i]
+		}
+	}
+	return lines
+}
+
+// Files returns the sorted names of the files declaring instrumented functions
+func (p *Profile) Files() []string {
+	var filenames []string
+	seen := make(map[string]bool)
+	for _, function := range p.coverage.Functions {
+		if filename := function.Span.Start.Filename; !seen[filename] {
+			seen[filename] = true
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// WriteFunctions writes the coverage of every function followed by the total coverage
+//
+//	calc.sf:3:	Add	100.0%
+//	total:	(statements)	75.0%
+func (p *Profile) WriteFunctions(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 1, '\t', 0)
+
+	for _, function := range p.Functions() {
+		fmt.Fprintf(tw, "%s:%d:\t%s\t%.1f%%\n", function.Pos.Filename, function.Pos.Line, function.Name, function.Percent())
+	}
+	fmt.Fprintf(tw, "total:\t(statements)\t%.1f%%\n", p.Percent())
+	return tw.Flush()
+}
+
+// WriteLcov writes the profile as one lcov tracefile record per source file
+func (p *Profile) WriteLcov(w io.Writer) error {
+	lines := p.Lines()
+	functions := p.Functions()
+
+	bw := bufio.NewWriter(w)
+	for _, filename := range p.Files() {
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", filename)
+
+		found, hit := 0, 0
+		for _, function := range functions {
+			if function.Pos.Filename != filename {
+				continue
+			}
+			fmt.Fprintf(bw, "FN:%d,%s\n", function.Pos.Line, function.Name)
+			fmt.Fprintf(bw, "FNDA:%d,%s\n", function.Hits, function.Name)
+			found++
+			if function.Hits > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(bw, "FNF:%d\nFNH:%d\n", found, hit)
+
+		fileLines := sortedLines(lines[filename])
+		hit = 0
+		for _, line := range fileLines {
+			count := lines[filename][line]
+			fmt.Fprintf(bw, "DA:%d,%d\n", line, count)
+			if count > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", len(fileLines), hit)
+	}
+	return bw.Flush()
+}
+
+// Annotate writes the source of filename in the gcov format. Every line is prefixed
+// with how often its statements ran, ##### when they never ran and - without statements.
+func (p *Profile) Annotate(w io.Writer, filename string, src []byte) error {
+	counts := p.Lines()[filename]
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "%9s:%5d:Source:%s\n", "-", 0, filename)
+	lines := bytes.Split(bytes.TrimSuffix(src, []byte("\n")), []byte("\n"))
+	for i, line := range lines {
+		mark := "-"
+		if count, found := counts[i+1]; found {
+			mark = "#####"
+			if count > 0 {
+				mark = fmt.Sprint(count)
+			}
+		}
+		fmt.Fprintf(bw, "%9s:%5d:%s\n", mark, i+1, line)
+	}
+	return bw.Flush()
+}
+
+// contains reports whether pos lies within span in the same file
+func contains(span token.Span, pos token.Position) bool {
+	return span.Start.Filename == pos.Filename && span.Contains(pos.Offset)
+}
+
+func sortedLines(lines map[int]int64) []int {
+	sorted := make([]int, 0, len(lines))
+	for line := range lines {
+		sorted = append(sorted, line)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+// percent returns covered as percentage of total. Without statements there is
+// nothing left to cover, which counts as full coverage.
+func percent(covered int, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return 100 * float64(covered) / float64(total)
+}
@@ -0,0 +1,143 @@
+package cover_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/drejca/shift/assert"
+	"github.com/drejca/shift/cover"
+	"github.com/drejca/shift/vm"
+	"github.com/drejca/shift/wasm"
+	"github.com/drejca/shift/wasm/wasmtest"
+)
+
+const input = `fn Sign(a i32) : i32 {
+	if a == 0 {
+		return 0
+	}
+	return 1
+}
+
+fn unused() {
+}
+
+test "sign" {
+	expect_eq(Sign(3), 1)
+	expect_eq(Sign(4), 1)
+}
+
+fn TestZero() {
+	expect_eq(Sign(0), 0)
+}
+`
+
+func TestProfile(t *testing.T) {
+	profile := run(t, input, "sign")
+
+	var functions bytes.Buffer
+	if err := profile.WriteFunctions(&functions); err != nil {
+		t.Fatal(err)
+	}
+	expected := "sign.sf:1:\tSign\t\t66.7%\nsign.sf:8:\tunused\t\t100.0%\ntotal:\t\t(statements)\t66.7%\n"
+	if err := assert.EqualString(expected, functions.String()); err != nil {
+		t.Error(err)
+	}
+
+	var lcov bytes.Buffer
+	if err := profile.WriteLcov(&lcov); err != nil {
+		t.Fatal(err)
+	}
+	expected = `TN:
+SF:sign.sf
+FN:1,Sign
+FNDA:2,Sign
+FN:8,unused
+FNDA:0,unused
+FNF:2
+FNH:1
+DA:2,2
+DA:3,0
+DA:5,2
+LF:3
+LH:2
+end_of_record
+`
+	if err := assert.EqualString(expected, lcov.String()); err != nil {
+		t.Error(err)
+	}
+
+	var annotated bytes.Buffer
+	if err := profile.Annotate(&annotated, "sign.sf", []byte(input)); err != nil {
+		t.Fatal(err)
+	}
+	expected = `        -:    0:Source:sign.sf
+        -:    1:fn Sign(a i32) : i32 {
+        2:    2:	if a == 0 {
+    #####:    3:		return 0
+        -:    4:	}
+        2:    5:	return 1
+        -:    6:}
+`
+	if !strings.HasPrefix(annotated.String(), expected) {
+		t.Errorf("expected annotated source to start with\n%s\nbut got\n%s", expected, annotated.String())
+	}
+}
+
+// run compiles source with coverage and runs its test block with the name
+func run(t *testing.T, source string, name string) *cover.Profile {
+	code, compiler := wasmtest.Compile(t, "sign.sf", source, (*wasm.Compiler).IncludeTests, (*wasm.Compiler).Cover)
+
+	instance, err := vm.New(code, &vm.Host{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instance.Run(wasm.TestExportPrefix + name); err != nil {
+		t.Fatal(err)
+	}
+	if len(instance.Host.Errors) != 0 {
+		t.Fatalf("unexpected test failures %v", instance.Host.Errors)
+	}
+
+	profile := cover.New(compiler.Coverage())
+	profile.Add(instance.VM.Globals)
+	return profile
+}
+
+func TestIfValueBranches(t *testing.T) {
+	source := `fn Pick(a i32) : i32 {
+	return if a != 0 {
+		1
+	} else {
+		2
+	}
+}
+
+test "pick" {
+	expect_eq(Pick(1), 1)
+}
+`
+	profile := run(t, source, "pick")
+
+	var lcov bytes.Buffer
+	if err := profile.WriteLcov(&lcov); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "DA:2,1\nDA:3,1\nDA:5,0\n"; !strings.Contains(lcov.String(), expected) {
+		t.Errorf("expected lcov to count the branch values with\n%s\nbut got\n%s", expected, lcov.String())
+	}
+}
+
+func TestManyCounters(t *testing.T) {
+	var source strings.Builder
+	source.WriteString("test \"many\" {\n\tCount()\n}\n\nfn Count() {\n\ta := 0\n")
+	for i := 0; i < 300; i++ {
+		source.WriteString("\ta += 1\n")
+	}
+	source.WriteString("}\n")
+
+	profile := run(t, source.String(), "many")
+	if profile.Percent() != 100 {
+		t.Errorf("expected all 301 statements to be covered but got %.1f%%", profile.Percent())
+	}
+}
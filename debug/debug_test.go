@@ -0,0 +1,242 @@
+package debug_test
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/drejca/shift/debug"
+	"github.com/drejca/shift/vm"
+	"github.com/drejca/shift/wasm"
+	"github.com/drejca/shift/wasm/wasmtest"
+)
+
+const input = `fn Add(a i32, b i32) : i32 {
+	sum := a + b
+	return sum
+}
+
+fn Div(a i32, b i32) : i32 {
+	return Add(a, 0) / b
+}
+`
+
+// rows are the lines and columns of the line table entries in the order of their offset
+const rows = "[2:2 3:2 7:2 7:9 7:19]"
+
+// opcodes are the instructions the rows start at: get_local of the statements, the call
+// of Add and the i32.div_s which traps
+var opcodes = []byte{0x20, 0x20, 0x20, 0x10, 0x6d}
+
+func TestSourceMap(t *testing.T) {
+	code, compiler := wasmtest.Compile(t, "calc.sf", input, (*wasm.Compiler).TrackPositions)
+	lineTable := compiler.LineTable()
+	sourceMap := debug.NewSourceMap(lineTable)
+
+	if fmt.Sprint(sourceMap.Sources) != "[calc.sf]" {
+		t.Errorf("expected sources [calc.sf] but got %v", sourceMap.Sources)
+	}
+
+	var positions []string
+	offset, line, column := 0, 0, 0
+	for _, segment := range strings.Split(sourceMap.Mappings, ",") {
+		fields := decodeVLQ(t, segment)
+		if len(fields) != 4 {
+			t.Fatalf("expected 4 fields in segment %s but got %v", segment, fields)
+		}
+		offset, line, column = offset+fields[0], line+fields[2], column+fields[3]
+
+		if i := len(positions); i >= len(opcodes) || offset >= len(code) || code[offset] != opcodes[i] {
+			t.Errorf("mapping %d:%d has offset %d which does not start its code", line+1, column+1, offset)
+		}
+		positions = append(positions, fmt.Sprintf("%d:%d", line+1, column+1))
+	}
+	if actual := fmt.Sprint(positions); actual != rows {
+		t.Errorf("expected mappings %s but got %s", rows, actual)
+	}
+}
+
+func TestDWARF(t *testing.T) {
+	code, compiler := wasmtest.Compile(t, "calc.sf", input, (*wasm.Compiler).TrackPositions)
+	lineTable := compiler.LineTable()
+
+	// debug info describes the code a build without it emits
+	if plain, _ := wasmtest.Compile(t, "calc.sf", input); !bytes.Equal(code, plain) {
+		t.Errorf("expected the same module with and without a line table")
+	}
+
+	sections := make(map[string][]byte)
+	for _, section := range debug.DWARF(lineTable, "/src") {
+		sections[section.Name] = section.Data
+	}
+	data, err := dwarf.New(sections[".debug_abbrev"], nil, nil, sections[".debug_info"], sections[".debug_line"], nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unit, err := data.Reader().Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := unit.Val(dwarf.AttrName); name != "calc.sf" {
+		t.Errorf("expected compile unit calc.sf but got %v", name)
+	}
+	if compDir := unit.Val(dwarf.AttrCompDir); compDir != "/src" {
+		t.Errorf("expected compile directory /src but got %v", compDir)
+	}
+
+	lines, err := data.LineReader(unit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var positions []string
+	var entry dwarf.LineEntry
+	for {
+		if err := lines.Next(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if entry.EndSequence {
+			if int(entry.Address) != lineTable.CodeSize {
+				t.Errorf("expected sequence to end at %d but got %d", lineTable.CodeSize, entry.Address)
+			}
+			continue
+		}
+
+		if i, offset := len(positions), lineTable.CodeOffset+int(entry.Address); i >= len(opcodes) || code[offset] != opcodes[i] {
+			t.Errorf("row %d:%d has address %d which does not start its code", entry.Line, entry.Column, entry.Address)
+		}
+		if entry.File.Name != "/src/calc.sf" {
+			t.Errorf("expected file /src/calc.sf but got %s", entry.File.Name)
+		}
+		positions = append(positions, fmt.Sprintf("%d:%d", entry.Line, entry.Column))
+	}
+	if actual := fmt.Sprint(positions); actual != rows {
+		t.Errorf("expected rows %s but got %s", rows, actual)
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	input := `fn add(a i32, b i32) : i32 {
+	sum := a + b
+	return sum
+}
+
+fn main(v i32) : i32 {
+	name := "shift"
+	x := add(v, 2)
+	y := add(x, 3)
+	return y
+}
+`
+	code, compiler := wasmtest.Compile(t, "dir/calc.sf", input, (*wasm.Compiler).InsertStepHooks)
+
+	tests := []struct {
+		commands string
+		output   string
+		err      error
+	}{
+		{
+			commands: "b 1\nb calc.sf:3\nlocals\nc\nbt\np sum\np x\nfinish\nlocals\nclear 3\nc\n",
+			output: `stopped at dir/calc.sf:7:2 in main
+(debug) no statement at dir/calc.sf:1
+(debug) breakpoint 1 at calc.sf:3
+(debug) v i32 = 4
+(debug) stopped at dir/calc.sf:3:2 in add
+(debug) #0 add at dir/calc.sf:3:2
+#1 main at dir/calc.sf:8:7
+(debug) sum i32 = 6
+(debug) no variable x in scope
+(debug) stopped at dir/calc.sf:9:2 in main
+(debug) v i32 = 4
+name string = "shift"
+x i32 = 6
+(debug) cleared breakpoint at calc.sf:3
+(debug) `,
+		},
+		{
+			commands: "n\ns\nn\nn\nq\n",
+			output: `stopped at dir/calc.sf:7:2 in main
+(debug) stopped at dir/calc.sf:8:2 in main
+(debug) stopped at dir/calc.sf:2:2 in add
+(debug) stopped at dir/calc.sf:3:2 in add
+(debug) stopped at dir/calc.sf:9:2 in main
+(debug) `,
+			err: debug.ErrQuit,
+		},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		debugger := debug.New(compiler.LineTable(), strings.NewReader(test.commands), &out)
+		host := &vm.Host{Stdout: &out, Stderr: &out, LineTable: compiler.LineTable(), Step: debugger.Step}
+
+		instance, err := vm.New(code, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := instance.Run("main", 4); err != test.err {
+			t.Errorf("%q expected error %v but got %v", test.commands, test.err, err)
+		}
+		if out.String() != test.output {
+			t.Errorf("%q expected output\n%s\nbut got\n%s", test.commands, test.output, out.String())
+		}
+	}
+}
+
+func TestBreakpointInIfValue(t *testing.T) {
+	input := `fn main(v i32) : i32 {
+	return if v != 0 {
+		v + 1
+	} else {
+		0
+	}
+}
+`
+	code, compiler := wasmtest.Compile(t, "calc.sf", input, (*wasm.Compiler).InsertStepHooks)
+
+	var out bytes.Buffer
+	debugger := debug.New(compiler.LineTable(), strings.NewReader("b 3\nc\nc\n"), &out)
+	instance, err := vm.New(code, &vm.Host{Stdout: &out, Stderr: &out, LineTable: compiler.LineTable(), Step: debugger.Step})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instance.Run("main", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "stopped at calc.sf:2:2 in main\n(debug) breakpoint 1 at calc.sf:3\n(debug) stopped at calc.sf:3:3 in main\n(debug) "
+	if out.String() != expected {
+		t.Errorf("expected output\n%s\nbut got\n%s", expected, out.String())
+	}
+}
+
+func decodeVLQ(t *testing.T, segment string) []int {
+	const digits = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+	var values []int
+	value, shift := 0, uint(0)
+	for _, c := range segment {
+		digit := strings.IndexRune(digits, c)
+		if digit == -1 {
+			t.Fatalf("invalid base64 digit %c in segment %s", c, segment)
+		}
+		value |= (digit & 0x1f) << shift
+		shift += 5
+		if digit&0x20 != 0 {
+			continue
+		}
+		if value&1 == 1 {
+			values = append(values, -(value >> 1))
+		} else {
+			values = append(values, value>>1)
+		}
+		value, shift = 0, 0
+	}
+	return values
+}
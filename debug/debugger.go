@@ -0,0 +1,297 @@
+package debug
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/drejca/shift/token"
+	"github.com/drejca/shift/vm"
+	"github.com/drejca/shift/wasm"
+)
+
+// ErrQuit stops a debugged program when the debugger is quit
+var ErrQuit = errors.New("debugger quit")
+
+// Prompt is written before every command the debugger reads
+const Prompt = "(debug) "
+
+// Breakpoint stops the program at the first statement of a line
+type Breakpoint struct {
+	Filename string
+	Line     int
+}
+
+func (b Breakpoint) String() string {
+	return fmt.Sprintf("%s:%d", b.Filename, b.Line)
+}
+
+// at reports whether the breakpoint is at pos. A file name given without its
+// directory matches the file in any directory.
+func (b Breakpoint) at(pos token.Position) bool {
+	if b.Line != pos.Line {
+		return false
+	}
+	return pos.Filename == b.Filename || strings.HasSuffix(pos.Filename, "/"+b.Filename)
+}
+
+// same reports whether two breakpoints stop at the same line however their files are named
+func (b Breakpoint) same(other Breakpoint) bool {
+	return b.at(token.Position{Filename: other.Filename, Line: other.Line}) ||
+		other.at(token.Position{Filename: b.Filename, Line: b.Line})
+}
+
+// mode is how the program runs until the debugger stops it next
+type mode int
+
+const (
+	modeStep     mode = iota // stop at the next line
+	modeNext                 // stop at the next line of the stopped function or its callers
+	modeFinish               // stop at the next line of a caller of the stopped function
+	modeContinue             // stop at breakpoints only
+)
+
+// Debugger is the step hook of a program compiled with step hooks. It stops the
+// program at its first line, at breakpoints and after stepping, and reads commands
+// from its input until the program is resumed. Stepping stops at the next line,
+// finish stops at the next line of the caller after the call returned.
+type Debugger struct {
+	lineTable   *wasm.LineTable
+	in          *bufio.Scanner
+	out         io.Writer
+	breakpoints []Breakpoint
+	mode        mode
+	depth       int            // call depth the program was resumed at
+	last        token.Position // position of the last statement the program passed
+	lastDepth   int
+	sources     map[string][][]byte
+}
+
+// New returns a debugger of the program described by lineTable reading commands from in
+func New(lineTable *wasm.LineTable, in io.Reader, out io.Writer) *Debugger {
+	return &Debugger{
+		lineTable: lineTable,
+		in:        bufio.NewScanner(in),
+		out:       out,
+		mode:      modeStep,
+		sources:   make(map[string][][]byte),
+	}
+}
+
+// Step is called with the call stack before every statement and stops the program
+// when its mode, a breakpoint or both say so. It panics with ErrQuit when quit.
+func (d *Debugger) Step(stack vm.Stack) {
+	if len(stack) == 0 {
+		return
+	}
+	pos, depth := stack[0].Pos, len(stack)
+	newLine := pos.Filename != d.last.Filename || pos.Line != d.last.Line || depth != d.lastDepth
+	d.last, d.lastDepth = pos, depth
+
+	if !newLine || !d.stops(pos, depth) {
+		return
+	}
+	d.printStop(stack[0])
+
+	for {
+		fmt.Fprint(d.out, Prompt)
+		if !d.in.Scan() {
+			fmt.Fprintln(d.out)
+			panic(ErrQuit)
+		}
+		if d.command(strings.Fields(d.in.Text()), stack) {
+			d.depth = depth
+			return
+		}
+	}
+}
+
+// stops reports whether the program stops at pos with depth functions on the call stack
+func (d *Debugger) stops(pos token.Position, depth int) bool {
+	for _, breakpoint := range d.breakpoints {
+		if breakpoint.at(pos) {
+			return true
+		}
+	}
+
+	switch d.mode {
+	case modeStep:
+		return true
+	case modeNext:
+		return depth <= d.depth
+	case modeFinish:
+		return depth < d.depth
+	}
+	return false
+}
+
+// command runs a command and reports whether it resumes the program
+func (d *Debugger) command(args []string, stack vm.Stack) (resume bool) {
+	if len(args) == 0 {
+		return false
+	}
+
+	switch args[0] {
+	case "s", "step":
+		d.mode = modeStep
+		return true
+	case "n", "next":
+		d.mode = modeNext
+		return true
+	case "f", "finish":
+		d.mode = modeFinish
+		return true
+	case "c", "continue":
+		d.mode = modeContinue
+		return true
+	case "b", "break":
+		if len(args) != 2 {
+			fmt.Fprintln(d.out, "usage: break [file:]line")
+			return false
+		}
+		d.setBreakpoint(args[1], stack[0].Pos.Filename)
+	case "clear":
+		if len(args) != 2 {
+			fmt.Fprintln(d.out, "usage: clear [file:]line")
+			return false
+		}
+		d.clearBreakpoint(args[1], stack[0].Pos.Filename)
+	case "bt", "backtrace":
+		for i, frame := range stack {
+			fmt.Fprintf(d.out, "#%d %s at %s\n", i, frame.Function, frame.Pos)
+		}
+	case "l", "locals":
+		for _, variable := range stack[0].Variables {
+			fmt.Fprintf(d.out, "%s %s = %s\n", variable.Name, variable.Type, variable.Value)
+		}
+	case "p", "print":
+		if len(args) != 2 {
+			fmt.Fprintln(d.out, "usage: print name")
+			return false
+		}
+		d.printVariable(stack[0], args[1])
+	case "q", "quit":
+		panic(ErrQuit)
+	case "h", "help":
+		fmt.Fprint(d.out, help)
+	default:
+		fmt.Fprintf(d.out, "unknown command %s, try help\n", args[0])
+	}
+	return false
+}
+
+const help = `break, b [file:]line   stop at the first statement of line
+clear [file:]line      remove the breakpoint at line
+continue, c            run until the next breakpoint
+step, s                run to the next line
+next, n                run to the next line without stopping in called functions
+finish, f              run until the stopped function returned
+backtrace, bt          print the call stack
+locals, l              print the variables in scope
+print, p name          print a variable
+quit, q                stop the program
+`
+
+// setBreakpoint sets a breakpoint at location, which is a line in filename or file:line.
+// Only lines starting a statement can stop the program.
+func (d *Debugger) setBreakpoint(location string, filename string) {
+	breakpoint, err := parseBreakpoint(location, filename)
+	if err != nil {
+		fmt.Fprintln(d.out, err)
+		return
+	}
+	if !d.hasStatement(breakpoint) {
+		fmt.Fprintf(d.out, "no statement at %s\n", breakpoint)
+		return
+	}
+	for _, set := range d.breakpoints {
+		if set.same(breakpoint) {
+			fmt.Fprintf(d.out, "breakpoint at %s already set\n", set)
+			return
+		}
+	}
+	d.breakpoints = append(d.breakpoints, breakpoint)
+	fmt.Fprintf(d.out, "breakpoint %d at %s\n", len(d.breakpoints), breakpoint)
+}
+
+// clearBreakpoint removes the breakpoint at location
+func (d *Debugger) clearBreakpoint(location string, filename string) {
+	breakpoint, err := parseBreakpoint(location, filename)
+	if err != nil {
+		fmt.Fprintln(d.out, err)
+		return
+	}
+	for i, set := range d.breakpoints {
+		if set.same(breakpoint) {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			fmt.Fprintf(d.out, "cleared breakpoint at %s\n", set)
+			return
+		}
+	}
+	fmt.Fprintf(d.out, "no breakpoint at %s\n", breakpoint)
+}
+
+// parseBreakpoint parses file:line or a line in filename
+func parseBreakpoint(location string, filename string) (Breakpoint, error) {
+	line := location
+	if i := strings.LastIndex(location, ":"); i != -1 {
+		filename, line = location[:i], location[i+1:]
+	}
+	n, err := strconv.Atoi(line)
+	if err != nil || n < 1 {
+		return Breakpoint{}, fmt.Errorf("invalid line %q", line)
+	}
+	return Breakpoint{Filename: filename, Line: n}, nil
+}
+
+// hasStatement reports whether a statement starts on the line of breakpoint
+func (d *Debugger) hasStatement(breakpoint Breakpoint) bool {
+	for _, entry := range d.lineTable.Entries {
+		if breakpoint.at(entry.Pos) {
+			return true
+		}
+	}
+	return false
+}
+
+// printVariable prints the variable name of frame
+func (d *Debugger) printVariable(frame vm.Frame, name string) {
+	for _, variable := range frame.Variables {
+		if variable.Name == name {
+			fmt.Fprintf(d.out, "%s %s = %s\n", variable.Name, variable.Type, variable.Value)
+			return
+		}
+	}
+	fmt.Fprintf(d.out, "no variable %s in scope\n", name)
+}
+
+// printStop prints where the program stopped followed by the source line when its file can be read
+//
+//	stopped at calc.sf:9:3 in check
+//	9	error("zero")
+func (d *Debugger) printStop(frame vm.Frame) {
+	fmt.Fprintf(d.out, "stopped at %s in %s\n", frame.Pos, frame.Function)
+	if line, found := d.sourceLine(frame.Pos); found {
+		fmt.Fprintf(d.out, "%d\t%s\n", frame.Pos.Line, bytes.TrimSpace(line))
+	}
+}
+
+// sourceLine returns the line at pos of its file, which is read once
+func (d *Debugger) sourceLine(pos token.Position) ([]byte, bool) {
+	lines, found := d.sources[pos.Filename]
+	if !found {
+		if src, err := ioutil.ReadFile(pos.Filename); err == nil {
+			lines = bytes.Split(src, []byte("\n"))
+		}
+		d.sources[pos.Filename] = lines
+	}
+	if pos.Line < 1 || pos.Line > len(lines) {
+		return nil, false
+	}
+	return lines[pos.Line-1], true
+}
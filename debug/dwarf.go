@@ -0,0 +1,192 @@
+package debug
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"bitbucket.org/sheran_gunasekera/leb128"
+	"github.com/drejca/shift/wasm"
+)
+
+// Section is a custom section of DWARF debug info
+type Section struct {
+	Name string
+	Data []byte
+}
+
+// producer names the compiler in the DWARF compile unit
+const producer = "shiftc"
+
+// DWARF tags, attributes and forms used by the compile unit
+const (
+	tagCompileUnit = 0x11
+
+	attrName     = 0x03
+	attrStmtList = 0x10
+	attrLowPC    = 0x11
+	attrHighPC   = 0x12
+	attrCompDir  = 0x1b
+	attrProducer = 0x25
+
+	formAddr      = 0x01
+	formData4     = 0x06
+	formString    = 0x08
+	formSecOffset = 0x17
+)
+
+// Standard and extended line number program opcodes
+const (
+	lineCopy        = 0x01
+	lineAdvancePC   = 0x02
+	lineAdvanceLine = 0x03
+	lineSetFile     = 0x04
+	lineSetColumn   = 0x05
+
+	lineEndSequence = 0x01
+	lineSetAddress  = 0x02
+
+	lineOpcodeBase = 13
+)
+
+// DWARF returns the .debug_abbrev, .debug_info and .debug_line sections describing
+// the emitted module of lineTable as a single compile unit built in compDir.
+// Addresses are offsets into the content of the code section as in DWARF for wasm,
+// which the emitter records without adding code to the module.
+func DWARF(lineTable *wasm.LineTable, compDir string) []Section {
+	entries := sortedEntries(lineTable)
+
+	var files []string
+	fileIndex := make(map[string]int)
+	for _, entry := range entries {
+		if _, found := fileIndex[entry.Pos.Filename]; !found {
+			files = append(files, entry.Pos.Filename)
+			fileIndex[entry.Pos.Filename] = len(files) // files count from one
+		}
+	}
+
+	name := ""
+	if len(files) > 0 {
+		name = files[0]
+	}
+
+	return []Section{
+		{Name: ".debug_abbrev", Data: debugAbbrev()},
+		{Name: ".debug_info", Data: debugInfo(name, compDir, lineTable.CodeSize)},
+		{Name: ".debug_line", Data: debugLine(lineTable, entries, files, fileIndex)},
+	}
+}
+
+// debugAbbrev declares the compile unit abbreviation, the only one debug info uses
+func debugAbbrev() []byte {
+	var b bytes.Buffer
+	b.Write(leb128.EncodeULeb128(1))
+	b.Write(leb128.EncodeULeb128(tagCompileUnit))
+	b.WriteByte(0) // no children
+
+	for _, attr := range [][2]uint32{
+		{attrProducer, formString},
+		{attrName, formString},
+		{attrCompDir, formString},
+		{attrStmtList, formSecOffset},
+		{attrLowPC, formAddr},
+		{attrHighPC, formData4},
+	} {
+		b.Write(leb128.EncodeULeb128(attr[0]))
+		b.Write(leb128.EncodeULeb128(attr[1]))
+	}
+	b.Write([]byte{0, 0}) // end of attributes
+	b.WriteByte(0)        // end of abbreviations
+	return b.Bytes()
+}
+
+// debugInfo returns the compile unit covering all code with its line program at offset 0
+func debugInfo(name string, compDir string, codeSize int) []byte {
+	var die bytes.Buffer
+	die.Write(leb128.EncodeULeb128(1))
+	writeString(&die, producer)
+	writeString(&die, name)
+	writeString(&die, compDir)
+	binary.Write(&die, binary.LittleEndian, uint32(0))
+	binary.Write(&die, binary.LittleEndian, uint32(0))
+	binary.Write(&die, binary.LittleEndian, uint32(codeSize))
+
+	var header bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, uint16(4)) // version
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // abbreviations offset
+	header.WriteByte(4)                                   // address size
+
+	return withLength(append(header.Bytes(), die.Bytes()...))
+}
+
+// debugLine returns a version 4 line number program with one row per entry
+func debugLine(lineTable *wasm.LineTable, entries []*wasm.LineEntry, files []string, fileIndex map[string]int) []byte {
+	var header bytes.Buffer
+	header.WriteByte(1)                                      // minimum instruction length
+	header.WriteByte(1)                                      // maximum operations per instruction
+	header.WriteByte(1)                                      // is_stmt by default
+	header.WriteByte(0xfb)                                   // line base -5
+	header.WriteByte(14)                                     // line range
+	header.WriteByte(lineOpcodeBase)                         // first special opcode
+	header.Write([]byte{0, 1, 1, 1, 1, 0, 0, 0, 1, 0, 0, 1}) // operands of the standard opcodes
+	header.WriteByte(0)                                      // no include directories, files are relative to compDir
+	for _, file := range files {
+		writeString(&header, file)
+		header.Write([]byte{0, 0, 0}) // directory, modification time and length
+	}
+	header.WriteByte(0)
+
+	var program bytes.Buffer
+	program.Write([]byte{0, 5, lineSetAddress})
+	binary.Write(&program, binary.LittleEndian, uint32(0))
+
+	address, file, line, column := 0, 1, 1, 0
+	for _, entry := range entries {
+		if delta := lineTable.CodeAddress(entry) - address; delta > 0 {
+			program.WriteByte(lineAdvancePC)
+			program.Write(leb128.EncodeULeb128(uint32(delta)))
+			address += delta
+		}
+		if index := fileIndex[entry.Pos.Filename]; index != file {
+			program.WriteByte(lineSetFile)
+			program.Write(leb128.EncodeULeb128(uint32(index)))
+			file = index
+		}
+		if delta := entry.Pos.Line - line; delta != 0 {
+			program.WriteByte(lineAdvanceLine)
+			program.Write(leb128.EncodeSLeb128(int32(delta)))
+			line = entry.Pos.Line
+		}
+		if entry.Pos.Column != column {
+			program.WriteByte(lineSetColumn)
+			program.Write(leb128.EncodeULeb128(uint32(entry.Pos.Column)))
+			column = entry.Pos.Column
+		}
+		program.WriteByte(lineCopy)
+	}
+
+	if delta := lineTable.CodeSize - address; delta > 0 {
+		program.WriteByte(lineAdvancePC)
+		program.Write(leb128.EncodeULeb128(uint32(delta)))
+	}
+	program.Write([]byte{0, 1, lineEndSequence})
+
+	var unit bytes.Buffer
+	binary.Write(&unit, binary.LittleEndian, uint16(4)) // version
+	binary.Write(&unit, binary.LittleEndian, uint32(header.Len()))
+	unit.Write(header.Bytes())
+	unit.Write(program.Bytes())
+	return withLength(unit.Bytes())
+}
+
+// withLength prefixes a unit with its 32 bit length
+func withLength(unit []byte) []byte {
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(unit)))
+	return append(length, unit...)
+}
+
+// writeString writes a null terminated string
+func writeString(b *bytes.Buffer, s string) {
+	b.WriteString(s)
+	b.WriteByte(0)
+}
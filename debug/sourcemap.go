@@ -0,0 +1,93 @@
+// Package debug builds source-level debug info of modules compiled with a line table
+// and debugs programs compiled with step hooks
+package debug
+
+import (
+	"sort"
+	"strings"
+
+	"bitbucket.org/sheran_gunasekera/leb128"
+	"github.com/drejca/shift/wasm"
+)
+
+// SourceMappingURLSection is the custom section naming the source map of a module
+const SourceMappingURLSection = "sourceMappingURL"
+
+// SourceMap is a version 3 source map of an emitted module. As a module is a single
+// line of bytes, every mapping is on generated line 0 and its column is the byte
+// offset of the code in the module.
+type SourceMap struct {
+	Version  int      `json:"version"`
+	File     string   `json:"file,omitempty"`
+	Sources  []string `json:"sources"`
+	Names    []string `json:"names"`
+	Mappings string   `json:"mappings"`
+}
+
+// NewSourceMap returns the source map of the emitted module described by lineTable.
+// Sources are named as in the positions of the line table.
+func NewSourceMap(lineTable *wasm.LineTable) *SourceMap {
+	sourceMap := &SourceMap{Version: 3, Sources: []string{}, Names: []string{}}
+
+	sources := make(map[string]int)
+	var segments []string
+	var offset, source, line, column int
+	for _, entry := range sortedEntries(lineTable) {
+		index, found := sources[entry.Pos.Filename]
+		if !found {
+			index = len(sourceMap.Sources)
+			sources[entry.Pos.Filename] = index
+			sourceMap.Sources = append(sourceMap.Sources, entry.Pos.Filename)
+		}
+
+		// source map lines and columns count from zero
+		segments = append(segments, encodeVLQ(entry.Offset-offset)+encodeVLQ(index-source)+
+			encodeVLQ(entry.Pos.Line-1-line)+encodeVLQ(entry.Pos.Column-1-column))
+		offset, source, line, column = entry.Offset, index, entry.Pos.Line-1, entry.Pos.Column-1
+	}
+	sourceMap.Mappings = strings.Join(segments, ",")
+	return sourceMap
+}
+
+// SourceMappingURL returns the payload of the custom section pointing to the source map at url
+func SourceMappingURL(url string) []byte {
+	return append(leb128.EncodeULeb128(uint32(len(url))), url...)
+}
+
+const base64Digits = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// encodeVLQ encodes a value as base64 VLQ. The lowest bit of the first digit holds the sign.
+func encodeVLQ(value int) string {
+	vlq := value << 1
+	if value < 0 {
+		vlq = (-value << 1) | 1
+	}
+
+	var out strings.Builder
+	for {
+		digit := vlq & 0x1f
+		vlq >>= 5
+		if vlq > 0 {
+			digit |= 0x20
+		}
+		out.WriteByte(base64Digits[digit])
+		if vlq == 0 {
+			return out.String()
+		}
+	}
+}
+
+// sortedEntries returns the entries of lineTable with a position in the order of their
+// offset. Entries starting at the same offset keep the order they were compiled in.
+func sortedEntries(lineTable *wasm.LineTable) []*wasm.LineEntry {
+	var entries []*wasm.LineEntry
+	for _, entry := range lineTable.Entries {
+		if entry.Pos.Line > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(a, b int) bool {
+		return entries[a].Offset < entries[b].Offset
+	})
+	return entries
+}
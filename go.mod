@@ -4,7 +4,7 @@ replace github.com/go-interpreter/wagon => github.com/perlin-network/wagon v0.3.
 
 require (
 	bitbucket.org/sheran_gunasekera/leb128 v0.0.0-20140310100139-ab5288260bc3
-	github.com/go-interpreter/wagon v0.4.0 // indirect
+	github.com/go-interpreter/wagon v0.4.0
 	github.com/perlin-network/life v0.0.0-20190402092845-c30697b41680
 	github.com/urfave/cli v1.20.0
 	google.golang.org/appengine v1.6.1 // indirect
@@ -3,7 +3,10 @@ package lexer
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/drejca/shift/token"
 )
@@ -16,40 +19,89 @@ type Lexer struct {
 	buffer bytes.Buffer
 
 	pos      token.Position
+	start    token.Position // position of the first character of the current token
+	lastSize int            // size in bytes of the last read rune
 	curRune  rune
 	peekRune rune
+
+	comments []token.Comment
+
+	// insertSemi is set when a newline following the last token ends a statement
+	insertSemi bool
+
+	err *Error
+}
+
+// Error is a malformed token found by the lexer
+type Error struct {
+	Pos token.Position
+	End token.Position // position just after the malformed token
+	Err error
+}
+
+func (e Error) Position() token.Position {
+	return e.Pos
+}
+
+// Span returns the source range of the malformed token
+func (e Error) Span() token.Span {
+	return token.Span{Start: e.Pos, End: e.End}
+}
+func (e Error) Error() error {
+	return e.Err
 }
 
 // New returns new lexer
 func New(input io.Reader) *Lexer {
+	return NewFile("", input)
+}
+
+// NewFile returns new lexer recording filename in the positions of its tokens
+func NewFile(filename string, input io.Reader) *Lexer {
 	lex := &Lexer{
 		reader: bufio.NewReader(input),
-		pos:    token.Position{Line: 1, Column: 1},
+		pos:    token.Position{Filename: filename, Line: 1, Column: 1},
 	}
 	return lex
 }
 
-// NextToken returns next token ends on token.EOF
+// NextToken returns next token ends on token.EOF. Comments read before the
+// token are attached to it, comments at the end of input to token.EOF.
+//
+// A newline or the end of input is returned as token.SEMICOLON with literal "\n"
+// when the last token on the line is an identifier, a literal, return, ?, ++, --, or a
+// closing ), ] or }. A line ending in an operator or , continues the statement.
 func (l *Lexer) NextToken() token.Token {
+	tok := l.next()
+	tok.Comments = l.comments
+	l.comments = nil
+
+	switch tok.Type {
+	case token.IDENT, token.INT, token.FLOAT, token.STRING, token.CHAR,
+		token.RETURN, token.QUESTION, token.INC, token.DEC, token.RPAREN, token.RBRACKET, token.RCURLY:
+		l.insertSemi = true
+	default:
+		l.insertSemi = false
+	}
+	return tok
+}
+
+func (l *Lexer) next() token.Token {
+	l.start = l.pos
 	ch := l.read()
 
 	if isNewLine(ch) {
+		semicolon := l.Token(token.SEMICOLON, "\n")
 		l.pos.Line++
-		l.pos.Column = 1
-		l.skipNewLine()
-		return l.NextToken()
-	}
-	if ch == '\r' {
-		l.pos.Line++
-		l.pos.Column = 1
-		ch = l.read()
-		if ch == '\n' {
-			return l.NextToken()
+		l.skipNewLine(ch)
+		if l.insertSemi {
+			return semicolon
 		}
+		return l.next()
 	}
 	if isWhitespace(ch) {
 		l.skipWhitespace()
-		return l.NextToken()
+		return l.next()
 	}
 	if isLetter(ch) {
 		l.unread()
@@ -71,6 +123,12 @@ func (l *Lexer) NextToken() token.Token {
 		return l.Token(token.COLON, string(ch))
 	case ';':
 		return l.Token(token.SEMICOLON, string(ch))
+	case '.':
+		return l.Token(token.DOT, string(ch))
+	case '@':
+		return l.Token(token.AT, string(ch))
+	case '?':
+		return l.Token(token.QUESTION, string(ch))
 	case '(':
 		return l.Token(token.LPAREN, string(ch))
 	case ')':
@@ -79,12 +137,67 @@ func (l *Lexer) NextToken() token.Token {
 		return l.Token(token.LCURLY, string(ch))
 	case '}':
 		return l.Token(token.RCURLY, string(ch))
+	case '[':
+		return l.Token(token.LBRACKET, string(ch))
+	case ']':
+		return l.Token(token.RBRACKET, string(ch))
 	case '+':
+		switch l.peek() {
+		case '+':
+			l.read()
+			return l.Token(token.INC, "++")
+		case '=':
+			l.read()
+			return l.Token(token.ADD_ASSIGN, "+=")
+		}
 		return l.Token(token.PLUS, string(ch))
 	case '-':
+		switch l.peek() {
+		case '-':
+			l.read()
+			return l.Token(token.DEC, "--")
+		case '=':
+			l.read()
+			return l.Token(token.SUB_ASSIGN, "-=")
+		}
 		return l.Token(token.MINUS, string(ch))
 	case '*':
-		return l.Token(token.ASTERISK, string(ch))
+		return l.operator(token.ASTERISK, token.MUL_ASSIGN)
+	case '%':
+		return l.operator(token.PERCENT, token.REM_ASSIGN)
+	case '&':
+		return l.operator(token.AMPERSAND, token.AND_ASSIGN)
+	case '|':
+		return l.operator(token.PIPE, token.OR_ASSIGN)
+	case '^':
+		return l.operator(token.CARET, token.XOR_ASSIGN)
+	case '<':
+		if l.peek() == '<' {
+			l.read()
+			return l.operator(token.SHL, token.SHL_ASSIGN)
+		}
+		return l.Token(token.ILLEGAL, string(ch))
+	case '>':
+		if l.peek() == '>' {
+			l.read()
+			return l.operator(token.SHR, token.SHR_ASSIGN)
+		}
+		return l.Token(token.ILLEGAL, string(ch))
+	case '/':
+		switch l.peek() {
+		case '/':
+			l.readLineComment()
+			return l.next()
+		case '*':
+			if tok, ok := l.readBlockComment(); !ok {
+				return tok
+			}
+			if l.insertSemi && l.comments[len(l.comments)-1].EndLine() > l.start.Line {
+				return token.Token{Type: token.SEMICOLON, Lit: "\n", Pos: l.start, End: l.start}
+			}
+			return l.next()
+		}
+		return l.operator(token.SLASH, token.QUO_ASSIGN)
 	case '!':
 		if l.peek() == '=' {
 			l.read()
@@ -92,23 +205,89 @@ func (l *Lexer) NextToken() token.Token {
 		}
 		return l.Token(token.BANG, string(ch))
 	case '=':
+		if l.peek() == '=' {
+			l.read()
+			return l.Token(token.EQ, string("=="))
+		}
 		return l.Token(token.ASSIGN, string(ch))
 	case '"':
 		return l.readString()
+	case '`':
+		return l.readRawString()
+	case '\'':
+		return l.readChar()
 	case eof:
-		return l.Token(token.EOF, string(ch))
+		if l.insertSemi {
+			l.unread()
+			return token.Token{Type: token.SEMICOLON, Lit: "\n", Pos: l.start, End: l.start}
+		}
+		return token.Token{Type: token.EOF, Lit: string(ch), Pos: l.start, End: l.start}
 	default:
 		return l.Token(token.ILLEGAL, string(ch))
 	}
 }
 
-func (l *Lexer) skipNewLine() {
+// readLineComment reads a // comment up to the end of the line
+func (l *Lexer) readLineComment() {
+	start := l.start
 	l.buffer.Reset()
-	ch := l.read()
-	if ch != '\n' {
-		l.unread()
+	l.buffer.WriteRune('/')
+	for {
+		ch := l.read()
+		if ch == eof || isNewLine(ch) {
+			l.unread()
+			break
+		}
+		l.buffer.WriteRune(ch)
+	}
+	l.comments = append(l.comments, token.Comment{Text: l.buffer.String(), Pos: start})
+}
+
+// readBlockComment reads a /* */ comment which may span lines and contain nested
+// block comments. An unterminated comment is returned as token.ILLEGAL.
+func (l *Lexer) readBlockComment() (token.Token, bool) {
+	start := l.start
+	l.buffer.Reset()
+	l.buffer.WriteRune('/')
+	l.buffer.WriteRune(l.read())
+
+	depth := 1
+	for depth > 0 {
+		ch := l.read()
+
+		if ch == eof {
+			l.unread()
+			return l.illegal(start, fmt.Errorf("unterminated block comment")), false
+		}
+
+		switch {
+		case ch == '/' && l.peek() == '*':
+			depth++
+			l.buffer.WriteRune(ch)
+			ch = l.read()
+		case ch == '*' && l.peek() == '/':
+			depth--
+			l.buffer.WriteRune(ch)
+			ch = l.read()
+		case ch == '\r':
+			continue
+		case ch == '\n':
+			l.pos.Line++
+			l.pos.Column = 1
+		}
+		l.buffer.WriteRune(ch)
 	}
+	l.comments = append(l.comments, token.Comment{Text: l.buffer.String(), Pos: start})
+	return token.Token{}, true
+}
+
+// skipNewLine skips the \n of a \r\n line ending
+func (l *Lexer) skipNewLine(ch rune) {
 	l.buffer.Reset()
+	if ch == '\r' && l.peek() == '\n' {
+		l.read()
+	}
+	l.pos.Column = 1
 }
 
 func (l *Lexer) skipWhitespace() {
@@ -126,77 +305,300 @@ func (l *Lexer) readIdentifier() token.Token {
 	l.buffer.Reset()
 	for {
 		ch := l.read()
-		if !isLetter(ch) && !isDigit(ch) {
+		if !isLetter(ch) && !unicode.IsDigit(ch) {
 			l.unread()
 			break
 		}
 		l.buffer.WriteRune(ch)
 	}
 	tok := token.LookupIdent(l.buffer.String())
-	tok.Pos = l.pos
-	tok.Pos.Column = tok.Pos.Column - len(tok.Lit)
+	tok.Pos = l.start
+	tok.End = l.pos
 	return tok
 }
 
+// readNumber reads decimal, hexadecimal (0x), binary (0b) and octal (0o) integers and
+// decimal floats with an optional exponent. Digits may be separated by _ and the number
+// may end with a type suffix such as i64 or f32. The literal is validated by the parser.
 func (l *Lexer) readNumber() token.Token {
+	l.buffer.Reset()
+	tokenType := token.INT
+
+	ch := l.read()
+	l.buffer.WriteRune(ch)
+
+	if ch == '0' && isBasePrefix(l.peek()) {
+		l.buffer.WriteRune(l.read())
+		l.readDigits(isHexDigit)
+	} else {
+		l.readDigits(isDigit)
+
+		if l.peek() == '.' {
+			tokenType = token.FLOAT
+			l.buffer.WriteRune(l.read())
+			l.readDigits(isDigit)
+		}
+
+		if ch := l.peek(); ch == 'e' || ch == 'E' {
+			tokenType = token.FLOAT
+			l.buffer.WriteRune(l.read())
+			if ch := l.peek(); ch == '+' || ch == '-' {
+				l.buffer.WriteRune(l.read())
+			}
+			l.readDigits(isDigit)
+		}
+	}
+
+	for ch := l.peek(); isLetter(ch) || isDigit(ch); ch = l.peek() {
+		l.buffer.WriteRune(l.read())
+	}
+	return l.Token(tokenType, l.buffer.String())
+}
+
+func (l *Lexer) readDigits(isValid func(ch rune) bool) {
+	for ch := l.peek(); isValid(ch) || ch == '_'; ch = l.peek() {
+		l.buffer.WriteRune(l.read())
+	}
+}
+
+// readString reads a string literal and replaces its escape sequences with the bytes they stand for
+func (l *Lexer) readString() token.Token {
+	start := l.start
 	l.buffer.Reset()
 	for {
 		ch := l.read()
 
-		if ch == '.' {
-			return l.readFloat()
+		if ch == eof || isNewLine(ch) {
+			l.unread()
+			return l.illegal(start, fmt.Errorf("unterminated string literal"))
 		}
 
-		if !isDigit(ch) {
-			l.unread()
+		if ch == '"' {
 			break
 		}
+
+		if ch == '\\' {
+			escapePos := l.startPos()
+			value, isByte, err := decodeEscape(l.readEscape())
+			if err != nil {
+				return l.illegal(escapePos, err)
+			}
+			if isByte {
+				l.buffer.WriteByte(byte(value))
+			} else {
+				l.buffer.WriteRune(value)
+			}
+			continue
+		}
+
 		l.buffer.WriteRune(ch)
 	}
-	tok := l.Token(token.INT, l.buffer.String())
-	return tok
+	return token.Token{Type: token.STRING, Lit: l.buffer.String(), Pos: start, End: l.pos}
 }
 
-func (l *Lexer) readFloat() token.Token {
-	l.buffer.WriteRune('.')
+// readRawString reads a string literal in backquotes which may span lines and has no escape sequences
+func (l *Lexer) readRawString() token.Token {
+	start := l.start
+	l.buffer.Reset()
 	for {
 		ch := l.read()
 
-		if !isDigit(ch) {
+		if ch == eof {
 			l.unread()
+			return l.illegal(start, fmt.Errorf("unterminated raw string literal"))
+		}
+
+		if ch == '`' {
 			break
 		}
+
+		if ch == '\r' {
+			continue
+		}
+		if ch == '\n' {
+			l.pos.Line++
+			l.pos.Column = 1
+		}
 		l.buffer.WriteRune(ch)
 	}
-	tok := l.Token(token.FLOAT, l.buffer.String())
-	return tok
+	return token.Token{Type: token.STRING, Lit: l.buffer.String(), Pos: start, End: l.pos}
 }
 
-func (l *Lexer) readString() token.Token {
+// readChar reads a single quoted rune literal. The literal of the token is its
+// source text, CharValue returns the value it stands for.
+func (l *Lexer) readChar() token.Token {
+	start := l.start
 	l.buffer.Reset()
+	l.buffer.WriteRune('\'')
+
+	count := 0
 	for {
 		ch := l.read()
 
-		if ch == eof {
-			return l.Token(token.EOF, string(ch))
+		if ch == eof || isNewLine(ch) {
+			l.unread()
+			return l.illegal(start, fmt.Errorf("unterminated rune literal"))
 		}
 
-		if ch == '"' {
+		l.buffer.WriteRune(ch)
+		if ch == '\'' {
 			break
 		}
+		count++
 
-		l.buffer.WriteRune(ch)
+		if ch == '\\' {
+			escapePos := l.startPos()
+			escape := l.readEscape()
+			if _, _, err := decodeEscape(escape); err != nil {
+				return l.illegal(escapePos, err)
+			}
+			l.buffer.WriteString(escape)
+		}
 	}
-	tok := l.Token(token.STRING, l.buffer.String())
-	return tok
 
+	switch {
+	case count == 0:
+		return l.illegal(start, fmt.Errorf("empty rune literal"))
+	case count > 1:
+		return l.illegal(start, fmt.Errorf("more than one character in rune literal"))
+	}
+	return token.Token{Type: token.CHAR, Lit: l.buffer.String(), Pos: start, End: l.pos}
+}
+
+// readEscape reads the source text of an escape sequence following a backslash
+func (l *Lexer) readEscape() string {
+	var escape bytes.Buffer
+
+	ch := l.read()
+	if ch == eof || isNewLine(ch) {
+		l.unread()
+		return ""
+	}
+	escape.WriteRune(ch)
+
+	switch ch {
+	case 'x':
+		for i := 0; i < 2; i++ {
+			ch := l.read()
+			if !isHexDigit(ch) {
+				l.unread()
+				break
+			}
+			escape.WriteRune(ch)
+		}
+	case 'u':
+		if l.peek() != '{' {
+			break
+		}
+		for {
+			ch := l.read()
+			if ch == eof || isNewLine(ch) || ch == '"' || ch == '\'' {
+				l.unread()
+				break
+			}
+			escape.WriteRune(ch)
+			if ch == '}' {
+				break
+			}
+		}
+	}
+	return escape.String()
+}
+
+// decodeEscape returns the value of an escape sequence without its backslash.
+// \xNN stands for a single byte, all other escapes for a unicode code point.
+func decodeEscape(escape string) (value rune, isByte bool, err error) {
+	switch escape {
+	case "n":
+		return '\n', false, nil
+	case "t":
+		return '\t', false, nil
+	case "r":
+		return '\r', false, nil
+	case "0":
+		return 0, false, nil
+	case "\\", "\"", "'":
+		return rune(escape[0]), false, nil
+	}
+
+	switch {
+	case len(escape) > 0 && escape[0] == 'x':
+		if len(escape) != 3 {
+			return 0, false, fmt.Errorf("invalid escape sequence \\%s, expected two hex digits", escape)
+		}
+		return rune(hexValue(escape[1:])), true, nil
+	case len(escape) > 0 && escape[0] == 'u':
+		digits := escape[1:]
+		if len(digits) < 3 || digits[0] != '{' || digits[len(digits)-1] != '}' {
+			return 0, false, fmt.Errorf("invalid escape sequence \\%s, expected \\u{...}", escape)
+		}
+		digits = digits[1 : len(digits)-1]
+		for _, ch := range digits {
+			if !isHexDigit(ch) {
+				return 0, false, fmt.Errorf("invalid escape sequence \\%s, expected hex digits", escape)
+			}
+		}
+		if len(digits) > 6 || !utf8.ValidRune(rune(hexValue(digits))) {
+			return 0, false, fmt.Errorf("escape sequence \\%s is not a valid unicode code point", escape)
+		}
+		return rune(hexValue(digits)), false, nil
+	}
+	return 0, false, fmt.Errorf("unknown escape sequence \\%s", escape)
+}
+
+// CharValue returns the value of a rune literal read by the lexer
+func CharValue(literal string) (rune, error) {
+	if len(literal) < 3 || literal[0] != '\'' || literal[len(literal)-1] != '\'' {
+		return 0, fmt.Errorf("invalid rune literal %s", literal)
+	}
+	body := literal[1 : len(literal)-1]
+
+	if body[0] == '\\' {
+		value, _, err := decodeEscape(body[1:])
+		return value, err
+	}
+	value, size := utf8.DecodeRuneInString(body)
+	if size != len(body) {
+		return 0, fmt.Errorf("more than one character in rune literal")
+	}
+	return value, nil
+}
+
+// startPos returns the position of the last read character
+func (l *Lexer) startPos() token.Position {
+	pos := l.pos
+	pos.Column--
+	pos.Offset -= l.lastSize
+	return pos
+}
+
+// illegal records the first malformed token and returns it as token.ILLEGAL
+func (l *Lexer) illegal(pos token.Position, err error) token.Token {
+	if l.err == nil {
+		l.err = &Error{Pos: pos, End: l.pos, Err: err}
+	}
+	return token.Token{Type: token.ILLEGAL, Lit: err.Error(), Pos: pos, End: l.pos}
+}
+
+// Err returns the first malformed token found by the lexer
+func (l *Lexer) Err() token.CompileError {
+	if l.err == nil {
+		return nil
+	}
+	return *l.err
+}
+
+// operator returns the operator read so far or its compound assignment form when followed by =
+func (l *Lexer) operator(operator token.Type, assign token.Type) token.Token {
+	if l.peek() == '=' {
+		l.read()
+		return l.Token(assign, token.Print(assign))
+	}
+	return l.Token(operator, token.Print(operator))
 }
 
 func (l *Lexer) Token(tokenType token.Type, literal string) token.Token {
-	tok := token.Token{Type: tokenType, Lit: literal}
-	tok.Pos = l.pos
-	tok.Pos.Column = tok.Pos.Column - len(tok.Lit)
-	return tok
+	return token.Token{Type: tokenType, Lit: literal, Pos: l.start, End: l.pos}
 }
 
 func (l *Lexer) peek() rune {
@@ -206,17 +608,42 @@ func (l *Lexer) peek() rune {
 }
 
 func (l *Lexer) read() rune {
-	ch, _, _ := l.reader.ReadRune()
+	ch, size, _ := l.reader.ReadRune()
 	l.pos.Column++
+	l.pos.Offset += size
+	l.lastSize = size
 	return ch
 }
 
 func (l *Lexer) unread() {
 	l.reader.UnreadRune()
 	l.pos.Column--
+	l.pos.Offset -= l.lastSize
+	l.lastSize = 0
 }
 
 func isNewLine(ch rune) bool    { return ch == '\n' || ch == '\r' }
 func isWhitespace(ch rune) bool { return ch == ' ' || ch == '\t' }
-func isLetter(ch rune) bool     { return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' }
+func isLetter(ch rune) bool     { return unicode.IsLetter(ch) || ch == '_' }
 func isDigit(ch rune) bool      { return '0' <= ch && ch <= '9' }
+func isBasePrefix(ch rune) bool {
+	return ch == 'x' || ch == 'X' || ch == 'b' || ch == 'B' || ch == 'o' || ch == 'O'
+}
+func isHexDigit(ch rune) bool {
+	return isDigit(ch) || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
+}
+
+func hexValue(digits string) (value int64) {
+	for _, ch := range digits {
+		value <<= 4
+		switch {
+		case isDigit(ch):
+			value |= int64(ch - '0')
+		case 'a' <= ch && ch <= 'f':
+			value |= int64(ch - 'a' + 10)
+		default:
+			value |= int64(ch - 'A' + 10)
+		}
+	}
+	return value
+}
@@ -1,6 +1,7 @@
 package lexer_test
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 
@@ -43,7 +44,9 @@ func TestNextToken(t *testing.T) {
 				{tokenType: token.IDENT, literal: "a"},
 				{tokenType: token.PLUS, literal: "+"},
 				{tokenType: token.IDENT, literal: "b"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
 				{tokenType: token.RCURLY, literal: "}"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
 				{tokenType: token.EOF, literal: string(rune(token.EOF))},
 			},
 		},
@@ -75,6 +78,7 @@ func TestNextToken(t *testing.T) {
 				{tokenType: token.INT, literal: "4"},
 				{tokenType: token.PLUS, literal: "+"},
 				{tokenType: token.INT, literal: "5"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
 				{tokenType: token.EOF, literal: string(rune(token.EOF))},
 			},
 		},
@@ -87,6 +91,7 @@ func TestNextToken(t *testing.T) {
 				{tokenType: token.IDENT, literal: "a"},
 				{tokenType: token.PLUS, literal: "+"},
 				{tokenType: token.INT, literal: "2"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
 				{tokenType: token.EOF, literal: string(rune(token.EOF))},
 			},
 		},
@@ -99,6 +104,7 @@ func TestNextToken(t *testing.T) {
 				{tokenType: token.IDENT, literal: "a"},
 				{tokenType: token.ASTERISK, literal: "*"},
 				{tokenType: token.INT, literal: "2"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
 				{tokenType: token.EOF, literal: string(rune(token.EOF))},
 			},
 		},
@@ -109,6 +115,7 @@ func TestNextToken(t *testing.T) {
 				{tokenType: token.IDENT, literal: "f"},
 				{tokenType: token.INIT_ASSIGN, literal: ":="},
 				{tokenType: token.FLOAT, literal: "0.6"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
 				{tokenType: token.EOF, literal: string(rune(token.EOF))},
 			},
 		},
@@ -123,6 +130,7 @@ func TestNextToken(t *testing.T) {
 				{tokenType: token.IDENT, literal: "num"},
 				{tokenType: token.IDENT, literal: "i32"},
 				{tokenType: token.RPAREN, literal: ")"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
 				{tokenType: token.EOF, literal: string(rune(token.EOF))},
 			},
 		},
@@ -136,6 +144,7 @@ func TestNextToken(t *testing.T) {
 				{tokenType: token.IDENT, literal: "f"},
 				{tokenType: token.LCURLY, literal: "{"},
 				{tokenType: token.RCURLY, literal: "}"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
 				{tokenType: token.EOF, literal: string(rune(token.EOF))},
 			},
 		},
@@ -146,6 +155,7 @@ func TestNextToken(t *testing.T) {
 				{tokenType: token.IDENT, literal: "name"},
 				{tokenType: token.INIT_ASSIGN, literal: ":="},
 				{tokenType: token.STRING, literal: "shift"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
 				{tokenType: token.EOF, literal: string(rune(token.EOF))},
 			},
 		},
@@ -156,6 +166,206 @@ func TestNextToken(t *testing.T) {
 				{tokenType: token.IDENT, literal: "interpolate"},
 				{tokenType: token.INIT_ASSIGN, literal: ":="},
 				{tokenType: token.STRING, literal: "this $a variable"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.EOF, literal: string(rune(token.EOF))},
+			},
+		},
+		{
+			name:  "package clause",
+			input: `package calc`,
+			outputs: []output{
+				{tokenType: token.PACKAGE, literal: "package"},
+				{tokenType: token.IDENT, literal: "calc"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.EOF, literal: string(rune(token.EOF))},
+			},
+		},
+		{
+			name: "package import and qualified call",
+			input: `import "numbers"
+			numbers.Add(1, 2)`,
+			outputs: []output{
+				{tokenType: token.IMPORT, literal: "import"},
+				{tokenType: token.STRING, literal: "numbers"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.IDENT, literal: "numbers"},
+				{tokenType: token.DOT, literal: "."},
+				{tokenType: token.IDENT, literal: "Add"},
+				{tokenType: token.LPAREN, literal: "("},
+				{tokenType: token.INT, literal: "1"},
+				{tokenType: token.COMMA, literal: ","},
+				{tokenType: token.INT, literal: "2"},
+				{tokenType: token.RPAREN, literal: ")"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.EOF, literal: string(rune(token.EOF))},
+			},
+		},
+		{
+			name:  "function attribute",
+			input: `@export("calc")`,
+			outputs: []output{
+				{tokenType: token.AT, literal: "@"},
+				{tokenType: token.IDENT, literal: "export"},
+				{tokenType: token.LPAREN, literal: "("},
+				{tokenType: token.STRING, literal: "calc"},
+				{tokenType: token.RPAREN, literal: ")"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.EOF, literal: string(rune(token.EOF))},
+			},
+		},
+		{
+			name:  "result type and error propagation",
+			input: `fn parse() : i32!i32 { return check()? }`,
+			outputs: []output{
+				{tokenType: token.FUNC, literal: "fn"},
+				{tokenType: token.IDENT, literal: "parse"},
+				{tokenType: token.LPAREN, literal: "("},
+				{tokenType: token.RPAREN, literal: ")"},
+				{tokenType: token.COLON, literal: ":"},
+				{tokenType: token.IDENT, literal: "i32"},
+				{tokenType: token.BANG, literal: "!"},
+				{tokenType: token.IDENT, literal: "i32"},
+				{tokenType: token.LCURLY, literal: "{"},
+				{tokenType: token.RETURN, literal: "return"},
+				{tokenType: token.IDENT, literal: "check"},
+				{tokenType: token.LPAREN, literal: "("},
+				{tokenType: token.RPAREN, literal: ")"},
+				{tokenType: token.QUESTION, literal: "?"},
+				{tokenType: token.RCURLY, literal: "}"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.EOF, literal: string(rune(token.EOF))},
+			},
+		},
+		{
+			name:  "string index, slice and comparison",
+			input: `s[1] == s[0:len(s)]`,
+			outputs: []output{
+				{tokenType: token.IDENT, literal: "s"},
+				{tokenType: token.LBRACKET, literal: "["},
+				{tokenType: token.INT, literal: "1"},
+				{tokenType: token.RBRACKET, literal: "]"},
+				{tokenType: token.EQ, literal: "=="},
+				{tokenType: token.IDENT, literal: "s"},
+				{tokenType: token.LBRACKET, literal: "["},
+				{tokenType: token.INT, literal: "0"},
+				{tokenType: token.COLON, literal: ":"},
+				{tokenType: token.IDENT, literal: "len"},
+				{tokenType: token.LPAREN, literal: "("},
+				{tokenType: token.IDENT, literal: "s"},
+				{tokenType: token.RPAREN, literal: ")"},
+				{tokenType: token.RBRACKET, literal: "]"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.EOF, literal: string(rune(token.EOF))},
+			},
+		},
+		{
+			name:  "string escape sequences",
+			input: `"tab\tquote\"slash\\\x41\u{e9}\0"`,
+			outputs: []output{
+				{tokenType: token.STRING, literal: "tab\tquote\"slash\\A\u00e9\x00"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.EOF, literal: string(rune(token.EOF))},
+			},
+		},
+		{
+			name:  "string with byte escape",
+			input: `"\xff"`,
+			outputs: []output{
+				{tokenType: token.STRING, literal: "\xff"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.EOF, literal: string(rune(token.EOF))},
+			},
+		},
+		{
+			name:  "raw string",
+			input: "`first \\n\r\nsecond`",
+			outputs: []output{
+				{tokenType: token.STRING, literal: "first \\n\nsecond"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.EOF, literal: string(rune(token.EOF))},
+			},
+		},
+		{
+			name:  "rune literals",
+			input: `'a' '\n' '\'' '\u{1F600}' 'é'`,
+			outputs: []output{
+				{tokenType: token.CHAR, literal: `'a'`},
+				{tokenType: token.CHAR, literal: `'\n'`},
+				{tokenType: token.CHAR, literal: `'\''`},
+				{tokenType: token.CHAR, literal: `'\u{1F600}'`},
+				{tokenType: token.CHAR, literal: `'é'`},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.EOF, literal: string(rune(token.EOF))},
+			},
+		},
+		{
+			name:  "unterminated string",
+			input: "\"shift\n",
+			outputs: []output{
+				{tokenType: token.ILLEGAL, literal: "unterminated string literal"},
+				{tokenType: token.EOF, literal: string(rune(token.EOF))},
+			},
+		},
+		{
+			name:  "compound assignment and increment operators",
+			input: "a += 1 -= *= /= %= &= |= ^= <<= >>= / % & | ^ << >> a++\nb--",
+			outputs: []output{
+				{tokenType: token.IDENT, literal: "a"},
+				{tokenType: token.ADD_ASSIGN, literal: "+="},
+				{tokenType: token.INT, literal: "1"},
+				{tokenType: token.SUB_ASSIGN, literal: "-="},
+				{tokenType: token.MUL_ASSIGN, literal: "*="},
+				{tokenType: token.QUO_ASSIGN, literal: "/="},
+				{tokenType: token.REM_ASSIGN, literal: "%="},
+				{tokenType: token.AND_ASSIGN, literal: "&="},
+				{tokenType: token.OR_ASSIGN, literal: "|="},
+				{tokenType: token.XOR_ASSIGN, literal: "^="},
+				{tokenType: token.SHL_ASSIGN, literal: "<<="},
+				{tokenType: token.SHR_ASSIGN, literal: ">>="},
+				{tokenType: token.SLASH, literal: "/"},
+				{tokenType: token.PERCENT, literal: "%"},
+				{tokenType: token.AMPERSAND, literal: "&"},
+				{tokenType: token.PIPE, literal: "|"},
+				{tokenType: token.CARET, literal: "^"},
+				{tokenType: token.SHL, literal: "<<"},
+				{tokenType: token.SHR, literal: ">>"},
+				{tokenType: token.IDENT, literal: "a"},
+				{tokenType: token.INC, literal: "++"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.IDENT, literal: "b"},
+				{tokenType: token.DEC, literal: "--"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.EOF, literal: string(rune(token.EOF))},
+			},
+		},
+		{
+			name:  "unicode identifiers",
+			input: `größe := _tmp1 + π2 * 名前`,
+			outputs: []output{
+				{tokenType: token.IDENT, literal: "größe"},
+				{tokenType: token.INIT_ASSIGN, literal: ":="},
+				{tokenType: token.IDENT, literal: "_tmp1"},
+				{tokenType: token.PLUS, literal: "+"},
+				{tokenType: token.IDENT, literal: "π2"},
+				{tokenType: token.ASTERISK, literal: "*"},
+				{tokenType: token.IDENT, literal: "名前"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
+				{tokenType: token.EOF, literal: string(rune(token.EOF))},
+			},
+		},
+		{
+			name:  "number literals",
+			input: `0xFF 0b1010 0o17 1_000_000 1.5e-3 2E+10 10i64 2.5f32`,
+			outputs: []output{
+				{tokenType: token.INT, literal: "0xFF"},
+				{tokenType: token.INT, literal: "0b1010"},
+				{tokenType: token.INT, literal: "0o17"},
+				{tokenType: token.INT, literal: "1_000_000"},
+				{tokenType: token.FLOAT, literal: "1.5e-3"},
+				{tokenType: token.FLOAT, literal: "2E+10"},
+				{tokenType: token.INT, literal: "10i64"},
+				{tokenType: token.FLOAT, literal: "2.5f32"},
+				{tokenType: token.SEMICOLON, literal: "\n"},
 				{tokenType: token.EOF, literal: string(rune(token.EOF))},
 			},
 		},
@@ -183,6 +393,67 @@ func TestNextToken(t *testing.T) {
 	}
 }
 
+func TestCharValue(t *testing.T) {
+	tests := []struct {
+		literal string
+		value   rune
+	}{
+		{literal: `'a'`, value: 'a'},
+		{literal: `'\t'`, value: '\t'},
+		{literal: `'\\'`, value: '\\'},
+		{literal: `'\x7f'`, value: 0x7f},
+		{literal: `'\u{e9}'`, value: 'é'},
+		{literal: `'é'`, value: 'é'},
+	}
+
+	for _, test := range tests {
+		value, err := lexer.CharValue(test.literal)
+		if err != nil {
+			t.Errorf("%s - unexpected error %s", test.literal, err)
+		}
+		if value != test.value {
+			t.Errorf("%s - expected %d but got %d", test.literal, test.value, value)
+		}
+	}
+}
+
+func TestLexerErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+		pos   token.Position
+	}{
+		{input: `a := "shift`, err: "unterminated string literal", pos: token.Position{Offset: 5, Line: 1, Column: 6}},
+		{input: "a := `shift\nlang", err: "unterminated raw string literal", pos: token.Position{Offset: 5, Line: 1, Column: 6}},
+		{input: `a := "sh\qift"`, err: `unknown escape sequence \q`, pos: token.Position{Offset: 8, Line: 1, Column: 9}},
+		{input: `a := "\x4"`, err: `invalid escape sequence \x4, expected two hex digits`, pos: token.Position{Offset: 6, Line: 1, Column: 7}},
+		{input: `a := "\u{110000}"`, err: `escape sequence \u{110000} is not a valid unicode code point`, pos: token.Position{Offset: 6, Line: 1, Column: 7}},
+		{input: `a := ''`, err: "empty rune literal", pos: token.Position{Offset: 5, Line: 1, Column: 6}},
+		{input: `a := 'ab'`, err: "more than one character in rune literal", pos: token.Position{Offset: 5, Line: 1, Column: 6}},
+		{input: `a := 'a`, err: "unterminated rune literal", pos: token.Position{Offset: 5, Line: 1, Column: 6}},
+		{input: "a\r\n\n\r\nb := \"c", err: "unterminated string literal", pos: token.Position{Offset: 11, Line: 4, Column: 6}},
+		{input: "a /* outer /* inner */\n", err: "unterminated block comment", pos: token.Position{Offset: 2, Line: 1, Column: 3}},
+	}
+
+	for _, test := range tests {
+		lex := lexer.New(strings.NewReader(test.input))
+		for lex.NextToken().Type != token.EOF {
+		}
+
+		err := lex.Err()
+		if err == nil {
+			t.Errorf("%s - expected error %q", test.input, test.err)
+			continue
+		}
+		if err.Error().Error() != test.err {
+			t.Errorf("%s - expected error %q but got %q", test.input, test.err, err.Error())
+		}
+		if err.Position() != test.pos {
+			t.Errorf("%s - expected position %+v but got %+v", test.input, test.pos, err.Position())
+		}
+	}
+}
+
 func TestTokenPosition(t *testing.T) {
 	t.Parallel()
 
@@ -212,7 +483,9 @@ fn Sub(a i32, b i32) : i32 {
 		{tokenType: token.IDENT, literal: "a", pos: token.Position{Line: 3, Column: 9}},
 		{tokenType: token.MINUS, literal: "-", pos: token.Position{Line: 3, Column: 11}},
 		{tokenType: token.IDENT, literal: "b", pos: token.Position{Line: 3, Column: 13}},
+		{tokenType: token.SEMICOLON, literal: "\n", pos: token.Position{Line: 3, Column: 14}},
 		{tokenType: token.RCURLY, literal: "}", pos: token.Position{Line: 4, Column: 1}},
+		{tokenType: token.SEMICOLON, literal: "\n", pos: token.Position{Line: 4, Column: 2}},
 		{tokenType: token.EOF, literal: string(rune(token.EOF)), pos: token.Position{Line: 5, Column: 1}},
 	}
 
@@ -238,3 +511,86 @@ fn Sub(a i32, b i32) : i32 {
 		}
 	}
 }
+
+func TestComments(t *testing.T) {
+	input := `// Sub subtracts
+// b from a
+fn Sub(a i32, b i32) : i32 { // body
+	/* outer /* nested */
+	still outer */ return a - b
+}
+// end`
+	tests := []struct {
+		tokenType token.Type
+		comments  []token.Comment
+	}{
+		{tokenType: token.FUNC, comments: []token.Comment{
+			{Text: "// Sub subtracts", Pos: token.Position{Line: 1, Column: 1}},
+			{Text: "// b from a", Pos: token.Position{Offset: 17, Line: 2, Column: 1}},
+		}},
+		{tokenType: token.RETURN, comments: []token.Comment{
+			{Text: "// body", Pos: token.Position{Offset: 58, Line: 3, Column: 30}},
+			{Text: "/* outer /* nested */\n\tstill outer */", Pos: token.Position{Offset: 67, Line: 4, Column: 2}},
+		}},
+		{tokenType: token.RCURLY},
+		{tokenType: token.EOF, comments: []token.Comment{
+			{Text: "// end", Pos: token.Position{Offset: 120, Line: 7, Column: 1}},
+		}},
+	}
+
+	lex := lexer.New(strings.NewReader(input))
+
+	i := 0
+	for i < len(tests) {
+		tok := lex.NextToken()
+		if tok.Type != tests[i].tokenType {
+			if tok.Type == token.EOF {
+				t.Fatalf("expected %s token", token.Print(tests[i].tokenType))
+			}
+			continue
+		}
+		if fmt.Sprint(tok.Comments) != fmt.Sprint(tests[i].comments) {
+			t.Errorf("%s - expected comments %v but got %v", token.Print(tok.Type), tests[i].comments, tok.Comments)
+		}
+		if tok.Type == token.RETURN && tok.Pos != (token.Position{Offset: 105, Line: 5, Column: 17}) {
+			t.Errorf("expected return after block comment at 5:17 but got %+v", tok.Pos)
+		}
+		i++
+	}
+}
+
+func TestTokenSpan(t *testing.T) {
+	input := `s := "héllo" + 'é'`
+
+	tests := []struct {
+		literal string
+		start   token.Position
+		end     token.Position
+	}{
+		{literal: "s", start: token.Position{Offset: 0, Line: 1, Column: 1}, end: token.Position{Offset: 1, Line: 1, Column: 2}},
+		{literal: ":=", start: token.Position{Offset: 2, Line: 1, Column: 3}, end: token.Position{Offset: 4, Line: 1, Column: 5}},
+		{literal: "héllo", start: token.Position{Offset: 5, Line: 1, Column: 6}, end: token.Position{Offset: 13, Line: 1, Column: 13}},
+		{literal: "+", start: token.Position{Offset: 14, Line: 1, Column: 14}, end: token.Position{Offset: 15, Line: 1, Column: 15}},
+		{literal: "'é'", start: token.Position{Offset: 16, Line: 1, Column: 16}, end: token.Position{Offset: 20, Line: 1, Column: 19}},
+		{literal: "\n", start: token.Position{Offset: 20, Line: 1, Column: 19}, end: token.Position{Offset: 20, Line: 1, Column: 19}},
+		{literal: string(rune(token.EOF)), start: token.Position{Offset: 20, Line: 1, Column: 19}, end: token.Position{Offset: 20, Line: 1, Column: 19}},
+	}
+
+	lex := lexer.NewFile("span.sf", strings.NewReader(input))
+
+	for _, test := range tests {
+		tok := lex.NextToken()
+		test.start.Filename = "span.sf"
+		test.end.Filename = "span.sf"
+
+		if tok.Lit != test.literal {
+			t.Fatalf("expected token %q but got %q", test.literal, tok.Lit)
+		}
+		if tok.Pos != test.start {
+			t.Errorf("%q - expected start %+v but got %+v", test.literal, test.start, tok.Pos)
+		}
+		if tok.End != test.end {
+			t.Errorf("%q - expected end %+v but got %+v", test.literal, test.end, tok.End)
+		}
+	}
+}
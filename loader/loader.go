@@ -0,0 +1,173 @@
+package loader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/drejca/shift/ast"
+	"github.com/drejca/shift/parser"
+	"github.com/drejca/shift/token"
+)
+
+// SourceExt is the file extension of Shift source files
+const SourceExt = ".sf"
+
+// ParseError is a parse error in one of the loaded files
+type ParseError struct {
+	Filename string
+	Err      token.CompileError
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.Filename, e.Err.Position().Line, e.Err.Position().Column, e.Err.Error())
+}
+
+// Loader reads Shift packages from the file system and orders them by their imports
+type Loader struct {
+	root     string
+	packages map[string]*ast.Package
+	loading  []string
+	order    []*ast.Package
+}
+
+// Load reads the package at path and all packages it imports. Path is either
+// a single source file or a directory holding the files of the root package.
+// Import paths are resolved relative to the root package directory. Packages
+// are returned in dependency order with the root package last.
+func Load(path string) ([]*ast.Package, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Loader{packages: make(map[string]*ast.Package)}
+
+	var files []string
+	if info.IsDir() {
+		l.root = path
+		files, err = sourceFiles(path)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		l.root = filepath.Dir(path)
+		files = []string{path}
+	}
+
+	err = l.loadPackage("", files)
+	if err != nil {
+		return nil, err
+	}
+	return l.order, nil
+}
+
+func (l *Loader) loadPackage(importPath string, files []string) error {
+	if len(files) == 0 {
+		return fmt.Errorf("no Shift source files in %s", filepath.Join(l.root, importPath))
+	}
+
+	l.loading = append(l.loading, importPath)
+	defer func() { l.loading = l.loading[:len(l.loading)-1] }()
+
+	pkg := &ast.Package{Path: importPath}
+
+	for _, filename := range files {
+		program, err := parseFile(filename)
+		if err != nil {
+			return err
+		}
+
+		name := program.PackageName()
+		if pkg.Name == "" {
+			pkg.Name = name
+		} else if pkg.Name != name {
+			return fmt.Errorf("found packages %s (%s) and %s (%s) in %s", pkg.Name, filepath.Base(pkg.Files[0].Filename), name, filepath.Base(filename), filepath.Dir(filename))
+		}
+		pkg.Files = append(pkg.Files, program)
+	}
+
+	if importPath != "" && pkg.Name == "main" {
+		return fmt.Errorf("import %q is a program, not an importable package", importPath)
+	}
+
+	for _, program := range pkg.Files {
+		for _, path := range program.Imports() {
+			err := l.importPackage(program.Filename, path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	l.packages[importPath] = pkg
+	l.order = append(l.order, pkg)
+	return nil
+}
+
+func (l *Loader) importPackage(filename string, importPath string) error {
+	for i, path := range l.loading {
+		if path == importPath {
+			cycle := append(append([]string{}, l.loading[i:]...), importPath)
+			return fmt.Errorf("%s: import cycle not allowed: %s", filename, strings.Join(quote(cycle), " -> "))
+		}
+	}
+
+	if _, loaded := l.packages[importPath]; loaded {
+		return nil
+	}
+
+	if filepath.IsAbs(importPath) || strings.HasPrefix(importPath, ".") {
+		return fmt.Errorf("%s: invalid import path %q", filename, importPath)
+	}
+
+	dir := filepath.Join(l.root, filepath.FromSlash(importPath))
+	files, err := sourceFiles(dir)
+	if err != nil {
+		return fmt.Errorf("%s: cannot find package %q in %s", filename, importPath, dir)
+	}
+	return l.loadPackage(importPath, files)
+}
+
+func parseFile(filename string) (*ast.Program, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	p := parser.NewFile(filename, file)
+	program, parseErr := p.ParseProgram()
+	if parseErr != nil {
+		return nil, &ParseError{Filename: filename, Err: parseErr}
+	}
+	program.Filename = filename
+	return program, nil
+}
+
+func sourceFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == SourceExt {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func quote(paths []string) []string {
+	quoted := make([]string, len(paths))
+	for i, path := range paths {
+		quoted[i] = fmt.Sprintf("%q", path)
+	}
+	return quoted
+}
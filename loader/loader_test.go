@@ -0,0 +1,75 @@
+package loader_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/drejca/shift/loader"
+)
+
+func TestLoadSingleFile(t *testing.T) {
+	packages, err := loader.Load("../testprogram/main.sf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(packages) != 1 {
+		t.Fatalf("expected 1 package but got %d", len(packages))
+	}
+	if packages[0].Name != "main" {
+		t.Errorf("expected package main but got %s", packages[0].Name)
+	}
+	if len(packages[0].Files) != 1 {
+		t.Errorf("expected 1 file but got %d", len(packages[0].Files))
+	}
+}
+
+func TestLoadOrdersPackagesByImports(t *testing.T) {
+	packages, err := loader.Load("../testprogram/packages/calc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		name  string
+		path  string
+		files []string
+	}{
+		{name: "numbers", path: "numbers", files: []string{"add.sf", "multiply.sf"}},
+		{name: "main", path: "", files: []string{"calc.sf", "main.sf"}},
+	}
+
+	if len(packages) != len(expected) {
+		t.Fatalf("expected %d packages but got %d", len(expected), len(packages))
+	}
+
+	for i, pkg := range packages {
+		if pkg.Name != expected[i].name {
+			t.Errorf("%d) expected package %s but got %s", i, expected[i].name, pkg.Name)
+		}
+		if pkg.Path != expected[i].path {
+			t.Errorf("%d) expected path %q but got %q", i, expected[i].path, pkg.Path)
+		}
+		if len(pkg.Files) != len(expected[i].files) {
+			t.Fatalf("%d) expected %d files but got %d", i, len(expected[i].files), len(pkg.Files))
+		}
+		for j, file := range pkg.Files {
+			if filepath.Base(file.Filename) != expected[i].files[j] {
+				t.Errorf("%d) expected file %s but got %s", i, expected[i].files[j], file.Filename)
+			}
+		}
+	}
+}
+
+func TestLoadImportCycle(t *testing.T) {
+	_, err := loader.Load("../testprogram/packages/cycle")
+	if err == nil {
+		t.Fatal("expected import cycle error")
+	}
+
+	expected := `import cycle not allowed: "a" -> "b" -> "a"`
+	if !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected error %q but got %q", expected, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 
 	"github.com/drejca/shift/ast"
 	"github.com/drejca/shift/lexer"
@@ -13,21 +14,43 @@ import (
 const (
 	_ int = iota
 	LOWEST
-	EQUALS  // =, :=, ==, !=
-	SUM     // +, -
-	PRODUCT // *, /
+	EQUALS  // =, :=, +=, ==, !=
+	SUM     // +, -, |, ^
+	PRODUCT // *, /, %, &, <<, >>
 	CALL
+	SELECTOR
 )
 
 var precedences = map[token.Type]int{
 	token.INIT_ASSIGN: EQUALS,
 	token.ASSIGN:      EQUALS,
+	token.ADD_ASSIGN:  EQUALS,
+	token.SUB_ASSIGN:  EQUALS,
+	token.MUL_ASSIGN:  EQUALS,
+	token.QUO_ASSIGN:  EQUALS,
+	token.REM_ASSIGN:  EQUALS,
+	token.AND_ASSIGN:  EQUALS,
+	token.OR_ASSIGN:   EQUALS,
+	token.XOR_ASSIGN:  EQUALS,
+	token.SHL_ASSIGN:  EQUALS,
+	token.SHR_ASSIGN:  EQUALS,
+	token.EQ:          EQUALS,
 	token.NOT_EQ:      EQUALS,
 	token.PLUS:        SUM,
 	token.MINUS:       SUM,
+	token.PIPE:        SUM,
+	token.CARET:       SUM,
 	token.ASTERISK:    PRODUCT,
+	token.SLASH:       PRODUCT,
+	token.PERCENT:     PRODUCT,
+	token.AMPERSAND:   PRODUCT,
+	token.SHL:         PRODUCT,
+	token.SHR:         PRODUCT,
 	token.RPAREN:      LOWEST,
 	token.LPAREN:      CALL,
+	token.LBRACKET:    CALL,
+	token.DOT:         SELECTOR,
+	token.QUESTION:    CALL,
 }
 
 type Parser struct {
@@ -40,6 +63,9 @@ type Parser struct {
 	infixParseFns  map[token.Type]infixParseFn
 
 	blockDepth int
+
+	comments    []token.Comment // comments read in the block or case clause being parsed
+	allComments []token.Comment
 }
 
 type ParseError struct {
@@ -60,13 +86,19 @@ type (
 )
 
 func New(input io.Reader) *Parser {
-	p := &Parser{l: lexer.New(input)}
+	return NewFile("", input)
+}
+
+// NewFile returns a parser recording filename in the positions of the parsed nodes
+func NewFile(filename string, input io.Reader) *Parser {
+	p := &Parser{l: lexer.NewFile(filename, input)}
 
 	p.prefixParseFns = make(map[token.Type]prefixParseFn)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
 	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
+	p.registerPrefix(token.CHAR, p.parseCharLiteral)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.IF, p.parseIfExpression)
 
@@ -74,11 +106,28 @@ func New(input io.Reader) *Parser {
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
 	p.registerInfix(token.MINUS, p.parseInfixExpression)
 	p.registerInfix(token.ASTERISK, p.parseInfixExpression)
+	p.registerInfix(token.SLASH, p.parseInfixExpression)
+	p.registerInfix(token.PERCENT, p.parseInfixExpression)
+	p.registerInfix(token.AMPERSAND, p.parseInfixExpression)
+	p.registerInfix(token.PIPE, p.parseInfixExpression)
+	p.registerInfix(token.CARET, p.parseInfixExpression)
+	p.registerInfix(token.SHL, p.parseInfixExpression)
+	p.registerInfix(token.SHR, p.parseInfixExpression)
 	p.registerInfix(token.INIT_ASSIGN, p.parseInitAssignExpression)
 	p.registerInfix(token.ASSIGN, p.parseAssignmentExpression)
+	for _, assign := range []token.Type{
+		token.ADD_ASSIGN, token.SUB_ASSIGN, token.MUL_ASSIGN, token.QUO_ASSIGN, token.REM_ASSIGN,
+		token.AND_ASSIGN, token.OR_ASSIGN, token.XOR_ASSIGN, token.SHL_ASSIGN, token.SHR_ASSIGN,
+	} {
+		p.registerInfix(assign, p.parseAssignmentExpression)
+	}
+	p.registerInfix(token.EQ, p.parseInfixExpression)
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
+	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
+	p.registerInfix(token.DOT, p.parseSelectorExpression)
+	p.registerInfix(token.QUESTION, p.parseTryExpression)
 
 	p.nextToken()
 	p.nextToken()
@@ -87,34 +136,108 @@ func New(input io.Reader) *Parser {
 
 func (p *Parser) ParseProgram() (*ast.Program, token.CompileError) {
 	program := &ast.Program{}
+	program.Extent.Start = token.Position{Filename: p.curToken.Pos.Filename, Line: 1, Column: 1}
 
 	for p.curToken.Type != token.EOF {
+		if p.curTokenIs(token.SEMICOLON) {
+			p.nextToken()
+			continue
+		}
+
 		stmt, err := p.parseGlobalStatement()
 		if err != nil {
-			return nil, err
+			return nil, p.firstError(err)
+		}
+		if pkg, ok := stmt.(*ast.PackageStatement); ok && len(program.Statements) > 0 {
+			return nil, p.parseError(fmt.Errorf("package clause must be first in file"), pkg.Token, pkg.Token.Pos.Column-1)
+		}
+		if err := p.endStatement(token.EOF); err != nil {
+			return nil, p.firstError(err)
 		}
 		if stmt != nil {
 			program.Statements = append(program.Statements, stmt)
 		}
 		p.nextToken()
 	}
+	if err := p.l.Err(); err != nil {
+		return nil, err
+	}
+	program.Extent.End = p.curToken.End
+	program.Comments = p.allComments
 	return program, nil
 }
 
+// firstError prefers a malformed token found by the lexer over a parse error
+// following it, as the parse error is usually caused by the malformed token
+func (p *Parser) firstError(err token.CompileError) token.CompileError {
+	lexErr := p.l.Err()
+	if lexErr == nil {
+		return err
+	}
+
+	lexPos, pos := lexErr.Position(), err.Position()
+	if lexPos.Line < pos.Line || lexPos.Line == pos.Line && lexPos.Column <= pos.Column+1 {
+		return lexErr
+	}
+	return err
+}
+
 func (p *Parser) parseGlobalStatement() (ast.Statement, token.CompileError) {
 	switch p.curToken.Type {
-	case token.FUNC:
-		return p.parseFunc()
+	case token.FUNC, token.AT:
+		doc := docComments(p.curToken)
+
+		var fn *ast.Function
+		var err token.CompileError
+		if p.curTokenIs(token.AT) {
+			fn, err = p.parseAttributedFunc()
+		} else {
+			fn, err = p.parseFunc()
+		}
+		if err != nil {
+			return nil, err
+		}
+		fn.Doc = doc
+		return fn, nil
 	case token.IMPORT:
-		return p.parseImportStatement()
+		return p.parseImport()
+	case token.PACKAGE:
+		return p.parsePackageStatement()
+	case token.IDENT:
+		// test is not a keyword, so it stays usable as a name inside functions
+		if p.curToken.Lit == "test" && p.peekTokenIs(token.STRING) {
+			return p.parseTestBlock()
+		}
+		if p.curToken.Lit == "test" && (p.peekTokenIs(token.LCURLY) || p.peekTokenIs(token.IDENT)) {
+			return nil, ParseError{Pos: p.curToken.Pos, Err: fmt.Errorf("test block needs a name string")}
+		}
 	}
 	return nil, p.parseError(fmt.Errorf("non-declaration statement outside function body"), p.curToken, p.curToken.Pos.Column-1)
 }
 
+// docComments returns the line comments on the lines directly before tok
+func docComments(tok token.Token) []token.Comment {
+	line := tok.Pos.Line
+	start := len(tok.Comments)
+	for start > 0 {
+		comment := tok.Comments[start-1]
+		if !comment.IsLine() || comment.EndLine() != line-1 {
+			break
+		}
+		line = comment.Pos.Line
+		start--
+	}
+	return tok.Comments[start:]
+}
+
 func (p *Parser) parseLocalStatement() (ast.Statement, token.CompileError) {
 	switch p.curToken.Type {
 	case token.RETURN:
 		return p.parseReturn()
+	case token.DEFER:
+		return p.parseDefer()
+	case token.SWITCH:
+		return p.parseSwitchStatement()
 	}
 	return p.parseExpressionStatement()
 }
@@ -138,11 +261,83 @@ func (p *Parser) parseFunc() (*ast.Function, token.CompileError) {
 		Signature: fnSignature,
 		Body:      stmt,
 	}
+	fn.Extent = p.span(fnSignature.Extent.Start)
 
 	return fn, nil
 }
 
+func (p *Parser) parseTestBlock() (*ast.TestBlock, token.CompileError) {
+	test := &ast.TestBlock{Token: p.curToken}
+
+	p.nextToken()
+	test.Name = p.curToken.Lit
+
+	if !p.expectPeek(token.LCURLY) {
+		return nil, p.peekError(token.LCURLY)
+	}
+
+	body, err := p.parseBlockStatement()
+	if err != nil {
+		return nil, err
+	}
+	test.Body = body
+	test.Extent = p.span(test.Token.Pos)
+
+	return test, nil
+}
+
+func (p *Parser) parseAttributedFunc() (*ast.Function, token.CompileError) {
+	var attributes []*ast.Attribute
+
+	for p.curTokenIs(token.AT) {
+		attr, err := p.parseAttribute()
+		if err != nil {
+			return nil, err
+		}
+		attributes = append(attributes, attr)
+		p.nextToken()
+
+		if p.curTokenIs(token.SEMICOLON) {
+			p.nextToken()
+		}
+	}
+
+	if !p.curTokenIs(token.FUNC) {
+		return nil, p.parseError(fmt.Errorf("attributes must be followed by a function declaration"), p.curToken, p.curToken.Pos.Column-1)
+	}
+
+	fn, err := p.parseFunc()
+	if err != nil {
+		return nil, err
+	}
+	fn.Attributes = attributes
+	fn.Extent.Start = attributes[0].Extent.Start
+	return fn, nil
+}
+
+func (p *Parser) parseAttribute() (*ast.Attribute, token.CompileError) {
+	attr := &ast.Attribute{Token: p.curToken}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil, p.parseError(fmt.Errorf("missing attribute name"), p.curToken, p.curToken.Pos.Column)
+	}
+	attr.Name = p.curToken.Lit
+
+	if p.peekTokenIs(token.LPAREN) {
+		p.nextToken()
+
+		args, err := p.parseExpressionList(token.RPAREN)
+		if err != nil {
+			return nil, err
+		}
+		attr.Arguments = args
+	}
+	attr.Extent = p.span(attr.Token.Pos)
+	return attr, nil
+}
+
 func (p *Parser) parseFunctionSignature() (*ast.FunctionSignature, token.CompileError) {
+	start := p.curToken.Pos
 	if !p.expectPeek(token.IDENT) {
 		return nil, p.parseError(fmt.Errorf("missing function name"), p.curToken, p.curToken.Pos.Column+2)
 	}
@@ -176,6 +371,7 @@ func (p *Parser) parseFunctionSignature() (*ast.FunctionSignature, token.Compile
 		}
 		fnSignature.ReturnParams = returnParams
 	}
+	fnSignature.Extent = p.span(start)
 	return fnSignature, nil
 }
 
@@ -211,6 +407,7 @@ func (p *Parser) parseInputParam() (*ast.Parameter, token.CompileError) {
 	param := &ast.Parameter{}
 	if p.peekTokenIs(token.IDENT) {
 		param.Ident = &ast.Identifier{Value: p.peekToken.Lit}
+		param.Ident.Extent = p.peekToken.Span()
 	} else {
 		return nil, p.parseError(fmt.Errorf("trailing comma in parameters"), p.curToken, p.curToken.Pos.Column-1)
 	}
@@ -222,6 +419,7 @@ func (p *Parser) parseInputParam() (*ast.Parameter, token.CompileError) {
 		return nil, p.parseError(fmt.Errorf("missing function parameter type"), p.curToken, p.curToken.Pos.Column)
 	}
 	p.nextToken()
+	param.Extent = p.span(param.Ident.Extent.Start)
 
 	return param, nil
 }
@@ -232,13 +430,22 @@ func (p *Parser) parseReturnParameters() ([]*ast.Parameter, token.CompileError)
 	p.nextToken()
 
 	if p.curTokenIs(token.IDENT) {
-		params = append(params, &ast.Parameter{Type: p.curToken.Lit})
-	}
-
-	if p.peekTokenIs(token.LCURLY) {
-		return params, nil
+		param := &ast.Parameter{Type: p.curToken.Lit}
+		start := p.curToken.Pos
+
+		// T!E result types parse for any T and E, but the compiler only implements
+		// i32!i32 and reports an error for other pairs
+		if p.peekTokenIs(token.BANG) {
+			p.nextToken()
+			if !p.expectPeek(token.IDENT) {
+				return nil, p.parseError(fmt.Errorf("missing error type"), p.curToken, p.curToken.Pos.Column)
+			}
+			param.ErrorType = p.curToken.Lit
+		}
+		param.Extent = p.span(start)
+		params = append(params, param)
 	}
-	return nil, p.peekError(token.LCURLY)
+	return params, nil
 }
 
 func (p *Parser) parseBlockStatement() (*ast.BlockStatement, token.CompileError) {
@@ -247,14 +454,23 @@ func (p *Parser) parseBlockStatement() (*ast.BlockStatement, token.CompileError)
 
 	block := &ast.BlockStatement{FirstToken: p.curToken, Depth: p.blockDepth}
 	block.Statements = []ast.Statement{}
+	comments := p.collectComments()
 
 	p.nextToken()
 
 	for !p.curTokenIs(token.RCURLY) && !p.curTokenIs(token.EOF) {
+		if p.curTokenIs(token.SEMICOLON) {
+			p.nextToken()
+			continue
+		}
+
 		stmt, err := p.parseLocalStatement()
 		if err != nil {
 			return nil, err
 		}
+		if err := p.endStatement(token.RCURLY); err != nil {
+			return nil, err
+		}
 		if stmt != nil {
 			block.Statements = append(block.Statements, stmt)
 		}
@@ -263,6 +479,8 @@ func (p *Parser) parseBlockStatement() (*ast.BlockStatement, token.CompileError)
 	if p.curTokenIs(token.EOF) {
 		return nil, p.peekError(token.RCURLY)
 	}
+	block.Extent = p.span(block.FirstToken.Pos)
+	block.Comments = comments()
 
 	return block, nil
 }
@@ -276,22 +494,133 @@ func (p *Parser) returnFromBlock() {
 }
 
 func (p *Parser) parseReturn() (*ast.ReturnStatement, token.CompileError) {
+	stmt := &ast.ReturnStatement{}
+	stmt.Extent = p.curToken.Span()
+
+	if p.peekTokenIs(token.RCURLY) || p.peekTokenIs(token.SEMICOLON) {
+		return stmt, nil
+	}
 	p.nextToken()
 
-	stmt := &ast.ReturnStatement{}
 	expression, err := p.parseExpression(LOWEST)
 	if err != nil {
 		return nil, err
 	}
 	stmt.ReturnValue = expression
+	stmt.Extent.End = p.curToken.End
 
-	if p.peekTokenIs(token.SEMICOLON) {
-		p.nextToken()
+	return stmt, nil
+}
+
+func (p *Parser) parseDefer() (*ast.DeferStatement, token.CompileError) {
+	stmt := &ast.DeferStatement{Token: p.curToken}
+	p.nextToken()
+
+	expression, err := p.parseExpression(LOWEST)
+	if err != nil {
+		return nil, err
 	}
+	stmt.Expression = expression
+	stmt.Extent = p.span(stmt.Token.Pos)
+
 	return stmt, nil
 }
 
+func (p *Parser) parseSwitchStatement() (*ast.SwitchStatement, token.CompileError) {
+	stmt := &ast.SwitchStatement{Token: p.curToken, Depth: p.blockDepth}
+	p.nextToken()
+
+	value, err := p.parseExpression(LOWEST)
+	if err != nil {
+		return nil, err
+	}
+	stmt.Value = value
+
+	if !p.expectPeek(token.LCURLY) {
+		return nil, p.parseError(fmt.Errorf("missing { at beginning of switch block"), p.curToken, p.curToken.Pos.Column+len(p.curToken.Lit))
+	}
+	p.nextToken()
+
+	for !p.curTokenIs(token.RCURLY) {
+		if p.curTokenIs(token.EOF) {
+			return nil, p.error(token.RCURLY)
+		}
+
+		clause, err := p.parseCaseClause()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Cases = append(stmt.Cases, clause)
+	}
+	stmt.Extent = p.span(stmt.Token.Pos)
+	return stmt, nil
+}
+
+func (p *Parser) parseCaseClause() (*ast.CaseClause, token.CompileError) {
+	clause := &ast.CaseClause{Token: p.curToken}
+
+	switch p.curToken.Type {
+	case token.CASE:
+		p.nextToken()
+
+		value, err := p.parseExpression(LOWEST)
+		if err != nil {
+			return nil, err
+		}
+		clause.Values = append(clause.Values, value)
+
+		for p.peekTokenIs(token.COMMA) {
+			p.nextToken()
+			p.nextToken()
+
+			value, err := p.parseExpression(LOWEST)
+			if err != nil {
+				return nil, err
+			}
+			clause.Values = append(clause.Values, value)
+		}
+	case token.DEFAULT:
+	default:
+		return nil, p.parseError(fmt.Errorf("expected case or default"), p.curToken, p.curToken.Pos.Column-1)
+	}
+
+	if !p.expectPeek(token.COLON) {
+		return nil, p.peekError(token.COLON)
+	}
+	comments := p.collectComments()
+	p.nextToken()
+
+	p.enterBlock()
+	defer p.returnFromBlock()
+	clause.Depth = p.blockDepth
+
+	clause.Extent = p.span(clause.Token.Pos)
+
+	for !p.curTokenIs(token.CASE) && !p.curTokenIs(token.DEFAULT) && !p.curTokenIs(token.RCURLY) && !p.curTokenIs(token.EOF) {
+		if p.curTokenIs(token.SEMICOLON) {
+			p.nextToken()
+			continue
+		}
+
+		stmt, err := p.parseLocalStatement()
+		if err != nil {
+			return nil, err
+		}
+		if stmt != nil {
+			clause.Statements = append(clause.Statements, stmt)
+		}
+		clause.Extent.End = p.curToken.End
+		if err := p.endStatement(token.RCURLY); err != nil {
+			return nil, err
+		}
+		p.nextToken()
+	}
+	clause.Comments = comments()
+	return clause, nil
+}
+
 func (p *Parser) parseIfExpression() (ast.Expression, token.CompileError) {
+	start := p.curToken.Pos
 	p.nextToken()
 
 	expression, err := p.parseExpression(LOWEST)
@@ -308,10 +637,60 @@ func (p *Parser) parseIfExpression() (ast.Expression, token.CompileError) {
 		return nil, err
 	}
 
-	return &ast.IfExpression{Condition: expression, Body: stmt}, nil
+	exp := &ast.IfExpression{Condition: expression, Body: stmt}
+
+	if p.peekTokenIs(token.ELSE) {
+		p.nextToken()
+
+		if p.peekTokenIs(token.IF) {
+			p.nextToken()
+			if exp.Alternative, err = p.parseIfExpression(); err != nil {
+				return nil, err
+			}
+		} else {
+			if !p.expectPeek(token.LCURLY) {
+				return nil, p.parseError(fmt.Errorf("missing { at beginning of else block"), p.peekToken, p.peekToken.Pos.Column)
+			}
+			if exp.Alternative, err = p.parseBlockStatement(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	exp.Extent = p.span(start)
+	return exp, nil
 }
 
-func (p *Parser) parseImportStatement() (*ast.ImportStatement, token.CompileError) {
+func (p *Parser) parseImport() (ast.Statement, token.CompileError) {
+	importToken := p.curToken
+	if !p.peekTokenIs(token.STRING) {
+		return p.parseImportStatement("", importToken.Pos)
+	}
+	p.nextToken()
+
+	if !p.isHostImport() {
+		return p.parseImportPackageStatement(importToken)
+	}
+
+	moduleName := p.curToken.Lit
+	if p.peekTokenIs(token.LCURLY) {
+		return p.parseImportBlockStatement(moduleName, importToken.Pos)
+	}
+	return p.parseImportStatement(moduleName, importToken.Pos)
+}
+
+// isHostImport reports whether the import path is followed by host function declarations
+func (p *Parser) isHostImport() bool {
+	return p.peekTokenIs(token.FUNC) || p.peekTokenIs(token.STRING) || p.peekTokenIs(token.LCURLY)
+}
+
+func (p *Parser) parseImportStatement(moduleName string, start token.Position) (*ast.ImportStatement, token.CompileError) {
+	stmt := &ast.ImportStatement{Module: moduleName}
+
+	if p.peekTokenIs(token.STRING) {
+		p.nextToken()
+		stmt.Field = p.curToken.Lit
+	}
+
 	if !p.expectPeek(token.FUNC) {
 		return nil, p.parseError(fmt.Errorf("expected import function signature"), p.curToken, p.curToken.Pos.Column+2)
 	}
@@ -320,7 +699,63 @@ func (p *Parser) parseImportStatement() (*ast.ImportStatement, token.CompileErro
 	if err != nil {
 		return nil, err
 	}
-	return &ast.ImportStatement{FuncSignature: fnSignature}, nil
+	stmt.FuncSignature = fnSignature
+	stmt.Extent = p.span(start)
+
+	return stmt, nil
+}
+
+func (p *Parser) parseImportBlockStatement(moduleName string, start token.Position) (*ast.ImportBlockStatement, token.CompileError) {
+	block := &ast.ImportBlockStatement{Module: moduleName}
+	p.nextToken()
+
+	for !p.peekTokenIs(token.RCURLY) {
+		if p.peekTokenIs(token.EOF) {
+			return nil, p.peekError(token.RCURLY)
+		}
+
+		if p.peekTokenIs(token.SEMICOLON) {
+			p.nextToken()
+			continue
+		}
+
+		stmt, err := p.parseImportStatement(moduleName, p.peekToken.Pos)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.endStatement(token.RCURLY); err != nil {
+			return nil, err
+		}
+		block.Imports = append(block.Imports, stmt)
+	}
+	p.nextToken()
+	block.Extent = p.span(start)
+
+	return block, nil
+}
+
+func (p *Parser) parsePackageStatement() (*ast.PackageStatement, token.CompileError) {
+	stmt := &ast.PackageStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil, p.parseError(fmt.Errorf("missing package name"), p.curToken, p.curToken.Pos.Column+len(p.curToken.Lit))
+	}
+	stmt.Name = p.curToken.Lit
+	stmt.Extent = p.span(stmt.Token.Pos)
+
+	return stmt, nil
+}
+
+func (p *Parser) parseImportPackageStatement(importToken token.Token) (*ast.ImportPackageStatement, token.CompileError) {
+	stmt := &ast.ImportPackageStatement{Token: importToken}
+
+	if p.curToken.Lit == "" {
+		return nil, p.parseError(fmt.Errorf("empty import path"), p.curToken, p.curToken.Pos.Column)
+	}
+	stmt.Path = p.curToken.Lit
+	stmt.Extent = p.span(stmt.Token.Pos)
+
+	return stmt, nil
 }
 
 func (p *Parser) parseType() string {
@@ -331,24 +766,31 @@ func (p *Parser) parseType() string {
 	return ""
 }
 
-func (p *Parser) parseExpressionStatement() (*ast.ExpressionStatement, token.CompileError) {
+func (p *Parser) parseExpressionStatement() (ast.Statement, token.CompileError) {
 	stmt := &ast.ExpressionStatement{Token: p.curToken}
 
 	expression, err := p.parseExpression(LOWEST)
 	if err != nil {
 		return nil, err
 	}
-	stmt.Expression = expression
 
-	if p.peekTokenIs(token.SEMICOLON) {
+	if p.peekTokenIs(token.INC) || p.peekTokenIs(token.DEC) {
 		p.nextToken()
+		incDec := &ast.IncDecStatement{Token: p.curToken, Operator: p.curToken.Lit, Operand: expression}
+		incDec.Extent = p.span(stmt.Token.Pos)
+		return incDec, nil
 	}
+
+	stmt.Expression = expression
+	stmt.Extent = p.span(stmt.Token.Pos)
+
 	return stmt, nil
 }
 
 func (p *Parser) parseAssignmentExpression(expression ast.Expression) (ast.Expression, token.CompileError) {
 	stmt := &ast.AssignmentExpression{
 		Token:      p.curToken,
+		Operator:   p.curToken.Lit,
 		Identifier: expression,
 	}
 	p.nextToken()
@@ -358,10 +800,8 @@ func (p *Parser) parseAssignmentExpression(expression ast.Expression) (ast.Expre
 		return nil, err
 	}
 	stmt.Expression = expression
+	stmt.Extent = p.span(stmt.Identifier.Span().Start)
 
-	if p.peekTokenIs(token.SEMICOLON) {
-		p.nextToken()
-	}
 	return stmt, nil
 }
 
@@ -379,10 +819,7 @@ func (p *Parser) parseInitAssignExpression(expression ast.Expression) (ast.Expre
 		return nil, err
 	}
 	exp.Value = expression
-
-	if p.peekTokenIs(token.SEMICOLON) {
-		p.nextToken()
-	}
+	exp.Extent = p.span(exp.LeftExp.Span().Start)
 
 	return exp, nil
 }
@@ -420,6 +857,66 @@ func (p *Parser) parseCallExpression(function ast.Expression) (ast.Expression, t
 		return nil, err
 	}
 	exp.Arguments = expression
+	exp.Extent = p.span(function.Span().Start)
+	return exp, nil
+}
+
+// parseIndexExpression parses s[i] and the slice forms s[low:high], s[low:], s[:high] and s[:]
+func (p *Parser) parseIndexExpression(left ast.Expression) (ast.Expression, token.CompileError) {
+	tok := p.curToken
+	p.nextToken()
+
+	var low ast.Expression
+	if !p.curTokenIs(token.COLON) {
+		var err token.CompileError
+		low, err = p.parseExpression(LOWEST)
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.peekTokenIs(token.COLON) {
+			if !p.expectPeek(token.RBRACKET) {
+				return nil, p.peekError(token.RBRACKET)
+			}
+			exp := &ast.IndexExpression{Token: tok, Left: left, Index: low}
+			exp.Extent = p.span(left.Span().Start)
+			return exp, nil
+		}
+		p.nextToken()
+	}
+
+	exp := &ast.SliceExpression{Token: tok, Left: left, Low: low}
+	if !p.peekTokenIs(token.RBRACKET) {
+		p.nextToken()
+
+		high, err := p.parseExpression(LOWEST)
+		if err != nil {
+			return nil, err
+		}
+		exp.High = high
+	}
+	if !p.expectPeek(token.RBRACKET) {
+		return nil, p.peekError(token.RBRACKET)
+	}
+	exp.Extent = p.span(left.Span().Start)
+	return exp, nil
+}
+
+func (p *Parser) parseSelectorExpression(x ast.Expression) (ast.Expression, token.CompileError) {
+	exp := &ast.SelectorExpression{Token: p.curToken, X: x}
+
+	if !p.expectPeek(token.IDENT) {
+		return nil, p.parseError(fmt.Errorf("missing name after ."), p.curToken, p.curToken.Pos.Column)
+	}
+	exp.Sel = &ast.Identifier{Token: p.curToken, Value: p.curToken.Lit}
+	exp.Sel.Extent = p.curToken.Span()
+	exp.Extent = p.span(x.Span().Start)
+	return exp, nil
+}
+
+func (p *Parser) parseTryExpression(expression ast.Expression) (ast.Expression, token.CompileError) {
+	exp := &ast.TryExpression{Token: p.curToken, Expression: expression}
+	exp.Extent = p.span(expression.Span().Start)
 	return exp, nil
 }
 
@@ -479,6 +976,7 @@ func (p *Parser) parseInfixExpression(left ast.Expression) (ast.Expression, toke
 	}
 
 	infixExpression.Right = expression
+	infixExpression.Extent = p.span(left.Span().Start)
 
 	return infixExpression, nil
 }
@@ -505,36 +1003,146 @@ func (p *Parser) curPrecedence() int {
 }
 
 func (p *Parser) parseIdentifier() (ast.Expression, token.CompileError) {
-	return &ast.Identifier{Value: p.curToken.Lit}, nil
+	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Lit}
+	ident.Extent = p.curToken.Span()
+	return ident, nil
 }
 
 func (p *Parser) parseIntegerLiteral() (ast.Expression, token.CompileError) {
 	lit := &ast.IntegerLiteral{Token: p.curToken}
+	lit.Extent = p.curToken.Span()
+
+	number, suffix := splitNumberSuffix(p.curToken.Lit, false)
+	bitSize := 32
+	switch suffix {
+	case "", "i32":
+	case "i64":
+		bitSize = 64
+	default:
+		return nil, p.parseError(fmt.Errorf("invalid suffix %q on integer literal %s", suffix, p.curToken.Lit), p.curToken, p.curToken.Pos.Column)
+	}
 
-	value, err := strconv.ParseInt(p.curToken.Lit, 0, 64)
+	value, err := strconv.ParseInt(trimLeadingZeros(number), 0, bitSize)
 	if err != nil {
+		if err.(*strconv.NumError).Err == strconv.ErrRange {
+			return nil, p.parseError(fmt.Errorf("integer literal %s overflows i%d", p.curToken.Lit, bitSize), p.curToken, p.curToken.Pos.Column)
+		}
 		return nil, p.parseError(fmt.Errorf("could not parse %q as integer", p.curToken.Lit), p.curToken, p.curToken.Pos.Column)
 	}
 	lit.Value = value
+	lit.Type = suffix
 	return lit, nil
 }
 
 func (p *Parser) parseFloatLiteral() (ast.Expression, token.CompileError) {
 	lit := &ast.FloatLiteral{Token: p.curToken}
+	lit.Extent = p.curToken.Span()
+
+	number, suffix := splitNumberSuffix(p.curToken.Lit, true)
+	bitSize := 64
+	switch suffix {
+	case "", "f64":
+	case "f32":
+		bitSize = 32
+	default:
+		return nil, p.parseError(fmt.Errorf("invalid suffix %q on float literal %s", suffix, p.curToken.Lit), p.curToken, p.curToken.Pos.Column)
+	}
 
-	value, err := strconv.ParseFloat(p.curToken.Lit, 64)
+	value, err := strconv.ParseFloat(number, bitSize)
 	if err != nil {
-		return nil, p.parseError(fmt.Errorf("could not parse %q as integer", p.curToken.Lit), p.curToken, p.curToken.Pos.Column)
+		if err.(*strconv.NumError).Err == strconv.ErrRange {
+			return nil, p.parseError(fmt.Errorf("float literal %s overflows f%d", p.curToken.Lit, bitSize), p.curToken, p.curToken.Pos.Column)
+		}
+		return nil, p.parseError(fmt.Errorf("could not parse %q as float", p.curToken.Lit), p.curToken, p.curToken.Pos.Column)
 	}
 	lit.Value = value
+	lit.Type = suffix
 	return lit, nil
 }
 
+// splitNumberSuffix splits the type suffix from a number literal. The suffix starts
+// with the first letter which is neither a base prefix, a hex digit nor an exponent.
+func splitNumberSuffix(lit string, isFloat bool) (number string, suffix string) {
+	digits := "0123456789_"
+	start := 0
+
+	if isFloat {
+		digits += ".eE+-"
+	} else if len(lit) > 1 && lit[0] == '0' && strings.ContainsRune("xXbBoO", rune(lit[1])) {
+		if lit[1] == 'x' || lit[1] == 'X' {
+			digits += "abcdefABCDEF"
+		}
+		start = 2
+	}
+
+	i := start
+	for i < len(lit) && strings.IndexByte(digits, lit[i]) >= 0 {
+		i++
+	}
+	return lit[:i], lit[i:]
+}
+
+// trimLeadingZeros keeps decimal literals such as 017 from being read as octal
+func trimLeadingZeros(number string) string {
+	if len(number) < 2 || number[0] != '0' || !isDecimal(number[1]) {
+		return number
+	}
+	trimmed := strings.TrimLeft(number, "0_")
+	if trimmed == "" {
+		return "0"
+	}
+	return trimmed
+}
+
+func isDecimal(ch byte) bool {
+	return '0' <= ch && ch <= '9' || ch == '_'
+}
+
 func (p *Parser) parseStringLiteral() (ast.Expression, token.CompileError) {
 	str := &ast.String{Token: p.curToken, Value: p.curToken.Lit}
+	str.Extent = p.curToken.Span()
 	return str, nil
 }
 
+func (p *Parser) parseCharLiteral() (ast.Expression, token.CompileError) {
+	value, err := lexer.CharValue(p.curToken.Lit)
+	if err != nil {
+		return nil, p.parseError(err, p.curToken, p.curToken.Pos.Column)
+	}
+	lit := &ast.IntegerLiteral{Token: p.curToken, Value: int64(value)}
+	lit.Extent = p.curToken.Span()
+	return lit, nil
+}
+
+// endStatement consumes the ; or newline ending a statement. The terminator may
+// be left out before the closing token of the enclosing statement list.
+func (p *Parser) endStatement(closing token.Type) token.CompileError {
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+		return nil
+	}
+	if p.peekTokenIs(closing) {
+		return nil
+	}
+	return p.parseError(fmt.Errorf("unexpected %s at end of statement", tokenText(p.peekToken)), p.peekToken, p.peekToken.Pos.Column)
+}
+
+// tokenText describes a token in an error message
+func tokenText(tok token.Token) string {
+	switch tok.Type {
+	case token.EOF:
+		return "end of file"
+	case token.STRING:
+		return "string literal"
+	}
+	return tok.Lit
+}
+
+// span returns the source range from start up to the end of the current token
+func (p *Parser) span(start token.Position) token.Span {
+	return token.Span{Start: start, End: p.curToken.End}
+}
+
 func (p *Parser) expectToken(tokenType token.Type) bool {
 	if p.curTokenIs(tokenType) {
 		return true
@@ -575,13 +1183,32 @@ func (p *Parser) peekError(tokenType token.Type) token.CompileError {
 }
 
 func (p *Parser) parseError(err error, tok token.Token, column int) token.CompileError {
-	pos := token.Position{Line: tok.Pos.Line, Column: column}
+	pos := tok.Pos
+	pos.Offset += column - tok.Pos.Column
+	if pos.Offset < 0 {
+		pos.Offset = 0
+	}
+	pos.Column = column
 	return ParseError{Pos: pos, Err: err}
 }
 
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
 	p.peekToken = p.l.NextToken()
+	p.comments = append(p.comments, p.curToken.Comments...)
+	p.allComments = append(p.allComments, p.curToken.Comments...)
+}
+
+// collectComments collects the comments of the tokens read from now on apart from
+// those of the enclosing block. The returned function stops and returns them.
+func (p *Parser) collectComments() func() []token.Comment {
+	outer := p.comments
+	p.comments = nil
+	return func() []token.Comment {
+		comments := p.comments
+		p.comments = outer
+		return comments
+	}
 }
 
 func (p *Parser) registerPrefix(tokenType token.Type, fn prefixParseFn) {
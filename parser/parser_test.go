@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/drejca/shift/assert"
+	"github.com/drejca/shift/ast"
 	"github.com/drejca/shift/parser"
 	"github.com/drejca/shift/print"
 	"github.com/drejca/shift/token"
@@ -48,6 +49,43 @@ fn add(a i32, b i32) : i32 {
 	}
 }
 
+func TestParseTestBlock(t *testing.T) {
+	input := `
+fn Add(a i32, b i32) : i32 {
+	return (a + b)
+}
+
+fn Check(test i32) : i32 {
+	return test
+}
+
+test "adds numbers" {
+	expect_eq(Add(2, 3), 5)
+	assert((Add(1, 1) == 2), "1 + 1 is 2")
+}
+`
+	p := parser.New(strings.NewReader(input))
+	program, compilerError := p.ParseProgram()
+
+	if compilerError != nil {
+		printer := print.New(strings.NewReader(input))
+		t.Fatal(printer.PrintError(compilerError))
+	}
+
+	err := assert.EqualString(input, program.String())
+	if err != nil {
+		t.Error(err)
+	}
+
+	test, ok := program.Statements[2].(*ast.TestBlock)
+	if !ok {
+		t.Fatalf("expected *ast.TestBlock but got %T", program.Statements[2])
+	}
+	if test.Name != "adds numbers" {
+		t.Errorf("expected test name %q but got %q", "adds numbers", test.Name)
+	}
+}
+
 func TestReturnStatement(t *testing.T) {
 	tests := []struct {
 		input string
@@ -80,6 +118,97 @@ fn name() {
 `},
 		{input: `
 import fn error(msg string)
+`},
+		{input: `
+import "wasi_snapshot_preview1" "fd_write" fn fdWrite(fd i32, iovs i32, iovsLen i32, written i32) : i32
+`},
+		{input: `
+import "console" "log" fn print(msg string)
+`},
+		{input: `
+import "console" {
+	fn log(msg string)
+	"warn" fn warning(msg string)
+}
+`},
+		{input: `
+fn close(handle i32) {
+	defer release(handle)
+	if (handle != 0) {
+		return
+	}
+}
+`},
+		{input: `
+fn parse(a i32) : i32!i32 {
+	b := check(a)?
+	return (b + check(a)?)
+}
+`},
+		{input: `
+fn grade(score i32) : i32 {
+	switch score {
+	case 1, 2:
+		return 1
+	case 3:
+		a := 2
+		return a
+	default:
+		if (score != 0) {
+			return 3
+		}
+	}
+	return 0
+}
+`},
+		{input: `
+fn Strings(s string) : i32 {
+	t := (s[1:] + s[:2])
+	if (t[0:len(s)] == s) {
+		return t[0]
+	}
+	return len(s[:])
+}
+`},
+		{input: `
+fn Escapes(c i32) : i32 {
+	s := "tab\tquote\"slash\\zero\0é\xff"
+	switch c {
+	case 'a', '\n', '\u{e9}':
+		return len(s)
+	}
+	return '\''
+}
+`},
+		{input: `
+fn Ops(a i32, b i32) : i32 {
+	a += (b * 2)
+	a >>= 1
+	a++
+	b--
+	c := ((a / b) % 3)
+	c = ((c & 7) | (a ^ b))
+	c <<= a = 2
+	return (c << 2)
+}
+`},
+		{input: `
+// Calc returns a
+// unchanged
+@export("calc_v2")
+@inline
+fn Calc(a i32) : i32 {
+	return a
+}
+`},
+		{input: `
+package calc
+
+import "numbers"
+
+fn Sum(a i32, b i32) : i32 {
+	return numbers.Add(a, b)
+}
 `},
 	}
 
@@ -98,6 +227,226 @@ import fn error(msg string)
 	}
 }
 
+func TestDocComments(t *testing.T) {
+	input := `
+// not a doc comment
+
+/* not a doc comment */
+// Add returns
+// the sum of a and b
+fn Add(a i32, b i32) : i32 {
+	// not a doc comment
+	return a + b /* nor this */
+}
+
+fn Sub(a i32, b i32) : i32 { return a - b }
+`
+	program, err := parser.New(strings.NewReader(input)).ParseProgram()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tests := []struct {
+		function string
+		doc      string
+	}{
+		{function: "Add", doc: "[{// Add returns 5:1} {// the sum of a and b 6:1}]"},
+		{function: "Sub", doc: "[]"},
+	}
+
+	for i, test := range tests {
+		function := program.Statements[i].(*ast.Function)
+		if function.Signature.Name != test.function {
+			t.Fatalf("expected function %s but got %s", test.function, function.Signature.Name)
+		}
+		if fmt.Sprint(function.Doc) != test.doc {
+			t.Errorf("%s - expected doc %s but got %v", test.function, test.doc, function.Doc)
+		}
+	}
+}
+
+func TestCommentsRoundTrip(t *testing.T) {
+	input := `
+import "env" "log" fn log(msg string) // host logger
+
+/* Sum adds
+   numbers */
+
+// Sum returns a + b
+fn Sum(a i32, b i32) : i32 {
+	// leading
+	c := (a + b) // trailing
+	/* before switch */
+	switch c {
+	case 0:
+		// zero
+		return 0 /* none */
+	default:
+		log("sum")
+		// after log
+	}
+	return c
+	// end of body
+} // end of Sum
+
+test "sums" {
+	expect_eq(Sum(1, 2), 3) // three
+}
+
+// end of file
+`
+	program, err := parser.New(strings.NewReader(input)).ParseProgram()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if err := assert.EqualString(input, program.String()); err != nil {
+		t.Error(err)
+	}
+
+	var texts []string
+	for _, comment := range program.Comments {
+		if input[comment.Pos.Offset:comment.Pos.Offset+len(comment.Text)] != comment.Text {
+			t.Errorf("expected comment %q at offset %d", comment.Text, comment.Pos.Offset)
+		}
+		texts = append(texts, comment.Text)
+	}
+	if len(texts) != 13 || texts[0] != "// host logger" || texts[12] != "// end of file" {
+		t.Errorf("expected 13 comments from // host logger to // end of file but got %q", texts)
+	}
+}
+
+func TestNodeSpans(t *testing.T) {
+	input := `import "env" "log" fn log(msg string)
+
+// Scale multiplies
+@inline
+fn Scale(a i32, b i32) : i32 {
+	c := a + b * 2
+	return len("héllo"[1:]) + c
+}`
+	program, err := parser.NewFile("span.sf", strings.NewReader(input)).ParseProgram()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	function := program.Statements[1].(*ast.Function)
+	initAssign := function.Body.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.InitAssignExpression)
+	returnStmt := function.Body.Statements[1].(*ast.ReturnStatement)
+	call := returnStmt.ReturnValue.(*ast.InfixExpression).Left.(*ast.CallExpression)
+
+	tests := []struct {
+		node     ast.Node
+		expected string
+	}{
+		{node: program, expected: input},
+		{node: program.Statements[0], expected: `import "env" "log" fn log(msg string)`},
+		{node: function, expected: input[strings.Index(input, "@inline"):]},
+		{node: function.Attributes[0], expected: "@inline"},
+		{node: function.Signature, expected: "fn Scale(a i32, b i32) : i32"},
+		{node: function.Signature.InputParams[1], expected: "b i32"},
+		{node: function.Body, expected: input[strings.Index(input, "{"):]},
+		{node: initAssign, expected: "c := a + b * 2"},
+		{node: initAssign.Value.(*ast.InfixExpression).Right, expected: "b * 2"},
+		{node: returnStmt, expected: `return len("héllo"[1:]) + c`},
+		{node: call, expected: `len("héllo"[1:])`},
+		{node: call.Arguments[0], expected: `"héllo"[1:]`},
+	}
+
+	for _, test := range tests {
+		span := test.node.Span()
+		if span.Start.Filename != "span.sf" {
+			t.Errorf("%s - expected file span.sf but got %q", test.expected, span.Start.Filename)
+		}
+		if got := input[span.Start.Offset:span.End.Offset]; got != test.expected {
+			t.Errorf("expected span %q but got %q", test.expected, got)
+		}
+	}
+}
+
+func TestStatementTerminators(t *testing.T) {
+	tests := []struct {
+		input      string
+		statements []string
+	}{
+		{input: "a := b\n(c)", statements: []string{"a := b", "c"}},
+		{input: "a := b; c()", statements: []string{"a := b", "c()"}},
+		{input: "return 1 +\n\t2", statements: []string{"return (1 + 2)"}},
+		{input: "a = add(1,\n\t2)\nreturn a", statements: []string{"a = add(1, 2)", "return a"}},
+		{input: "a := s[1:\n\t2]?", statements: []string{"a := s[1:2]?"}},
+		{input: "return\n", statements: []string{"return"}},
+		{input: "if a {\n\tb()\n}\nc()", statements: []string{"if a {\n\t\tb()\n\t}", "c()"}},
+		{input: "a := 1 /* spans\nlines */ b()", statements: []string{"a := 1", "b()"}},
+		{input: ";;a()", statements: []string{"a()"}},
+		{input: "a++\nb--", statements: []string{"a++", "b--"}},
+		{input: "a -= 1 + b * c", statements: []string{"a -= (1 + (b * c))"}},
+		{input: "a = 1 | 2 ^ 7 & 3 << 1", statements: []string{"a = ((1 | 2) ^ ((7 & 3) << 1))"}},
+		{input: "a = b / c % d - e", statements: []string{"a = (((b / c) % d) - e)"}},
+		{input: "x := if a != b { 1 } else { 2 }", statements: []string{"x := if (a != b) {\n\t\t1\n\t} else {\n\t\t2\n\t}"}},
+		{input: "if a {\n\tb()\n} else if c {\n\td()\n}\ne()", statements: []string{"if a {\n\t\tb()\n\t} else if c {\n\t\td()\n\t}", "e()"}},
+	}
+
+	for _, test := range tests {
+		program, err := parser.New(strings.NewReader("fn A() {\n" + test.input + "\n}")).ParseProgram()
+		if err != nil {
+			t.Fatalf("%q - %s", test.input, err.Error())
+		}
+
+		var statements []string
+		for _, stmt := range program.Statements[0].(*ast.Function).Body.Statements {
+			statements = append(statements, strings.TrimSpace(stmt.String()))
+		}
+		if fmt.Sprintf("%q", statements) != fmt.Sprintf("%q", test.statements) {
+			t.Errorf("%q - expected statements %q but got %q", test.input, test.statements, statements)
+		}
+	}
+}
+
+func TestNumberLiterals(t *testing.T) {
+	tests := []struct {
+		input     string
+		value     interface{}
+		valueType string
+	}{
+		{input: "42", value: int64(42)},
+		{input: "0xFF", value: int64(255)},
+		{input: "0b1010", value: int64(10)},
+		{input: "0o17", value: int64(15)},
+		{input: "017", value: int64(17)},
+		{input: "1_000_000", value: int64(1000000)},
+		{input: "0x7fff_ffff", value: int64(2147483647)},
+		{input: "4294967296i64", value: int64(4294967296), valueType: "i64"},
+		{input: "10i32", value: int64(10), valueType: "i32"},
+		{input: "1.5e-3", value: 0.0015},
+		{input: "2E+2", value: 200.0},
+		{input: "1_000.5", value: 1000.5},
+		{input: "2.5f32", value: 2.5, valueType: "f32"},
+	}
+
+	for _, test := range tests {
+		program, err := parser.New(strings.NewReader("fn A() {\n\treturn " + test.input + "\n}")).ParseProgram()
+		if err != nil {
+			t.Fatalf("%s - %s", test.input, err.Error())
+		}
+
+		function := program.Statements[0].(*ast.Function)
+		returnValue := function.Body.Statements[0].(*ast.ReturnStatement).ReturnValue
+
+		var value interface{}
+		var valueType string
+		switch literal := returnValue.(type) {
+		case *ast.IntegerLiteral:
+			value, valueType = literal.Value, literal.Type
+		case *ast.FloatLiteral:
+			value, valueType = literal.Value, literal.Type
+		}
+
+		if value != test.value || valueType != test.valueType {
+			t.Errorf("%s - expected %v%s but got %v%s", test.input, test.value, test.valueType, value, valueType)
+		}
+	}
+}
+
 func TestParseErrors(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -115,6 +464,10 @@ func TestParseErrors(t *testing.T) {
 			Err: errors.New("missing )"),
 			Pos: token.Position{Line: 1, Column: 26},
 		}},
+		{input: `fn A() {if a {} else b}`, parseErr: parser.ParseError{
+			Err: errors.New("missing { at beginning of else block"),
+			Pos: token.Position{Line: 1, Column: 22},
+		}},
 		{input: `fn Add {}`, parseErr: parser.ParseError{
 			Err: errors.New("missing ("),
 			Pos: token.Position{Line: 1, Column: 8},
@@ -143,6 +496,94 @@ func TestParseErrors(t *testing.T) {
 			Err: errors.New("trailing comma in parameters"),
 			Pos: token.Position{Line: 1, Column: 19},
 		}},
+		{input: "fn A() {}\npackage calc", parseErr: parser.ParseError{
+			Err: errors.New("package clause must be first in file"),
+			Pos: token.Position{Line: 2, Column: 0},
+		}},
+		{input: `import "console" { fn log(msg string)`, parseErr: parser.ParseError{
+			Err: errors.New("missing }"),
+			Pos: token.Position{Line: 1, Column: 38},
+		}},
+		{input: `import "console" { log(msg string) }`, parseErr: parser.ParseError{
+			Err: errors.New("expected import function signature"),
+			Pos: token.Position{Line: 1, Column: 20},
+		}},
+		{input: `@inline import fn log(msg string)`, parseErr: parser.ParseError{
+			Err: errors.New("attributes must be followed by a function declaration"),
+			Pos: token.Position{Line: 1, Column: 8},
+		}},
+		{input: `@ fn A() {}`, parseErr: parser.ParseError{
+			Err: errors.New("missing attribute name"),
+			Pos: token.Position{Line: 1, Column: 1},
+		}},
+		{input: `fn A() { switch a { 1: } }`, parseErr: parser.ParseError{
+			Err: errors.New("expected case or default"),
+			Pos: token.Position{Line: 1, Column: 20},
+		}},
+		{input: `fn A() { switch a { case 1 } }`, parseErr: parser.ParseError{
+			Err: errors.New("missing :"),
+			Pos: token.Position{Line: 1, Column: 28},
+		}},
+		{input: `fn A() { a := s[1 }`, parseErr: parser.ParseError{
+			Err: errors.New("missing ]"),
+			Pos: token.Position{Line: 1, Column: 19},
+		}},
+		{input: `fn A() { a := "abc }`, parseErr: parser.ParseError{
+			Err: errors.New("unterminated string literal"),
+			Pos: token.Position{Line: 1, Column: 15},
+		}},
+		{input: `fn A() { return '' }`, parseErr: parser.ParseError{
+			Err: errors.New("empty rune literal"),
+			Pos: token.Position{Line: 1, Column: 17},
+		}},
+		{input: `fn A() { return 2147483648 }`, parseErr: parser.ParseError{
+			Err: errors.New("integer literal 2147483648 overflows i32"),
+			Pos: token.Position{Line: 1, Column: 17},
+		}},
+		{input: `fn A() { return 1e40f32 }`, parseErr: parser.ParseError{
+			Err: errors.New("float literal 1e40f32 overflows f32"),
+			Pos: token.Position{Line: 1, Column: 17},
+		}},
+		{input: `fn A() { return 10u8 }`, parseErr: parser.ParseError{
+			Err: errors.New(`invalid suffix "u8" on integer literal 10u8`),
+			Pos: token.Position{Line: 1, Column: 17},
+		}},
+		{input: `fn A() { return 0b102 }`, parseErr: parser.ParseError{
+			Err: errors.New(`could not parse "0b102" as integer`),
+			Pos: token.Position{Line: 1, Column: 17},
+		}},
+		{input: "fn A() {\n\ta := 1 b\n}", parseErr: parser.ParseError{
+			Err: errors.New("unexpected b at end of statement"),
+			Pos: token.Position{Line: 2, Column: 9},
+		}},
+		{input: "fn A() {\n\treturn 1\n\t+ 2\n}", parseErr: parser.ParseError{
+			Err: errors.New("illegal symbol +"),
+			Pos: token.Position{Line: 3, Column: 1},
+		}},
+		{input: "fn A() {} fn B() {}", parseErr: parser.ParseError{
+			Err: errors.New("unexpected fn at end of statement"),
+			Pos: token.Position{Line: 1, Column: 11},
+		}},
+		{input: "fn A()\n{}", parseErr: parser.ParseError{
+			Err: errors.New("missing {"),
+			Pos: token.Position{Line: 1, Column: 7},
+		}},
+		{input: `package {}`, parseErr: parser.ParseError{
+			Err: errors.New("missing package name"),
+			Pos: token.Position{Line: 1, Column: 8},
+		}},
+		{input: `test {}`, parseErr: parser.ParseError{
+			Err: errors.New("test block needs a name string"),
+			Pos: token.Position{Line: 1, Column: 1},
+		}},
+		{input: "fn A() {}\n  test adds {}", parseErr: parser.ParseError{
+			Err: errors.New("test block needs a name string"),
+			Pos: token.Position{Line: 2, Column: 3},
+		}},
+		{input: `test "adds"`, parseErr: parser.ParseError{
+			Err: errors.New("missing {"),
+			Pos: token.Position{Line: 1, Column: 12},
+		}},
 	}
 
 	for i, test := range tests {
@@ -6,6 +6,7 @@ import (
 	"github.com/drejca/shift/token"
 	"io"
 	"strconv"
+	"strings"
 )
 
 type Printer struct {
@@ -36,15 +37,53 @@ func (p *Printer) PrintError(err token.CompileError) string {
 	out.WriteString("]  ")
 	out.WriteString(p.PrintLine(err.Position().Line))
 	out.WriteString("\n")
-	for i := 0; i < (err.Position().Column + len(lineNumberText) + 3); i++ {
+	for i := 0; i < len(lineNumberText)+4; i++ {
 		out.WriteString(" ")
 	}
-	out.WriteString("^\n")
+	out.WriteString(indent(p.PrintLine(err.Position().Line), err.Position().Column))
+	out.WriteString(underline(err))
+	out.WriteString("\n")
 	out.WriteString(err.Error().Error())
 
 	return out.String()
 }
 
+// indent returns the whitespace placing a caret under column of line. Tabs
+// are repeated so the caret lines up with the line however tabs are displayed.
+func indent(line string, column int) string {
+	var out bytes.Buffer
+
+	for _, ch := range line {
+		if column <= 1 {
+			break
+		}
+		if ch == '\t' {
+			out.WriteRune('\t')
+		} else {
+			out.WriteRune(' ')
+		}
+		column--
+	}
+	for ; column > 1; column-- {
+		out.WriteRune(' ')
+	}
+	return out.String()
+}
+
+// underline returns a caret under each column the error spans when it reports a
+// span on a single line and a single caret otherwise
+func underline(err token.CompileError) string {
+	spanned, ok := err.(interface{ Span() token.Span })
+	if !ok {
+		return "^"
+	}
+	span := spanned.Span()
+	if span.End.Line != span.Start.Line || span.End.Column <= span.Start.Column {
+		return "^"
+	}
+	return strings.Repeat("^", span.End.Column-span.Start.Column)
+}
+
 func (p *Printer) PrintLine(line int) string {
 	return string(p.lines[line-1])
 }
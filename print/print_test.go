@@ -0,0 +1,42 @@
+package print_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/drejca/shift/assert"
+	"github.com/drejca/shift/parser"
+	"github.com/drejca/shift/print"
+)
+
+func TestPrintError(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			input: "fn A() {\n\tx := \"é\" + 'ab'\n}",
+			expected: "\n[2]  \tx := \"é\" + 'ab'\n" +
+				"     \t           ^^^^\n" +
+				"more than one character in rune literal",
+		},
+		{
+			input: "fn Größe() {\n\tgröße := \"unterminated\n}",
+			expected: "\n[2]  \tgröße := \"unterminated\n" +
+				"     \t         ^^^^^^^^^^^^^\n" +
+				"unterminated string literal",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := parser.New(strings.NewReader(test.input)).ParseProgram()
+		if err == nil {
+			t.Fatalf("expected error parsing %q", test.input)
+		}
+
+		printer := print.New(strings.NewReader(test.input))
+		if err := assert.EqualString(test.expected, printer.PrintError(err)); err != nil {
+			t.Error(err)
+		}
+	}
+}
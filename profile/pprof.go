@@ -0,0 +1,192 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"time"
+)
+
+// Field numbers of the messages of profile.proto written by WriteProfile
+const (
+	profileSampleType        = 1
+	profileSample            = 2
+	profileLocation          = 4
+	profileFunction          = 5
+	profileStringTable       = 6
+	profileTimeNanos         = 9
+	profileDurationNanos     = 10
+	profilePeriodType        = 11
+	profilePeriod            = 12
+	profileDefaultSampleType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+	functionStartLine  = 5
+)
+
+// WriteProfile writes the profile gzipped in the pprof format, so it can be viewed with
+// go tool pprof. Every stack of the call tree is a sample with the calls made with the
+// stack and the instructions executed with the stack on top, instructions being the
+// default sample type. Every function has a single location at its declaration.
+func (p *Profiler) WriteProfile(w io.Writer) error {
+	var profile protobuf
+	strings := newStringTable()
+
+	for _, sampleType := range [][2]string{{"calls", "count"}, {"instructions", "count"}} {
+		var valueType protobuf
+		valueType.int64Field(valueTypeType, strings.index(sampleType[0]))
+		valueType.int64Field(valueTypeUnit, strings.index(sampleType[1]))
+		profile.message(profileSampleType, &valueType)
+	}
+
+	ids := make(map[int]uint64) // location and function id by function index
+	var functions []int
+	p.walk(func(n *node) {
+		var locations []uint64
+		for caller := n; caller != p.root; caller = caller.parent {
+			id, found := ids[caller.function]
+			if !found {
+				id = uint64(len(ids) + 1)
+				ids[caller.function] = id
+				functions = append(functions, caller.function)
+			}
+			locations = append(locations, id)
+		}
+
+		var sample protobuf
+		sample.packed(sampleLocationID, locations)
+		sample.packed(sampleValue, []uint64{uint64(n.calls), uint64(n.instructions)})
+		profile.message(profileSample, &sample)
+	})
+
+	for _, function := range functions {
+		line := int64(p.functions[function].Pos.Line)
+
+		var location, locationLineInfo protobuf
+		location.uint64Field(locationID, ids[function])
+		locationLineInfo.uint64Field(lineFunctionID, ids[function])
+		locationLineInfo.int64Field(lineLine, line)
+		location.message(locationLine, &locationLineInfo)
+		profile.message(profileLocation, &location)
+
+		name := strings.index(p.name(function))
+		var fn protobuf
+		fn.uint64Field(functionID, ids[function])
+		fn.int64Field(functionName, name)
+		fn.int64Field(functionSystemName, name)
+		fn.int64Field(functionFilename, strings.index(p.functions[function].Pos.Filename))
+		fn.int64Field(functionStartLine, line)
+		profile.message(profileFunction, &fn)
+	}
+
+	var periodType protobuf
+	periodType.int64Field(valueTypeType, strings.index("instructions"))
+	periodType.int64Field(valueTypeUnit, strings.index("count"))
+	profile.message(profilePeriodType, &periodType)
+	profile.int64Field(profilePeriod, 1)
+	profile.int64Field(profileTimeNanos, p.start.UnixNano())
+	profile.int64Field(profileDurationNanos, int64(time.Since(p.start)))
+	profile.int64Field(profileDefaultSampleType, strings.index("instructions"))
+
+	for _, s := range strings.strings {
+		profile.stringField(profileStringTable, s)
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(profile.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// stringTable holds the strings of a profile, which are referred to by index.
+// The first string is empty.
+type stringTable struct {
+	strings []string
+	indices map[string]int64
+}
+
+func newStringTable() *stringTable {
+	return &stringTable{strings: []string{""}, indices: map[string]int64{"": 0}}
+}
+
+// index returns the index of s, adding it to the table when it is new
+func (t *stringTable) index(s string) int64 {
+	index, found := t.indices[s]
+	if !found {
+		index = int64(len(t.strings))
+		t.indices[s] = index
+		t.strings = append(t.strings, s)
+	}
+	return index
+}
+
+// protobuf encodes a protocol buffer message. Fields with zero values are left out.
+type protobuf struct {
+	bytes.Buffer
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (b *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.WriteByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	b.WriteByte(byte(x))
+}
+
+func (b *protobuf) key(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protobuf) uint64Field(field int, x uint64) {
+	if x == 0 {
+		return
+	}
+	b.key(field, wireVarint)
+	b.varint(x)
+}
+
+func (b *protobuf) int64Field(field int, x int64) {
+	b.uint64Field(field, uint64(x))
+}
+
+func (b *protobuf) stringField(field int, s string) {
+	b.key(field, wireBytes)
+	b.varint(uint64(len(s)))
+	b.WriteString(s)
+}
+
+// packed writes repeated varints in a single field
+func (b *protobuf) packed(field int, xs []uint64) {
+	var values protobuf
+	for _, x := range xs {
+		values.varint(x)
+	}
+	b.message(field, &values)
+}
+
+func (b *protobuf) message(field int, m *protobuf) {
+	b.key(field, wireBytes)
+	b.varint(uint64(m.Len()))
+	b.Write(m.Bytes())
+}
@@ -0,0 +1,101 @@
+// Package profile builds function-level profiles of programs compiled with profile hooks
+package profile
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/drejca/shift/wasm"
+)
+
+// Profiler is the profiler of a vm host. It builds the call tree of the calls it is
+// told about and charges the instructions executed between two calls or returns to
+// the function running in between. Instructions are counted as the gas used by the
+// instance, so it needs to be created with the instruction gas policy.
+type Profiler struct {
+	functions map[int]wasm.ProfiledFunction
+	root      *node
+	current   *node
+	gas       uint64 // gas used when the last call started or returned
+	start     time.Time
+}
+
+// node is a call stack of the call tree
+type node struct {
+	function     int
+	parent       *node
+	children     map[int]*node
+	order        []*node // children in the order they were first called
+	calls        int64
+	instructions int64 // instructions executed with the stack on top
+}
+
+// New returns a profiler of a module with the profiled functions
+func New(functions []wasm.ProfiledFunction) *Profiler {
+	p := &Profiler{
+		functions: make(map[int]wasm.ProfiledFunction),
+		root:      &node{function: -1, children: make(map[int]*node)},
+		start:     time.Now(),
+	}
+	for _, function := range functions {
+		p.functions[int(function.Index)] = function
+	}
+	p.current = p.root
+	return p
+}
+
+// Enter starts a call of the function with index
+func (p *Profiler) Enter(function int, gas uint64) {
+	p.charge(gas)
+
+	child, found := p.current.children[function]
+	if !found {
+		child = &node{function: function, parent: p.current, children: make(map[int]*node)}
+		p.current.children[function] = child
+		p.current.order = append(p.current.order, child)
+	}
+	child.calls++
+	p.current = child
+}
+
+// Leave returns from the last call started
+func (p *Profiler) Leave(gas uint64) {
+	p.charge(gas)
+	if p.current != p.root {
+		p.current = p.current.parent
+	}
+}
+
+// Unwind returns from all calls started
+func (p *Profiler) Unwind(gas uint64) {
+	p.charge(gas)
+	p.current = p.root
+}
+
+// charge charges the instructions executed since the last call started or returned
+func (p *Profiler) charge(gas uint64) {
+	if p.current != p.root {
+		p.current.instructions += int64(gas - p.gas)
+	}
+	p.gas = gas
+}
+
+// walk calls visit with every stack of the call tree, callers before the functions they called
+func (p *Profiler) walk(visit func(n *node)) {
+	var walk func(n *node)
+	walk = func(n *node) {
+		for _, child := range n.order {
+			visit(child)
+			walk(child)
+		}
+	}
+	walk(p.root)
+}
+
+// name returns the name of the function with index
+func (p *Profiler) name(function int) string {
+	if profiled, found := p.functions[function]; found {
+		return profiled.Name
+	}
+	return fmt.Sprintf("function %d", function)
+}
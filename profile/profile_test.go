@@ -0,0 +1,300 @@
+package profile_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"testing"
+
+	"github.com/drejca/shift/profile"
+	"github.com/drejca/shift/vm"
+	"github.com/drejca/shift/wasm"
+	"github.com/drejca/shift/wasm/wasmtest"
+)
+
+const input = `fn Square(x i32) : i32 {
+	return x * x
+}
+
+fn Fib(n i32) : i32 {
+	if n == 0 {
+		return 0
+	}
+	if n == 1 {
+		return 1
+	}
+	return Fib(n - 1) + Fib(n - 2)
+}
+
+fn main(n i32) : i32 {
+	s := Square(n)
+	return Fib(n) + Square(s)
+}
+`
+
+func TestProfiler(t *testing.T) {
+	profiler, instance := run(t, input)
+	if _, err := instance.Run("main", 5); err != nil {
+		t.Fatal(err)
+	}
+	gas := instance.Gas()
+	if _, err := instance.Run("Square", 3); err != nil {
+		t.Fatal(err)
+	}
+	pprof := readProfile(t, profiler)
+
+	functions := pprof.functions()
+	var names []string
+	for _, name := range pprof.order(functions) {
+		names = append(names, fmt.Sprintf("%s:%d %d", name, pprof.lines[name], functions[name].calls))
+	}
+	if actual := fmt.Sprint(names); actual != "[main:15 1 Fib:5 15 Square:1 3]" {
+		t.Errorf("expected functions [main:15 1 Fib:5 15 Square:1 3] but got %s", actual)
+	}
+
+	// a call of Square executes as many instructions as Square run on its own
+	main, fib, square := functions["main"], functions["Fib"], functions["Square"]
+	call := int64(instance.Gas() - gas)
+	if square.flat != 3*call {
+		t.Errorf("expected 3 calls of Square to execute %d instructions but got %d", 3*call, square.flat)
+	}
+	if main.cum != int64(gas) {
+		t.Errorf("expected main to execute all %d instructions but got %d", gas, main.cum)
+	}
+	if main.cum != main.flat+fib.cum+2*call {
+		t.Errorf("expected main cum %d to be its flat %d, the cum of Fib %d and 2 calls of Square %d", main.cum, main.flat, fib.cum, 2*call)
+	}
+	if fib.flat != fib.cum {
+		t.Errorf("expected recursive Fib to count its instructions once but got flat %d and cum %d", fib.flat, fib.cum)
+	}
+
+	calls := make(map[string]int64)
+	for _, sample := range pprof.samples {
+		caller := ""
+		if len(sample.stack) > 1 {
+			caller = sample.stack[1]
+		}
+		calls[caller+"->"+sample.stack[0]] += sample.calls
+	}
+	var edges []string
+	for edge, count := range calls {
+		edges = append(edges, fmt.Sprintf("%s %d", edge, count))
+	}
+	sort.Strings(edges)
+	expected := "[->Square 1 ->main 1 Fib->Fib 14 main->Fib 1 main->Square 2]"
+	if actual := fmt.Sprint(edges); actual != expected {
+		t.Errorf("expected calls %s but got %s", expected, actual)
+	}
+}
+
+func TestUnwind(t *testing.T) {
+	profiler, instance := run(t, input)
+
+	// Fib recurses until the call stack overflows
+	if _, err := instance.Run("Fib", -1); err == nil {
+		t.Fatal("expected Fib(-1) to trap")
+	}
+	functions := readProfile(t, profiler).functions()
+	if fib := functions["Fib"]; len(functions) != 1 || fib.cum != int64(instance.Gas()) {
+		t.Errorf("expected Fib to execute all %d instructions but got %v", instance.Gas(), functions)
+	}
+
+	// the next call from the host is not made from the stack Fib trapped with
+	square, _ := instance.VM.GetFunctionExport("Square")
+	profiler.Enter(square, instance.Gas())
+	profiler.Unwind(instance.Gas())
+	for _, sample := range readProfile(t, profiler).samples {
+		if sample.stack[0] == "Square" && len(sample.stack) != 1 {
+			t.Errorf("expected Square to be called from the host but got a stack of %d functions", len(sample.stack))
+		}
+	}
+}
+
+func TestWriteProfile(t *testing.T) {
+	profiler, instance := run(t, input)
+	if _, err := instance.Run("main", 5); err != nil {
+		t.Fatal(err)
+	}
+	pprof := readProfile(t, profiler)
+
+	strs := fmt.Sprintf("%q", pprof.strings)
+	for _, s := range []string{"calls", "instructions", "count", "main", "Fib", "Square", "calc.sf"} {
+		if !bytes.Contains([]byte(strs), []byte(fmt.Sprintf("%q", s))) {
+			t.Errorf("expected string table %s to contain %s", strs, s)
+		}
+	}
+	if pprof.sampleTypes != 2 || len(pprof.lines) != 3 {
+		t.Errorf("expected 2 sample types and 3 functions but got %d and %d", pprof.sampleTypes, len(pprof.lines))
+	}
+	// main, main->Square, main->Fib and Fib down to the depth of 5
+	if len(pprof.samples) != 7 {
+		t.Errorf("expected 7 samples but got %d", len(pprof.samples))
+	}
+}
+
+func run(t *testing.T, source string) (*profile.Profiler, *vm.Instance) {
+	code, compiler := wasmtest.Compile(t, "calc.sf", source, (*wasm.Compiler).InsertProfileHooks)
+
+	profiler := profile.New(compiler.ProfiledFunctions())
+	instance, err := vm.NewWithGas(code, &vm.Host{Profiler: profiler}, vm.InstructionGas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return profiler, instance
+}
+
+// pprof is a profile decoded from the pprof format
+type pprof struct {
+	sampleTypes int
+	samples     []sample
+	strings     []string
+	lines       map[string]int64 // start line by function name
+}
+
+// sample is a stack of function names, the function on top first
+type sample struct {
+	stack        []string
+	calls        int64
+	instructions int64
+}
+
+// function sums up the samples of a function. Flat counts the instructions
+// executed in the function itself, cum also those of the functions it called.
+type function struct {
+	calls int64
+	flat  int64
+	cum   int64
+}
+
+// functions sums up the samples by function name
+func (p *pprof) functions() map[string]*function {
+	functions := make(map[string]*function)
+	get := func(name string) *function {
+		if functions[name] == nil {
+			functions[name] = &function{}
+		}
+		return functions[name]
+	}
+
+	for _, sample := range p.samples {
+		top := get(sample.stack[0])
+		top.calls += sample.calls
+		top.flat += sample.instructions
+
+		// a recursive function counts the instructions of a stack once
+		counted := make(map[string]bool)
+		for _, name := range sample.stack {
+			if !counted[name] {
+				counted[name] = true
+				get(name).cum += sample.instructions
+			}
+		}
+	}
+	return functions
+}
+
+// order returns the function names with the most cumulative instructions first
+func (p *pprof) order(functions map[string]*function) []string {
+	var names []string
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(a, b int) bool {
+		return functions[names[a]].cum > functions[names[b]].cum
+	})
+	return names
+}
+
+// readProfile writes the profile of profiler and decodes it
+func readProfile(t *testing.T, profiler *profile.Profiler) *pprof {
+	var out bytes.Buffer
+	if err := profiler.WriteProfile(&out); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, messages := fields(t, data)
+	p := &pprof{sampleTypes: len(messages[1]), lines: make(map[string]int64)}
+	for _, s := range messages[6] {
+		p.strings = append(p.strings, string(s))
+	}
+
+	names := make(map[uint64]string) // function name by function id
+	for _, message := range messages[5] {
+		values, _ := fields(t, message)
+		name := p.strings[values[2][0]]
+		names[values[1][0]] = name
+		p.lines[name] = int64(values[5][0])
+	}
+
+	locations := make(map[uint64]uint64) // function id by location id
+	for _, message := range messages[4] {
+		values, lines := fields(t, message)
+		line, _ := fields(t, lines[4][0])
+		locations[values[1][0]] = line[1][0]
+	}
+
+	for _, message := range messages[2] {
+		_, packed := fields(t, message)
+		var s sample
+		for _, location := range varints(t, packed[1][0]) {
+			s.stack = append(s.stack, names[locations[location]])
+		}
+		values := varints(t, packed[2][0])
+		s.calls, s.instructions = int64(values[0]), int64(values[1])
+		p.samples = append(p.samples, s)
+	}
+	return p
+}
+
+// fields decodes the varint and length-delimited fields of a protocol buffer message by field number
+func fields(t *testing.T, data []byte) (map[int][]uint64, map[int][][]byte) {
+	values := make(map[int][]uint64)
+	messages := make(map[int][][]byte)
+	for len(data) > 0 {
+		key, n := varint(t, data)
+		data = data[n:]
+		if key&7 == 0 {
+			value, n := varint(t, data)
+			values[int(key>>3)] = append(values[int(key>>3)], value)
+			data = data[n:]
+			continue
+		}
+		length, n := varint(t, data)
+		messages[int(key>>3)] = append(messages[int(key>>3)], data[n:n+int(length)])
+		data = data[n+int(length):]
+	}
+	return values, messages
+}
+
+// varints decodes packed varints
+func varints(t *testing.T, data []byte) []uint64 {
+	var values []uint64
+	for len(data) > 0 {
+		value, n := varint(t, data)
+		values = append(values, value)
+		data = data[n:]
+	}
+	return values
+}
+
+func varint(t *testing.T, data []byte) (uint64, int) {
+	var x uint64
+	for i, b := range data {
+		x |= uint64(b&0x7f) << (7 * uint(i))
+		if b < 0x80 {
+			return x, i + 1
+		}
+	}
+	t.Fatal("truncated varint")
+	return 0, 0
+}
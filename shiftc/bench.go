@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/drejca/shift/vm"
+	"github.com/drejca/shift/wasm"
+	"github.com/urfave/cli"
+)
+
+// maxBenchN limits how many times a benchmark function is called in one round
+const maxBenchN = 1000000000
+
+// benchResult is the outcome of calling a benchmark function n times
+type benchResult struct {
+	n   int
+	d   time.Duration
+	gas uint64
+}
+
+// bench compiles every program given as argument and runs its exported Bench
+// functions until they have run for -benchtime. Results are printed in the Go
+// benchmark format with a Benchmark prefix, so runs can be compared with benchstat.
+// Gas is metered at one unit per executed instruction and does not vary between
+// runs of the same code, which makes gas/op the figure to watch for codegen changes.
+func bench(c *cli.Context) error {
+	pattern, err := regexp.Compile(c.String("run"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("invalid -run pattern: %s", err), exitError)
+	}
+	benchtime := c.Duration("benchtime")
+	if benchtime <= 0 {
+		return cli.NewExitError(fmt.Sprintf("invalid -benchtime %s", benchtime), exitError)
+	}
+	count := c.Int("count")
+	if count < 1 {
+		return cli.NewExitError(fmt.Sprintf("invalid -count %d", count), exitError)
+	}
+
+	filenames := []string(c.Args())
+	if len(filenames) == 0 {
+		filenames = []string{"."}
+	}
+
+	passed := true
+	for _, filename := range filenames {
+		if !benchProgram(filename, pattern, benchtime, count) {
+			passed = false
+		}
+	}
+	if !passed {
+		return cli.NewExitError("", exitError)
+	}
+	return nil
+}
+
+// benchProgram runs the benchmarks of the program in filename matching pattern
+// count times each and reports whether all of them ran without failing
+func benchProgram(filename string, pattern *regexp.Regexp, benchtime time.Duration, count int) bool {
+	start := time.Now()
+
+	// positions only add a line table, the benchmarked code is the code build emits
+	compiler := wasm.NewCompiler()
+	compiler.TrackPositions()
+
+	code, err := compile(filename, compiler)
+	if err != nil {
+		fmt.Printf("\nFAIL\t%s [build failed]\n", filename)
+		return false
+	}
+
+	instance, err := vm.New(code, &vm.Host{})
+	if err != nil {
+		fmt.Printf("%s\nFAIL\t%s\t%s\n", err, filename, elapsed(start))
+		return false
+	}
+
+	passed := true
+	for _, name := range instance.Exports() {
+		if !wasm.IsTestFunc(name, "Bench") || !pattern.MatchString(name) {
+			continue
+		}
+
+		for i := 0; i < count; i++ {
+			result, output, ok := runBench(code, compiler.LineTable(), name, benchtime)
+			if !ok {
+				passed = false
+				fmt.Printf("--- FAIL: %s\n%s", name, indent(output))
+				break
+			}
+			fmt.Printf("%-24s\t%10d\t%10d ns/op\t%10d gas/op\n",
+				"Benchmark"+strings.TrimPrefix(name, "Bench"), result.n,
+				result.d.Nanoseconds()/int64(result.n), result.gas/uint64(result.n))
+		}
+	}
+
+	if !passed {
+		fmt.Printf("FAIL\nFAIL\t%s\t%s\n", filename, elapsed(start))
+		return false
+	}
+	fmt.Printf("ok  \t%s\t%s\n", filename, elapsed(start))
+	return true
+}
+
+// runBench calls the benchmark function name in rounds with a growing number of
+// calls until a round takes at least benchtime and returns the last round
+func runBench(code []byte, lineTable *wasm.LineTable, name string, benchtime time.Duration) (result benchResult, output string, passed bool) {
+	n := 1
+	for {
+		result, output, passed = runBenchRound(code, lineTable, name, n)
+		if !passed || result.d >= benchtime || n >= maxBenchN {
+			return result, output, passed
+		}
+		n = predictBenchN(n, result.d, benchtime)
+	}
+}
+
+// runBenchRound calls the benchmark function name n times in a fresh instance of code
+func runBenchRound(code []byte, lineTable *wasm.LineTable, name string, n int) (result benchResult, output string, passed bool) {
+	var out bytes.Buffer
+	host := &vm.Host{Stdout: &out, Stderr: &out, LineTable: lineTable}
+
+	instance, err := vm.NewWithGas(code, host, vm.InstructionGas)
+	if err != nil {
+		return result, err.Error() + "\n", false
+	}
+
+	params, results, err := instance.Signature(name)
+	if err != nil {
+		return result, err.Error() + "\n", false
+	}
+	if params != 0 || results != 0 {
+		return result, fmt.Sprintf("wrong signature for %s, must be: fn %s()\n", name, name), false
+	}
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		_, err = instance.Run(name)
+		if exit, ok := err.(*vm.Exit); ok {
+			fmt.Fprintf(&out, "benchmark called exit(%d)\n", exit.Code)
+			return result, out.String(), false
+		}
+		if err != nil {
+			fmt.Fprintf(&out, "trap: %s\n", err)
+			return result, out.String(), false
+		}
+		if len(host.Errors) != 0 {
+			return result, out.String(), false
+		}
+	}
+	return benchResult{n: n, d: time.Since(start), gas: instance.Gas()}, out.String(), true
+}
+
+// predictBenchN estimates the number of calls taking benchtime from a round of n
+// calls taking d. Like Go it overshoots by a fifth and grows at most a hundredfold.
+func predictBenchN(n int, d time.Duration, benchtime time.Duration) int {
+	next := int64(maxBenchN)
+	if ns := d.Nanoseconds(); ns > 0 {
+		next = benchtime.Nanoseconds() * int64(n) / ns
+	}
+	next += next / 5
+	if limit := int64(n) * 100; next > limit {
+		next = limit
+	}
+	if next <= int64(n) {
+		next = int64(n) + 1
+	}
+	if next > maxBenchN {
+		next = maxBenchN
+	}
+	return int(next)
+}
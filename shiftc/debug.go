@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+
+	"github.com/drejca/shift/debug"
+	"github.com/drejca/shift/vm"
+	"github.com/drejca/shift/wasm"
+	"github.com/urfave/cli"
+)
+
+// debugProgram runs a program like run in an interactive debugger reading commands
+// from stdin. The program stops at the first statement of main, where breakpoints
+// can be set before continuing.
+func debugProgram(c *cli.Context) error {
+	compiler := wasm.NewCompiler()
+	compiler.InsertStepHooks()
+
+	debugger := debug.New(compiler.LineTable(), os.Stdin, os.Stdout)
+	return runMain(c, compiler, &vm.Host{Stdout: os.Stdout, Stderr: os.Stderr, Step: debugger.Step})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/drejca/shift/debug"
+	"github.com/drejca/shift/wasm"
+)
+
+// addDebugInfo appends the DWARF sections of the module built into wasmFile and writes
+// its source map to wasmFile with a .map extension, which the module then points to.
+// Sources in the source map are relative to it, DWARF names them relative to the
+// working directory.
+func addDebugInfo(code []byte, wasmFile string, lineTable *wasm.LineTable) ([]byte, error) {
+	compDir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	for _, section := range debug.DWARF(lineTable, compDir) {
+		code = wasm.AppendCustomSection(code, section.Name, section.Data)
+	}
+
+	mapFile := wasmFile + ".map"
+	sourceMap := debug.NewSourceMap(lineTable)
+	sourceMap.File = filepath.Base(wasmFile)
+	for i, source := range sourceMap.Sources {
+		if rel, err := filepath.Rel(filepath.Dir(mapFile), source); err == nil {
+			sourceMap.Sources[i] = filepath.ToSlash(rel)
+		}
+	}
+
+	data, err := json.Marshal(sourceMap)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(mapFile, data, 0644); err != nil {
+		return nil, err
+	}
+	return wasm.AppendCustomSection(code, debug.SourceMappingURLSection, debug.SourceMappingURL(filepath.Base(mapFile))), nil
+}
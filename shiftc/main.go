@@ -2,14 +2,16 @@ package main
 
 import (
 	"fmt"
-	"github.com/drejca/shift/parser"
+	"github.com/drejca/shift/loader"
 	"github.com/drejca/shift/print"
 	"github.com/drejca/shift/wasm"
 	"github.com/urfave/cli"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 func main() {
@@ -23,8 +25,50 @@ func main() {
 		{
 			Name:    "build",
 			Aliases: []string{"b"},
-			Usage:   "build [filename]",
+			Usage:   "build [--strip] [--debug] [filename|directory]",
 			Action:  build,
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "strip", Usage: "leave the name section with debug names out of the module"},
+				cli.BoolFlag{Name: "debug", Usage: "add DWARF line info and write a source map next to the module"},
+			},
+		},
+		{
+			Name:    "run",
+			Aliases: []string{"r"},
+			Usage:   "run [-profile file] [filename|directory] [arguments]",
+			Action:  run,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "profile", Usage: "write a pprof profile of the function calls to file"},
+			},
+		},
+		{
+			Name:    "test",
+			Aliases: []string{"t"},
+			Usage:   "test [-run regexp] [-v] [-cover] [-coverprofile file] [-coverannotate] [filename|directory]...",
+			Action:  test,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "run", Usage: "run only tests matching the regular expression"},
+				cli.BoolFlag{Name: "v", Usage: "print the name and output of every test"},
+				cli.BoolFlag{Name: "cover", Usage: "print the statement coverage of every function"},
+				cli.StringFlag{Name: "coverprofile", Usage: "write the coverage as lcov tracefile to file"},
+				cli.BoolFlag{Name: "coverannotate", Usage: "print the source annotated with statement counts"},
+			},
+		},
+		{
+			Name:    "debug",
+			Aliases: []string{"d"},
+			Usage:   "debug [filename|directory] [arguments]",
+			Action:  debugProgram,
+		},
+		{
+			Name:   "bench",
+			Usage:  "bench [-run regexp] [-benchtime duration] [-count n] [filename|directory]...",
+			Action: bench,
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "run", Value: ".", Usage: "run only benchmarks matching the regular expression"},
+				cli.DurationFlag{Name: "benchtime", Value: time.Second, Usage: "run each benchmark for at least this long"},
+				cli.IntFlag{Name: "count", Value: 1, Usage: "run each benchmark this many times"},
+			},
 		},
 	}
 
@@ -38,55 +82,82 @@ func build(c *cli.Context) error {
 	filename := c.Args().First()
 	fmt.Println("build: ", filename)
 
-	file, err := os.Open(filename)
+	compiler := wasm.NewCompiler()
+	if c.Bool("strip") {
+		compiler.StripNames()
+	}
+	if c.Bool("debug") {
+		compiler.TrackPositions()
+	}
+
+	code, err := compile(filename, compiler)
 	if err != nil {
-		fmt.Print(err)
 		return err
 	}
 
-	p := parser.New(file)
-	program, parseErr := p.ParseProgram()
-
-	file.Close()
-
-	if parseErr != nil {
-		file, err = os.Open(filename)
+	if info, err := os.Stat(filename); err == nil && info.IsDir() {
+		abs, err := filepath.Abs(filename)
 		if err != nil {
 			fmt.Print(err)
 			return err
 		}
-
-		printer := print.New(file)
-		fmt.Print(printer.PrintError(parseErr))
-
-		file.Close()
-		return parseErr.Error()
+		filename = filepath.Join(filename, filepath.Base(abs))
+	} else {
+		fileExtPos := strings.LastIndex(filename, ".")
+		if fileExtPos != -1 {
+			filename = filename[:fileExtPos]
+		}
 	}
 
-	compiler := wasm.NewCompiler()
-	wasmModule := compiler.CompileProgram(program)
+	if c.Bool("debug") {
+		code, err = addDebugInfo(code, filename+".wasm", compiler.LineTable())
+		if err != nil {
+			fmt.Print(err)
+			return err
+		}
+	}
 
-	for _, err := range compiler.Errors() {
+	err = ioutil.WriteFile(filename + ".wasm", code, 0644)
+	if err != nil {
 		fmt.Print(err)
 		return err
 	}
+	return nil
+}
 
-	emitter := wasm.NewEmitter()
-	err = emitter.Emit(wasmModule)
+// compile compiles the program in filename to a wasm module with compiler printing any error
+func compile(filename string, compiler *wasm.Compiler) ([]byte, error) {
+	packages, err := loader.Load(filename)
 	if err != nil {
+		if parseErr, ok := err.(*loader.ParseError); ok {
+			file, err := os.Open(parseErr.Filename)
+			if err != nil {
+				fmt.Print(err)
+				return nil, err
+			}
+
+			printer := print.New(file)
+			fmt.Print(printer.PrintError(parseErr.Err))
+
+			file.Close()
+			return nil, parseErr.Err.Error()
+		}
 		fmt.Print(err)
-		return err
+		return nil, err
 	}
 
-	fileExtPos := strings.LastIndex(filename, ".")
-	if fileExtPos != -1 {
-		filename = filename[:fileExtPos]
+	wasmModule := compiler.CompilePackages(packages)
+
+	for _, err := range compiler.Errors() {
+		fmt.Print(err)
+		return nil, err
 	}
 
-	err = ioutil.WriteFile(filename + ".wasm", emitter.Bytes(), 0644)
+	emitter := wasm.NewEmitter()
+	err = emitter.Emit(wasmModule)
 	if err != nil {
 		fmt.Print(err)
-		return err
+		return nil, err
 	}
-	return nil
+	return emitter.Bytes(), nil
 }
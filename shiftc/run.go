@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/drejca/shift/debug"
+	"github.com/drejca/shift/profile"
+	"github.com/drejca/shift/vm"
+	"github.com/drejca/shift/wasm"
+	"github.com/urfave/cli"
+)
+
+// Exit codes of shiftc run besides the status a program passes to exit or
+// returns from main. Only statuses from 0 to 255 are meaningful exit codes, so
+// other statuses exit with exitError. A program can still return 1 or 2 itself,
+// which cannot be told apart from the reserved codes.
+const (
+	exitError = 1 // error was called, the program could not be run or its status is out of range
+	exitTrap  = 2 // the program trapped
+)
+
+// exitStatus returns the exit error of the status a program passed to exit or returned from main
+func exitStatus(status int) error {
+	if status < 0 || status > 255 {
+		return cli.NewExitError(fmt.Sprintf("exit status %d out of range 0-255", status), exitError)
+	}
+	if status == 0 {
+		return nil
+	}
+	return cli.NewExitError("", status)
+}
+
+// run compiles a program in memory and runs its main function. Integer
+// arguments after the filename are passed as the parameters of main.
+func run(c *cli.Context) error {
+	compiler := wasm.NewCompiler()
+	compiler.TrackPositions()
+
+	return runMain(c, compiler, &vm.Host{Stdout: os.Stdout, Stderr: os.Stderr})
+}
+
+// runMain compiles the program named by the first argument with compiler and runs
+// its main function with host, which gets the line table of the compiler. With
+// --profile the calls of Shift functions are profiled and the profile is written
+// to the file when main returned or stopped.
+func runMain(c *cli.Context, compiler *wasm.Compiler, host *vm.Host) error {
+	filename := c.Args().First()
+	profileFile := c.String("profile")
+	if profileFile != "" {
+		compiler.InsertProfileHooks()
+	}
+
+	var args []int64
+	for _, arg := range c.Args().Tail() {
+		value, err := strconv.ParseInt(arg, 0, 64)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("invalid argument %q: main only takes integer arguments", arg), exitError)
+		}
+		args = append(args, value)
+	}
+
+	code, err := compile(filename, compiler)
+	if err != nil {
+		return cli.NewExitError("", exitError)
+	}
+
+	host.LineTable = compiler.LineTable()
+	var profiler *profile.Profiler
+	var instance *vm.Instance
+	if profileFile != "" {
+		// profiled calls count the instructions they executed as gas
+		profiler = profile.New(compiler.ProfiledFunctions())
+		host.Profiler = profiler
+		instance, err = vm.NewWithGas(code, host, vm.InstructionGas)
+	} else {
+		instance, err = vm.New(code, host)
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+
+	params, _, err := instance.Signature("main")
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitError)
+	}
+	if params != len(args) {
+		return cli.NewExitError(fmt.Sprintf("main expects %d arguments but got %d", params, len(args)), exitError)
+	}
+
+	result, err := instance.Run("main", args...)
+	if profiler != nil {
+		if err := writeProfile(profileFile, profiler); err != nil {
+			return cli.NewExitError(err.Error(), exitError)
+		}
+	}
+	if exit, ok := err.(*vm.Exit); ok {
+		return exitStatus(exit.Code)
+	}
+	if err == debug.ErrQuit {
+		return cli.NewExitError("", exitError)
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("trap: %s\n%s", err, strings.TrimSuffix(instance.StackTrace().String(), "\n")), exitTrap)
+	}
+	if len(host.Errors) != 0 {
+		return cli.NewExitError("", exitError)
+	}
+	return mainStatus(compiler.MainResult(), result)
+}
+
+// mainStatus returns the exit error of the result main returned, which the compiler
+// only allows to be i32 or i32!i32. An Err result exits with exitError.
+func mainStatus(resultType string, result int64) error {
+	switch resultType {
+	case "i32":
+		return exitStatus(int(int32(result)))
+	case "i32!i32":
+		// the upper 32 bits of a T!E result flag an Err
+		if result>>32 != 0 {
+			return cli.NewExitError(fmt.Sprintf("main returned error %d", int32(result)), exitError)
+		}
+		return exitStatus(int(int32(result)))
+	}
+	return nil
+}
+
+// writeProfile writes the profile of profiler to file in the pprof format
+func writeProfile(file string, profiler *profile.Profiler) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := profiler.WriteProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
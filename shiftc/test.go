@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/drejca/shift/cover"
+	"github.com/drejca/shift/vm"
+	"github.com/drejca/shift/wasm"
+	"github.com/urfave/cli"
+)
+
+// testOptions are the flags of shiftc test
+type testOptions struct {
+	pattern      *regexp.Regexp
+	verbose      bool
+	cover        bool
+	coverProfile io.Writer // receives the lcov records of every program with -coverprofile
+	annotate     bool
+}
+
+// test compiles every program given as argument into a test module and runs
+// its test blocks and exported Test functions each in a fresh instance. A test
+// fails when a check fails, it calls error, exits or traps. Without arguments
+// the program in the current directory is tested.
+//
+// With -cover the statements run by the tests are counted and the coverage of
+// every function is printed. -coverprofile writes it as lcov tracefile and
+// -coverannotate prints the source annotated with the counts.
+func test(c *cli.Context) error {
+	pattern, err := regexp.Compile(c.String("run"))
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("invalid -run pattern: %s", err), exitError)
+	}
+	opts := &testOptions{
+		pattern:  pattern,
+		verbose:  c.Bool("v"),
+		cover:    c.Bool("cover") || c.IsSet("coverprofile") || c.Bool("coverannotate"),
+		annotate: c.Bool("coverannotate"),
+	}
+
+	if profile := c.String("coverprofile"); profile != "" {
+		file, err := os.Create(profile)
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitError)
+		}
+		defer file.Close()
+		opts.coverProfile = file
+	}
+
+	filenames := []string(c.Args())
+	if len(filenames) == 0 {
+		filenames = []string{"."}
+	}
+
+	passed := true
+	for _, filename := range filenames {
+		if !testProgram(filename, opts) {
+			passed = false
+		}
+	}
+	if !passed {
+		return cli.NewExitError("", exitError)
+	}
+	return nil
+}
+
+// testProgram runs the tests of the program in filename matching the -run pattern
+// and prints their results followed by a summary line. It reports whether all passed.
+func testProgram(filename string, opts *testOptions) bool {
+	start := time.Now()
+
+	compiler := wasm.NewCompiler()
+	compiler.IncludeTests()
+	compiler.TrackPositions()
+	if opts.cover {
+		compiler.Cover()
+	}
+
+	code, err := compile(filename, compiler)
+	if err != nil {
+		fmt.Printf("\nFAIL\t%s [build failed]\n", filename)
+		return false
+	}
+
+	instance, err := vm.New(code, &vm.Host{})
+	if err != nil {
+		fmt.Printf("%s\nFAIL\t%s\t%s\n", err, filename, elapsed(start))
+		return false
+	}
+
+	var profile *cover.Profile
+	if opts.cover {
+		profile = cover.New(compiler.Coverage())
+	}
+
+	passed := true
+	ran := false
+	for _, export := range instance.Exports() {
+		name, ok := testName(export)
+		if !ok || !opts.pattern.MatchString(name) {
+			continue
+		}
+		ran = true
+
+		if opts.verbose {
+			fmt.Printf("=== RUN   %s\n", name)
+		}
+		testStart := time.Now()
+		output, ok := runTest(code, compiler, profile, export)
+		if !ok {
+			passed = false
+			fmt.Printf("--- FAIL: %s (%.2fs)\n", name, time.Since(testStart).Seconds())
+		} else if opts.verbose {
+			fmt.Printf("--- PASS: %s (%.2fs)\n", name, time.Since(testStart).Seconds())
+		}
+		if !ok || opts.verbose {
+			fmt.Print(indent(output))
+		}
+	}
+
+	if !passed {
+		fmt.Printf("FAIL\nFAIL\t%s\t%s\n", filename, elapsed(start))
+		return false
+	}
+	if opts.verbose {
+		fmt.Println("PASS")
+	}
+
+	summary := fmt.Sprintf("ok  \t%s\t%s", filename, elapsed(start))
+	if !ran {
+		summary += " [no tests to run]"
+	}
+	if profile != nil {
+		summary += fmt.Sprintf("\tcoverage: %.1f%% of statements", profile.Percent())
+	}
+	fmt.Println(summary)
+
+	if profile != nil {
+		return reportCoverage(profile, opts)
+	}
+	return true
+}
+
+// reportCoverage prints the coverage of every function, writes the lcov records
+// and annotates the covered source files as requested by opts
+func reportCoverage(profile *cover.Profile, opts *testOptions) bool {
+	if err := profile.WriteFunctions(os.Stdout); err != nil {
+		fmt.Println(err)
+		return false
+	}
+
+	if opts.coverProfile != nil {
+		if err := profile.WriteLcov(opts.coverProfile); err != nil {
+			fmt.Println(err)
+			return false
+		}
+	}
+
+	if opts.annotate {
+		for _, filename := range profile.Files() {
+			src, err := ioutil.ReadFile(filename)
+			if err != nil {
+				fmt.Println(err)
+				return false
+			}
+			if err := profile.Annotate(os.Stdout, filename, src); err != nil {
+				fmt.Println(err)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// runTest runs the exported test function name in a fresh instance of code and returns
+// what it printed, including the positioned error calls and stack traces, and whether it passed.
+// The statements the test ran are added to profile unless it is nil.
+func runTest(code []byte, compiler *wasm.Compiler, profile *cover.Profile, name string) (output string, passed bool) {
+	var out bytes.Buffer
+	host := &vm.Host{Stdout: &out, Stderr: &out, LineTable: compiler.LineTable()}
+
+	instance, err := vm.New(code, host)
+	if err != nil {
+		return err.Error() + "\n", false
+	}
+	if profile != nil {
+		defer func() { profile.Add(instance.VM.Globals) }()
+	}
+
+	params, results, err := instance.Signature(name)
+	if err != nil {
+		return err.Error() + "\n", false
+	}
+	if params != 0 || results != 0 {
+		return fmt.Sprintf("wrong signature for %s, must be: fn %s()\n", name, name), false
+	}
+
+	_, err = instance.Run(name)
+	if exit, ok := err.(*vm.Exit); ok {
+		fmt.Fprintf(&out, "test called exit(%d)\n", exit.Code)
+		return out.String(), false
+	}
+	if err != nil {
+		fmt.Fprintf(&out, "trap: %s\n%s", err, instance.StackTrace())
+		return out.String(), false
+	}
+	return out.String(), len(host.Errors) == 0
+}
+
+// testName returns the name of the test a function is exported for. Test blocks
+// are exported with the wasm.TestExportPrefix, Test functions by their name.
+func testName(export string) (name string, ok bool) {
+	if strings.HasPrefix(export, wasm.TestExportPrefix) {
+		return strings.TrimPrefix(export, wasm.TestExportPrefix), true
+	}
+	return export, wasm.IsTestFunc(export, "Test")
+}
+
+// indent indents every line of output to nest it under its test result
+func indent(output string) string {
+	if output == "" {
+		return ""
+	}
+	lines := strings.SplitAfter(output, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = "    " + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// elapsed formats the time since start in seconds
+func elapsed(start time.Time) string {
+	return fmt.Sprintf("%.3fs", time.Since(start).Seconds())
+}
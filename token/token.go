@@ -1,14 +1,72 @@
 package token
 
+import "fmt"
+
 type Token struct {
-	Type Type
-	Lit  string   // token literal text
-	Pos  Position // token position
+	Type     Type
+	Lit      string    // token literal text
+	Pos      Position  // token position
+	End      Position  // position just after the token
+	Comments []Comment // comments between the previous token and this one
+}
+
+// Span returns the source range of the token
+func (t Token) Span() Span {
+	return Span{Start: t.Pos, End: t.End}
+}
+
+// Comment is a // line comment or a /* */ block comment kept as trivia of the following token
+type Comment struct {
+	Text string   // comment text including the comment delimiters
+	Pos  Position // position of the first comment delimiter
+}
+
+// IsLine reports whether the comment is a // line comment
+func (c Comment) IsLine() bool {
+	return len(c.Text) >= 2 && c.Text[:2] == "//"
+}
+
+// EndLine returns the line the comment ends on
+func (c Comment) EndLine() int {
+	line := c.Pos.Line
+	for _, ch := range c.Text {
+		if ch == '\n' {
+			line++
+		}
+	}
+	return line
 }
 
 type Position struct {
-	Line   int // line number, starting at 1
-	Column int // column number, starting at 1
+	Filename string // name of the source file, empty when not read from a file
+	Offset   int    // byte offset, starting at 0
+	Line     int    // line number, starting at 1
+	Column   int    // column number in characters, starting at 1. A tab counts as one character.
+}
+
+// String returns the position as file:line:column or line:column without a file name
+func (p Position) String() string {
+	s := fmt.Sprintf("%d:%d", p.Line, p.Column)
+	if p.Filename != "" {
+		s = p.Filename + ":" + s
+	}
+	return s
+}
+
+// Span is a range of source text from Start up to but not including End
+type Span struct {
+	Start Position
+	End   Position
+}
+
+// Len returns the length of the span in bytes
+func (s Span) Len() int {
+	return s.End.Offset - s.Start.Offset
+}
+
+// Contains reports whether the byte offset lies within the span
+func (s Span) Contains(offset int) bool {
+	return s.Start.Offset <= offset && offset < s.End.Offset
 }
 
 type CompileError interface {
@@ -30,31 +88,65 @@ const (
 	INT
 	FLOAT
 	STRING
+	CHAR
 
 	// Keywords
 	FUNC
 	RETURN
 	IMPORT
 	IF
+	ELSE
+	PACKAGE
+	DEFER
+	SWITCH
+	CASE
+	DEFAULT
 
 	// Delimiters
 	COMMA
 	COLON
 	SEMICOLON
+	DOT
+	AT
 
 	LPAREN
 	RPAREN
 	LCURLY
 	RCURLY
+	LBRACKET
+	RBRACKET
 
 	// Operators
 	PLUS
 	MINUS
 	ASTERISK
+	SLASH
+	PERCENT
+	AMPERSAND
+	PIPE
+	CARET
+	SHL
+	SHR
 	ASSIGN
 	INIT_ASSIGN
 	BANG
+	EQ
 	NOT_EQ
+	QUESTION
+
+	// Compound assignment and increment operators
+	ADD_ASSIGN
+	SUB_ASSIGN
+	MUL_ASSIGN
+	QUO_ASSIGN
+	REM_ASSIGN
+	AND_ASSIGN
+	OR_ASSIGN
+	XOR_ASSIGN
+	SHL_ASSIGN
+	SHR_ASSIGN
+	INC
+	DEC
 )
 
 var Tokens = map[Type]string{
@@ -68,32 +160,66 @@ var Tokens = map[Type]string{
 	INT:    "INT",
 	FLOAT:  "FLOAT",
 	STRING: "STRING",
+	CHAR:   "CHAR",
 
 	// Keywords
-	FUNC:   "FUNC",
-	RETURN: "RETURN",
-	IMPORT: "IMPORT",
-	IF:     "IF",
+	FUNC:    "FUNC",
+	RETURN:  "RETURN",
+	IMPORT:  "IMPORT",
+	IF:      "IF",
+	ELSE:    "ELSE",
+	PACKAGE: "PACKAGE",
+	DEFER:   "DEFER",
+	SWITCH:  "SWITCH",
+	CASE:    "CASE",
+	DEFAULT: "DEFAULT",
 
 	// Delimiters
 	COMMA:     ",",
 	COLON:     ":",
 	SEMICOLON: ";",
+	DOT:       ".",
+	AT:        "@",
 
 	LPAREN: "(",
 	RPAREN: ")",
 	LCURLY: "{",
 	RCURLY: "}",
 
+	LBRACKET: "[",
+	RBRACKET: "]",
+
 	// Operators
 	PLUS:        "+",
 	MINUS:       "-",
 	ASTERISK:    "*",
+	SLASH:       "/",
+	PERCENT:     "%",
+	AMPERSAND:   "&",
+	PIPE:        "|",
+	CARET:       "^",
+	SHL:         "<<",
+	SHR:         ">>",
 	ASSIGN:      "=",
 	INIT_ASSIGN: ":=",
 	BANG:        "!",
 
-	NOT_EQ: "!=",
+	EQ:       "==",
+	NOT_EQ:   "!=",
+	QUESTION: "?",
+
+	ADD_ASSIGN: "+=",
+	SUB_ASSIGN: "-=",
+	MUL_ASSIGN: "*=",
+	QUO_ASSIGN: "/=",
+	REM_ASSIGN: "%=",
+	AND_ASSIGN: "&=",
+	OR_ASSIGN:  "|=",
+	XOR_ASSIGN: "^=",
+	SHL_ASSIGN: "<<=",
+	SHR_ASSIGN: ">>=",
+	INC:        "++",
+	DEC:        "--",
 }
 
 // Print returns string name of token.Type
@@ -116,6 +242,18 @@ func LookupIdent(ident string) Token {
 		return Token{Type: IMPORT, Lit: ident}
 	case "if":
 		return Token{Type: IF, Lit: ident}
+	case "else":
+		return Token{Type: ELSE, Lit: ident}
+	case "package":
+		return Token{Type: PACKAGE, Lit: ident}
+	case "defer":
+		return Token{Type: DEFER, Lit: ident}
+	case "switch":
+		return Token{Type: SWITCH, Lit: ident}
+	case "case":
+		return Token{Type: CASE, Lit: ident}
+	case "default":
+		return Token{Type: DEFAULT, Lit: ident}
 	}
 	return Token{Type: IDENT, Lit: ident}
 }
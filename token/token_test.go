@@ -33,6 +33,13 @@ func TestLookupIdent(t *testing.T) {
 		{ident: "name", expectToken: token.Token{Lit: "name", Type: token.IDENT}},
 		{ident: "import", expectToken: token.Token{Lit: "import", Type: token.IMPORT}},
 		{ident: "if", expectToken: token.Token{Lit: "if", Type: token.IF}},
+		{ident: "else", expectToken: token.Token{Lit: "else", Type: token.ELSE}},
+		{ident: "package", expectToken: token.Token{Lit: "package", Type: token.PACKAGE}},
+		{ident: "defer", expectToken: token.Token{Lit: "defer", Type: token.DEFER}},
+		{ident: "switch", expectToken: token.Token{Lit: "switch", Type: token.SWITCH}},
+		{ident: "case", expectToken: token.Token{Lit: "case", Type: token.CASE}},
+		{ident: "default", expectToken: token.Token{Lit: "default", Type: token.DEFAULT}},
+		{ident: "test", expectToken: token.Token{Lit: "test", Type: token.IDENT}},
 	}
 
 	for _, test := range tests {
@@ -43,3 +50,19 @@ func TestLookupIdent(t *testing.T) {
 		}
 	}
 }
+
+func TestPrintPosition(t *testing.T) {
+	tests := []struct {
+		pos      token.Position
+		expected string
+	}{
+		{pos: token.Position{Filename: "main.sf", Offset: 12, Line: 2, Column: 5}, expected: "main.sf:2:5"},
+		{pos: token.Position{Line: 3, Column: 1}, expected: "3:1"},
+	}
+
+	for _, test := range tests {
+		if test.pos.String() != test.expected {
+			t.Errorf("expected %q got %q", test.expected, test.pos.String())
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package vm
+
+import (
+	"sort"
+
+	"github.com/go-interpreter/wagon/disasm"
+	"github.com/go-interpreter/wagon/wasm"
+	"github.com/perlin-network/life/compiler"
+	"github.com/perlin-network/life/exec"
+)
+
+// codeMap maps the instruction pointers of the code life interprets back to the wasm
+// instructions it was compiled from. Life compiles every reachable wasm instruction
+// other than control flow, drop and nop into exactly one instruction of its own in the
+// same order, so compiling a function again pairs up the instructions of both.
+type codeMap struct {
+	vm        *exec.VirtualMachine
+	functions map[int]*functionCode
+}
+
+// functionCode is the interpreted code of a function
+type functionCode struct {
+	starts  []int // offset of every interpreted instruction
+	sources []int // index of the wasm instruction it was compiled from, -1 for control flow
+}
+
+func newCodeMap(vm *exec.VirtualMachine) *codeMap {
+	return &codeMap{vm: vm, functions: make(map[int]*functionCode)}
+}
+
+// instruction returns the index of the wasm instruction executing at ip in the function
+// with index. The instruction pointer of a frame is past the instruction it executes
+// or inside of it when the instruction trapped. Control flow is attributed to the last
+// instruction before it.
+func (m *codeMap) instruction(index int, ip int) (instruction int, found bool) {
+	code, compiled := m.functions[index]
+	if !compiled {
+		code = m.compile(index)
+		m.functions[index] = code
+	}
+	if code == nil || ip < 1 {
+		return 0, false
+	}
+
+	i := sort.SearchInts(code.starts, ip) - 1
+	for ; i >= 0; i-- {
+		if code.sources[i] >= 0 {
+			return code.sources[i], true
+		}
+	}
+	return 0, false
+}
+
+// compile compiles the function with index like life does and pairs the instructions
+// of both, or returns nil for imported functions and code life compiled differently
+func (m *codeMap) compile(index int) *functionCode {
+	module := m.vm.Module.Base
+	var importTypeIDs []int
+	if module.Import != nil {
+		for _, entry := range module.Import.Entries {
+			if funcImport, ok := entry.Type.(wasm.FuncImport); ok {
+				importTypeIDs = append(importTypeIDs, int(funcImport.Type))
+			}
+		}
+	}
+
+	function := index - len(importTypeIDs)
+	if function < 0 || function >= len(module.FunctionIndexSpace) || index >= len(m.vm.FunctionCode) {
+		return nil
+	}
+	d, err := disasm.Disassemble(module.FunctionIndexSpace[function], module)
+	if err != nil {
+		return nil
+	}
+
+	ssa := compiler.NewSSAFunctionCompiler(module, d)
+	ssa.CallIndexOffset = len(importTypeIDs)
+	ssa.Compile(importTypeIDs)
+	if m.vm.GasPolicy != nil {
+		ssa.InsertGasCounters(m.vm.GasPolicy)
+	}
+
+	sources := reachableInstructions(d)
+	code := &functionCode{}
+	offset, next := 0, 0
+	for _, ins := range ssa.Code {
+		code.starts = append(code.starts, offset)
+		offset += instructionLength(ins)
+
+		switch ins.Op {
+		case "jmp", "jmp_if", "jmp_either", "jmp_table", "phi", "return", "add_gas":
+			code.sources = append(code.sources, -1)
+		default:
+			if next == len(sources) {
+				return nil
+			}
+			code.sources = append(code.sources, sources[next])
+			next++
+		}
+	}
+	if next != len(sources) || offset != len(m.vm.FunctionCode[index].Bytes) {
+		return nil
+	}
+	return code
+}
+
+// reachableInstructions returns the indices of the wasm instructions life compiles into
+// one instruction of its own. Like life it skips the code following an unconditional
+// branch up to the end or else of its block.
+func reachableInstructions(d *disasm.Disassembly) []int {
+	var sources []int
+	unreachableDepth := 0
+	for i, ins := range d.Code {
+		if unreachableDepth != 0 {
+			switch ins.Op.Name {
+			case "block", "loop", "if":
+				unreachableDepth++
+			case "end":
+				unreachableDepth--
+			}
+			if unreachableDepth == 1 && ins.Op.Name == "else" {
+				unreachableDepth--
+			}
+			if unreachableDepth != 0 {
+				continue
+			}
+		}
+
+		switch ins.Op.Name {
+		case "unreachable":
+			sources = append(sources, i)
+			unreachableDepth = 1
+		case "br", "br_table", "return":
+			unreachableDepth = 1
+		case "nop", "drop", "block", "loop", "if", "else", "end", "br_if":
+		default:
+			sources = append(sources, i)
+		}
+	}
+	return sources
+}
+
+// instructionLength returns the length of an instruction serialized by life, which
+// encodes immediates and operands with a fixed width
+func instructionLength(ins compiler.Instr) int {
+	// jump targets are relocated within the serialized code
+	ins.Immediates = make([]int64, len(ins.Immediates))
+	ssa := &compiler.SSAFunctionCompiler{Code: []compiler.Instr{ins}}
+	return len(ssa.Serialize())
+}
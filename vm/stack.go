@@ -0,0 +1,115 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/drejca/shift/token"
+	"github.com/drejca/shift/wasm"
+	"github.com/perlin-network/life/exec"
+)
+
+// Frame is a Shift function on the call stack
+type Frame struct {
+	Function  string
+	Pos       token.Position // position the function stopped at, unknown for runtime functions
+	Variables []Variable     // variables in scope at Pos
+}
+
+// Variable is a Shift variable of a stopped function
+type Variable struct {
+	Name  string
+	Type  string
+	Value string // value formatted as Shift literal
+}
+
+// Stack is the call stack of a stopped program with the innermost function first
+type Stack []Frame
+
+// String formats the stack like a Go stack trace
+//
+//	divide
+//		calc.sf:3:9
+//	main
+//		calc.sf:8:2
+func (s Stack) String() string {
+	var b strings.Builder
+	for _, frame := range s {
+		fmt.Fprintf(&b, "%s\n", frame.Function)
+		if frame.Pos.Line != 0 {
+			fmt.Fprintf(&b, "\t%s\n", frame.Pos)
+		}
+	}
+	return b.String()
+}
+
+// StackTrace returns the call stack the last call stopped with, empty when it
+// returned or no line table of the module was given to the host
+func (i *Instance) StackTrace() Stack {
+	return i.Host.stackTrace(i.VM)
+}
+
+// stackTrace symbolizes the frames of vm by the instruction every frame executes. A
+// host function is called from a frame of its own which is left out, its caller is
+// positioned at the call.
+func (h *Host) stackTrace(vm *exec.VirtualMachine) Stack {
+	lineTable := h.LineTable
+	if lineTable == nil {
+		return nil
+	}
+	if h.code == nil || h.code.vm != vm {
+		h.code = newCodeMap(vm)
+	}
+
+	var stack Stack
+	for i := vm.CurrentFrame; i >= 0 && i < len(vm.CallStack); i-- {
+		frame := vm.CallStack[i]
+		if lineTable.IsImport(frame.FunctionID) {
+			continue
+		}
+
+		stackFrame := Frame{Function: lineTable.FunctionName(frame.FunctionID)}
+		if instruction, found := h.code.instruction(frame.FunctionID, frame.IP); found {
+			entry := lineTable.Entry(frame.FunctionID, instruction)
+			stackFrame.Pos, _ = lineTable.Position(entry)
+			for _, variable := range lineTable.Variables(frame.FunctionID, entry) {
+				stackFrame.Variables = append(stackFrame.Variables, Variable{
+					Name:  variable.Name,
+					Type:  variable.Type,
+					Value: formatValue(vm, frame.Locals, variable),
+				})
+			}
+		}
+		stack = append(stack, stackFrame)
+	}
+	return stack
+}
+
+// formatValue formats the value of a variable held in locals
+func formatValue(vm *exec.VirtualMachine, locals []int64, variable *wasm.Variable) string {
+	if int(variable.Local) >= len(locals) {
+		return "?"
+	}
+	value := locals[variable.Local]
+
+	switch variable.Type {
+	case "string":
+		if int(variable.Local)+1 >= len(locals) {
+			return "?"
+		}
+		offset, length := uint32(value), uint32(locals[variable.Local+1])
+		if uint64(offset)+uint64(length) > uint64(len(vm.Memory)) {
+			return "?"
+		}
+		return strconv.Quote(string(vm.Memory[offset : offset+length]))
+	case "i64":
+		return strconv.FormatInt(value, 10)
+	case "f32":
+		return strconv.FormatFloat(float64(math.Float32frombits(uint32(value))), 'g', -1, 32)
+	case "f64":
+		return strconv.FormatFloat(math.Float64frombits(uint64(value)), 'g', -1, 64)
+	}
+	return strconv.FormatInt(int64(int32(value)), 10)
+}
@@ -0,0 +1,283 @@
+// Package vm runs compiled Shift modules in the life virtual machine
+package vm
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/drejca/shift/token"
+	"github.com/drejca/shift/wasm"
+	"github.com/perlin-network/life/compiler"
+	"github.com/perlin-network/life/exec"
+)
+
+// Exit is returned by Run when the program calls exit
+type Exit struct {
+	Code int
+}
+
+func (e *Exit) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// Error is a message passed to the error host function
+type Error struct {
+	Msg   string
+	Pos   token.Position // position of the error call, unknown without line table
+	Stack Stack          // call stack of the error call, empty without line table
+}
+
+func (e *Error) Error() string {
+	if e.Pos.Line == 0 {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// Host provides the functions Shift programs import from the env module
+//
+//	import fn print(msg string)
+//	import fn error(msg string)
+//	import fn exit(code i32)
+//
+// print writes a line to Stdout, error writes a line to Stderr and records it
+// in Errors without stopping the program and exit stops it with a status code.
+// With the LineTable of the module errors are positioned at their call and carry
+// the call stack, which is written to Stderr after the message.
+//
+// Modules compiled with step hooks call Step with the call stack before every
+// statement. Step runs on the program's goroutine, so the program waits while
+// it runs, and stops the program by panicking with an error.
+//
+// Test modules call the expect_eq functions of wasm.TestImportModule when the values
+// of a check differ, which report an error with the values appended to the message.
+//
+// Modules compiled with profile hooks report every call of a Shift function to
+// Profiler, which is told the gas used when the call starts and returns. The call
+// of Run starts and returns the outermost call.
+type Host struct {
+	Stdout    io.Writer
+	Stderr    io.Writer
+	LineTable *wasm.LineTable
+	Step      func(stack Stack)
+	Profiler  Profiler
+	Errors    []*Error
+	code      *codeMap // instructions of the last module a stack was symbolized for
+}
+
+// Profiler is told about the calls of a module compiled with profile hooks
+type Profiler interface {
+	// Enter is called when the function with index is called
+	Enter(function int, gas uint64)
+	// Leave is called when the last function entered returned
+	Leave(gas uint64)
+	// Unwind is called when a call of Run returned or stopped, which leaves every
+	// function it entered
+	Unwind(gas uint64)
+}
+
+// ResolveFunc resolves an imported host function
+func (h *Host) ResolveFunc(module string, field string) exec.FunctionImport {
+	if module == wasm.DebugImportModule && field == wasm.StepImport {
+		return func(vm *exec.VirtualMachine) int64 {
+			if h.Step != nil && h.LineTable != nil {
+				h.Step(h.stackTrace(vm))
+			}
+			return 0
+		}
+	}
+	if module == wasm.ProfileImportModule {
+		return h.resolveProfileHook(field)
+	}
+	if module == wasm.TestImportModule && strings.HasPrefix(field, wasm.ExpectEqBuiltin+".") {
+		return h.resolveExpectEq(strings.TrimPrefix(field, wasm.ExpectEqBuiltin+"."))
+	}
+	if module != "env" {
+		panic(fmt.Errorf("unknown import module %s", module))
+	}
+
+	switch field {
+	case "print":
+		return func(vm *exec.VirtualMachine) int64 {
+			fmt.Fprintln(h.Stdout, readString(vm, 0))
+			return 0
+		}
+	case "error":
+		return func(vm *exec.VirtualMachine) int64 {
+			h.reportError(vm, readString(vm, 0))
+			return 0
+		}
+	case "exit":
+		return func(vm *exec.VirtualMachine) int64 {
+			panic(&Exit{Code: int(int32(vm.GetCurrentFrame().Locals[0]))})
+		}
+	}
+	panic(fmt.Errorf("unknown import %s.%s", module, field))
+}
+
+// reportError records the message of an error call and writes it to Stderr
+func (h *Host) reportError(vm *exec.VirtualMachine, msg string) {
+	err := &Error{Msg: msg}
+	if h.LineTable != nil {
+		err.Stack = h.stackTrace(vm)
+		if len(err.Stack) > 0 {
+			err.Pos = err.Stack[0].Pos
+		}
+	}
+	h.Errors = append(h.Errors, err)
+	fmt.Fprintln(h.Stderr, err)
+	fmt.Fprint(h.Stderr, err.Stack)
+}
+
+// resolveExpectEq resolves the failure of expect_eq on values of typeName, which
+// reports its message followed by the values
+func (h *Host) resolveExpectEq(typeName string) exec.FunctionImport {
+	var format func(vm *exec.VirtualMachine, local int) string
+	switch typeName {
+	case "i32":
+		format = func(vm *exec.VirtualMachine, local int) string {
+			return fmt.Sprint(int32(vm.GetCurrentFrame().Locals[local]))
+		}
+	case "i64":
+		format = func(vm *exec.VirtualMachine, local int) string {
+			return fmt.Sprint(vm.GetCurrentFrame().Locals[local])
+		}
+	case "f32":
+		format = func(vm *exec.VirtualMachine, local int) string {
+			return fmt.Sprint(math.Float32frombits(uint32(vm.GetCurrentFrame().Locals[local])))
+		}
+	case "f64":
+		format = func(vm *exec.VirtualMachine, local int) string {
+			return fmt.Sprint(math.Float64frombits(uint64(vm.GetCurrentFrame().Locals[local])))
+		}
+	case "string":
+		return func(vm *exec.VirtualMachine) int64 {
+			h.reportError(vm, fmt.Sprintf("%s (%q != %q)", readString(vm, 0), readString(vm, 2), readString(vm, 4)))
+			return 0
+		}
+	default:
+		panic(fmt.Errorf("unknown import %s.%s.%s", wasm.TestImportModule, wasm.ExpectEqBuiltin, typeName))
+	}
+	return func(vm *exec.VirtualMachine) int64 {
+		h.reportError(vm, fmt.Sprintf("%s (%s != %s)", readString(vm, 0), format(vm, 2), format(vm, 3)))
+		return 0
+	}
+}
+
+// resolveProfileHook resolves the profile hook field, which does nothing without a Profiler
+func (h *Host) resolveProfileHook(field string) exec.FunctionImport {
+	switch field {
+	case wasm.EnterImport:
+		return func(vm *exec.VirtualMachine) int64 {
+			if h.Profiler != nil {
+				h.Profiler.Enter(int(vm.GetCurrentFrame().Locals[0]), vm.Gas)
+			}
+			return 0
+		}
+	case wasm.LeaveImport:
+		return func(vm *exec.VirtualMachine) int64 {
+			if h.Profiler != nil {
+				h.Profiler.Leave(vm.Gas)
+			}
+			return 0
+		}
+	}
+	panic(fmt.Errorf("unknown import %s.%s", wasm.ProfileImportModule, field))
+}
+
+// ResolveGlobal resolves an imported global which Shift programs never import
+func (h *Host) ResolveGlobal(module string, field string) int64 {
+	panic(fmt.Errorf("unknown global import %s.%s", module, field))
+}
+
+// readString reads the string passed as the parameters of a host function starting at local
+func readString(vm *exec.VirtualMachine, local int) string {
+	locals := vm.GetCurrentFrame().Locals
+	offset := uint32(locals[local])
+	length := uint32(locals[local+1])
+	if uint64(offset)+uint64(length) > uint64(len(vm.Memory)) {
+		panic(fmt.Errorf("string at %d with length %d is out of memory bounds", offset, length))
+	}
+	return string(vm.Memory[offset : offset+length])
+}
+
+// Instance is a module instantiated in the virtual machine
+type Instance struct {
+	VM   *exec.VirtualMachine
+	Host *Host
+}
+
+// InstructionGas charges a unit of gas for every instruction the virtual machine
+// executes and one more for every basic block entered
+var InstructionGas compiler.GasPolicy = &compiler.SimpleGasPolicy{GasPerInstruction: 1}
+
+// New instantiates the wasm module code with host providing its imports
+func New(code []byte, host *Host) (*Instance, error) {
+	return NewWithGas(code, host, nil)
+}
+
+// NewWithGas instantiates code like New and meters the gas used by its calls with
+// policy. Without a policy no gas is metered.
+func NewWithGas(code []byte, host *Host, policy compiler.GasPolicy) (*Instance, error) {
+	vm, err := exec.NewVirtualMachine(code, exec.VMConfig{}, host, policy)
+	if err != nil {
+		return nil, err
+	}
+	return &Instance{VM: vm, Host: host}, nil
+}
+
+// Gas returns the gas used by the calls since the instance was created
+func (i *Instance) Gas() uint64 {
+	return i.VM.Gas
+}
+
+// Signature returns the number of parameters and results of the exported function name
+func (i *Instance) Signature(name string) (params int, results int, err error) {
+	functionID, ok := i.VM.GetFunctionExport(name)
+	if !ok {
+		return 0, 0, fmt.Errorf("function %s is not exported", name)
+	}
+	code := i.VM.FunctionCode[functionID]
+	return code.NumParams, code.NumReturns, nil
+}
+
+// Exports returns the names of the exported functions in the order they are defined
+func (i *Instance) Exports() []string {
+	if i.VM.Module.Base.Export == nil {
+		return nil
+	}
+
+	entries := i.VM.Module.Base.Export.Entries
+	var names []string
+	for name := range entries {
+		if _, ok := i.VM.GetFunctionExport(name); ok {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(a, b int) bool {
+		return entries[names[a]].Index < entries[names[b]].Index
+	})
+	return names
+}
+
+// Run calls the exported function name. A trap or a call to exit stops the
+// program and is returned as error, the latter as *Exit. The call is reported
+// to the Profiler of the host, which needs a gas policy to count instructions.
+func (i *Instance) Run(name string, args ...int64) (int64, error) {
+	functionID, ok := i.VM.GetFunctionExport(name)
+	if !ok {
+		return 0, fmt.Errorf("function %s is not exported", name)
+	}
+
+	if params := i.VM.FunctionCode[functionID].NumParams; params != len(args) {
+		return 0, fmt.Errorf("function %s expects %d arguments but got %d", name, params, len(args))
+	}
+	if profiler := i.Host.Profiler; profiler != nil {
+		profiler.Enter(functionID, i.Gas())
+		defer func() { profiler.Unwind(i.Gas()) }()
+	}
+	return i.VM.Run(functionID, args...)
+}
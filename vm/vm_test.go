@@ -0,0 +1,323 @@
+package vm_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/drejca/shift/vm"
+	"github.com/drejca/shift/wasm"
+	"github.com/drejca/shift/wasm/wasmtest"
+)
+
+const program = `
+import fn print(msg string)
+import fn error(msg string)
+import fn exit(code i32)
+
+fn main(value i32) : i32 {
+	print("start")
+	if value == 1 {
+		error("one")
+	}
+	if value == 2 {
+		exit(7)
+	}
+	if value == 3 {
+		s := "ab"
+		return s[value]
+	}
+	print("end")
+	return value * 2
+}
+`
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		value  int64
+		result int64
+		err    string
+		stdout string
+		stderr string
+	}{
+		{value: 0, result: 0, stdout: "start\nend\n"},
+		{value: 1, result: 2, stdout: "start\nend\n", stderr: "one\n"},
+		{value: 2, err: "exit status 7", stdout: "start\n"},
+		{value: 3, err: "wasm: unreachable executed", stdout: "start\n"},
+	}
+
+	code, _ := wasmtest.Compile(t, "program.sf", program)
+
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		host := &vm.Host{Stdout: &stdout, Stderr: &stderr}
+
+		instance, err := vm.New(code, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := instance.Run("main", test.value)
+		if errorString(err) != test.err {
+			t.Errorf("main(%d) expected error %q but got %v", test.value, test.err, err)
+		}
+		if err == nil && result != test.result {
+			t.Errorf("main(%d) expected %d but got %d", test.value, test.result, result)
+		}
+		if stdout.String() != test.stdout {
+			t.Errorf("main(%d) expected stdout %q but got %q", test.value, test.stdout, stdout.String())
+		}
+		if stderr.String() != test.stderr {
+			t.Errorf("main(%d) expected stderr %q but got %q", test.value, test.stderr, stderr.String())
+		}
+	}
+}
+
+func TestRunExit(t *testing.T) {
+	code, _ := wasmtest.Compile(t, "program.sf", program)
+	instance, err := vm.New(code, &vm.Host{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = instance.Run("main", 2)
+	if exit, ok := err.(*vm.Exit); !ok || exit.Code != 7 {
+		t.Errorf("expected exit with code 7 but got %v", err)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	code, _ := wasmtest.Compile(t, "program.sf", program)
+	instance, err := vm.New(code, &vm.Host{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, results, err := instance.Signature("main")
+	if err != nil || params != 1 || results != 1 {
+		t.Errorf("expected main to take 1 parameter and return 1 result but got %d, %d, %v", params, results, err)
+	}
+
+	tests := []struct {
+		name string
+		args []int64
+		err  string
+	}{
+		{name: "main", err: "function main expects 1 arguments but got 0"},
+		{name: "start", err: "function start is not exported"},
+	}
+
+	for _, test := range tests {
+		_, err := instance.Run(test.name, test.args...)
+		if errorString(err) != test.err {
+			t.Errorf("expected error %q but got %v", test.err, err)
+		}
+	}
+}
+
+func TestGas(t *testing.T) {
+	code, _ := wasmtest.Compile(t, "program.sf", program)
+
+	instance, err := vm.NewWithGas(code, &vm.Host{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}, vm.InstructionGas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var used []uint64
+	for i := 0; i < 3; i++ {
+		gas := instance.Gas()
+		if _, err := instance.Run("main", 0); err != nil {
+			t.Fatal(err)
+		}
+		used = append(used, instance.Gas()-gas)
+	}
+	if used[0] == 0 || used[1] != used[0] || used[2] != used[0] {
+		t.Errorf("expected every call to use the same nonzero gas but got %v", used)
+	}
+
+	unmetered, err := vm.New(code, &vm.Host{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unmetered.Run("main", 0); err != nil {
+		t.Fatal(err)
+	}
+	if unmetered.Gas() != 0 {
+		t.Errorf("expected no gas to be metered without a policy but got %d", unmetered.Gas())
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	input := `import fn print(msg string)
+import fn error(msg string)
+
+fn TestFirst() {
+	print("first")
+	error("one")
+}
+
+fn TestSecond() {
+	error("two")
+}
+
+fn helper() {}
+`
+	code, compiler := wasmtest.Compile(t, "errors.sf", input, (*wasm.Compiler).TrackPositions)
+
+	tests := []struct {
+		name   string
+		stderr string
+	}{
+		{name: "TestFirst", stderr: "errors.sf:6:2: one\nTestFirst\n\terrors.sf:6:2\n"},
+		{name: "TestSecond", stderr: "errors.sf:10:2: two\nTestSecond\n\terrors.sf:10:2\n"},
+	}
+
+	for _, test := range tests {
+		var stderr bytes.Buffer
+		host := &vm.Host{Stdout: &bytes.Buffer{}, Stderr: &stderr, LineTable: compiler.LineTable()}
+
+		instance, err := vm.New(code, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exports := fmt.Sprint(instance.Exports()); exports != "[TestFirst TestSecond]" {
+			t.Errorf("expected exports [TestFirst TestSecond] but got %s", exports)
+		}
+
+		if _, err := instance.Run(test.name); err != nil {
+			t.Fatal(err)
+		}
+		if stderr.String() != test.stderr {
+			t.Errorf("%s expected stderr %q but got %q", test.name, test.stderr, stderr.String())
+		}
+		if len(host.Errors) != 1 {
+			t.Errorf("%s expected 1 error but got %d", test.name, len(host.Errors))
+		}
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	input := `import fn error(msg string)
+
+fn divide(a i32, b i32) : i32 {
+	return a / b
+}
+
+fn check(v i32) {
+	if v == 0 {
+		error("zero")
+	}
+}
+
+fn main(v i32) : i32 {
+	check(v)
+	return divide(10, v)
+}
+`
+	code, compiler := wasmtest.Compile(t, "calc.sf", input, (*wasm.Compiler).TrackPositions)
+
+	// tracking positions adds no code
+	if plain, _ := wasmtest.Compile(t, "calc.sf", input); !bytes.Equal(code, plain) {
+		t.Errorf("expected the same module with and without tracking positions")
+	}
+
+	// gas counters change the code life interprets but not the positions
+	metered := func(code []byte, host *vm.Host) (*vm.Instance, error) {
+		return vm.NewWithGas(code, host, vm.InstructionGas)
+	}
+	for _, newInstance := range []func([]byte, *vm.Host) (*vm.Instance, error){vm.New, metered} {
+		var stderr bytes.Buffer
+		host := &vm.Host{Stdout: &bytes.Buffer{}, Stderr: &stderr, LineTable: compiler.LineTable()}
+		instance, err := newInstance(code, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := instance.Run("main", 0); errorString(err) != "integer division by zero" {
+			t.Fatalf("expected integer division by zero but got %v", err)
+		}
+
+		expected := "calc.sf:9:3: zero\ncheck\n\tcalc.sf:9:3\nmain\n\tcalc.sf:14:2\n"
+		if stderr.String() != expected {
+			t.Errorf("expected stderr %q but got %q", expected, stderr.String())
+		}
+
+		expected = "divide\n\tcalc.sf:4:11\nmain\n\tcalc.sf:15:9\n"
+		if stack := instance.StackTrace().String(); stack != expected {
+			t.Errorf("expected stack trace %q but got %q", expected, stack)
+		}
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func TestExpectEq(t *testing.T) {
+	input := `fn Double(a i32) : i32 {
+	return a * 2
+}
+
+test "i32" {
+	expect_eq(Double(2), 5)
+}
+
+test "i64" {
+	a := 3i64
+	expect_eq(a, 4i64)
+}
+
+test "f32" {
+	x := 1.5f32
+	expect_eq(x, 2.5f32)
+}
+
+test "f64" {
+	expect_eq(0.25, 0.5)
+}
+
+test "string" {
+	expect_eq("a" + "b", "ba")
+}
+
+test "equal" {
+	expect_eq(Double(2), 4)
+}
+`
+	code, _ := wasmtest.Compile(t, "double.sf", input, (*wasm.Compiler).IncludeTests)
+
+	tests := []struct {
+		name string
+		msg  string
+	}{
+		{name: "i32", msg: "expect_eq failed: Double(2) != 5 (4 != 5)"},
+		{name: "i64", msg: "expect_eq failed: a != 4i64 (3 != 4)"},
+		{name: "f32", msg: "expect_eq failed: x != 2.5f32 (1.5 != 2.5)"},
+		{name: "f64", msg: "expect_eq failed: 0.25 != 0.5 (0.25 != 0.5)"},
+		{name: "string", msg: `expect_eq failed: ("a" + "b") != "ba" ("ab" != "ba")`},
+		{name: "equal"},
+	}
+
+	for _, test := range tests {
+		host := &vm.Host{Stdout: &bytes.Buffer{}, Stderr: &bytes.Buffer{}}
+		instance, err := vm.New(code, host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := instance.Run(wasm.TestExportPrefix + test.name); err != nil {
+			t.Fatal(err)
+		}
+
+		var msgs []string
+		for _, err := range host.Errors {
+			msgs = append(msgs, err.Msg)
+		}
+		if test.msg == "" && len(msgs) != 0 || test.msg != "" && fmt.Sprint(msgs) != fmt.Sprint([]string{test.msg}) {
+			t.Errorf("test %s expected error %q but got %q", test.name, test.msg, msgs)
+		}
+	}
+}
@@ -3,10 +3,65 @@ package wasm
 import (
 	"fmt"
 	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/drejca/shift/ast"
 )
 
+// Function attributes understood by the compiler. Calls of an @inline function are
+// expanded at the call site, but its body is still compiled and emitted like any
+// other function, so it is checked when it is never called and can be exported.
+const (
+	ExportAttribute   = "export"
+	NoExportAttribute = "noexport"
+	InlineAttribute   = "inline"
+	StartAttribute    = "start"
+)
+
+// ErrConstructor is the built-in returning its argument as the error of a T!E result
+const ErrConstructor = "Err"
+
+// LenBuiltin is the built-in returning the length of a string in bytes
+const LenBuiltin = "len"
+
+// functionDecl is a function declaration together with the package and file it was declared in
+type functionDecl struct {
+	function *ast.Function
+	pkgPath  string
+	file     *ast.Program
+}
+
+// resultBinding is a local bound to a result which has to be used before the function ends
+type resultBinding struct {
+	symbol Symbol
+	exp    *ast.InitAssignExpression
+	used   bool
+}
+
+// functionExit holds the deferred calls of a function body lowered into an exit block
+type functionExit struct {
+	result   *Symbol
+	deferred []deferredCall
+}
+
+// deferredCall is a compiled defer expression guarded by a flag set when the defer statement runs
+type deferredCall struct {
+	flag Symbol
+	ops  []Operation
+}
+
+// A switch is lowered to a br_table when it has at least minBranchTableCases case
+// values spanning no more than maxBranchTableSpread table entries per value
+const (
+	minBranchTableCases  = 3
+	maxBranchTableSpread = 2
+)
+
+// DefaultImportModule is the host module of imported functions declared without a module name
+const DefaultImportModule = "env"
+
 type Compiler struct {
 	module        *Module
 	symbolTable   *SymbolTable
@@ -16,6 +71,47 @@ type Compiler struct {
 	dataIndex     uint32
 	dataOffset    int32
 
+	packages    map[string]*ast.Package
+	pkgPath     string
+	imports     map[string]string
+	fileImports map[*ast.Program]map[string]string
+	functions   map[string]*functionDecl
+	inlining    map[*functionDecl]bool
+
+	runtime       map[string]*FuncType
+	runtimeFuncs  []*FuncType
+	runtimeBodies map[string]*FunctionBody
+
+	function   *FuncType
+	exit       *functionExit
+	tailReturn *ast.ReturnStatement
+	blockDepth uint32
+	results    []*resultBinding
+
+	coverage     *Coverage
+	counters     map[ast.Statement]int
+	counterGets  []*GetGlobal
+	counterSets  []*SetGlobal
+	skipCoverage bool
+
+	lineTable      *LineTable
+	scopeVariables []*Variable
+	stepHooks      bool
+	stepHook       *FuncType
+
+	profileHooks bool
+	enterHook    *FuncType
+	leaveHook    *FuncType
+
+	stripNames bool
+
+	tests         bool
+	testError     *FuncType
+	expectEq      map[string]*FuncType // failure of expect_eq by the type of its values
+	testFunctions map[*ast.TestBlock]*ast.Function
+
+	mainResult string // declared result of main in the root package, empty when it has none
+
 	errors []error
 }
 
@@ -26,43 +122,138 @@ func NewCompiler() *Compiler {
 }
 
 func (c *Compiler) CompileProgram(program *ast.Program) *Module {
+	pkg := &ast.Package{Name: program.PackageName(), Files: []*ast.Program{program}}
+	return c.CompilePackages([]*ast.Package{pkg})
+}
+
+// CompilePackages compiles packages ordered by their dependencies into one module.
+// The last package is the root package and only its functions are exported.
+func (c *Compiler) CompilePackages(packages []*ast.Package) *Module {
 	c.module = &Module{
 		typeSection:     &TypeSection{},
 		importSection:   &ImportSection{},
 		functionSection: &FunctionSection{},
 		memorySection:   &MemorySection{},
+		globalSection:   &GlobalSection{},
 		exportSection:   &ExportSection{},
 		codeSection:     &CodeSection{},
 		dataSection:     &DataSection{},
 	}
 
-	for _, stmt := range program.Statements {
-		switch stmt := stmt.(type) {
-		case *ast.Function:
-			funcType := c.compileFunctionSignature(stmt.Signature)
-
-			c.appendFunction(funcType)
-
-			if (funcType.name[0] >= 'A' && funcType.name[0] <= 'Z') || funcType.name == "main" {
-				funcType.exported = true
-				c.appendExportEntry(funcType)
+	c.packages = make(map[string]*ast.Package)
+	c.fileImports = make(map[*ast.Program]map[string]string)
+	c.functions = make(map[string]*functionDecl)
+	c.inlining = make(map[*functionDecl]bool)
+	c.runtime = make(map[string]*FuncType)
+	c.runtimeBodies = make(map[string]*FunctionBody)
+	c.testFunctions = make(map[*ast.TestBlock]*ast.Function)
+	for _, pkg := range packages {
+		c.packages[pkg.Path] = pkg
+	}
+	root := packages[len(packages)-1]
+
+	// imported functions come first in the function index space
+	for _, pkg := range packages {
+		c.pkgPath = pkg.Path
+
+		for _, file := range pkg.Files {
+			for _, stmt := range file.Statements {
+				switch stmt := stmt.(type) {
+				case *ast.ImportStatement:
+					c.compileImport(stmt)
+				case *ast.ImportBlockStatement:
+					for _, imp := range stmt.Imports {
+						c.compileImport(imp)
+					}
+				}
 			}
-		case *ast.ImportStatement:
-			funcType := c.compileFunctionSignature(stmt.FuncSignature)
+		}
+	}
+	if c.tests {
+		c.importTestFunctions()
+	}
+	if c.stepHooks {
+		c.importStepHook()
+	}
+	if c.profileHooks {
+		c.importProfileHooks()
+	}
 
-			c.appendImport(funcType)
+	for _, pkg := range packages {
+		c.pkgPath = pkg.Path
+
+		for _, file := range pkg.Files {
+			for _, stmt := range file.Statements {
+				switch stmt := stmt.(type) {
+				case *ast.TestBlock:
+					if c.tests && pkg == root {
+						c.declareTest(stmt, file)
+					}
+				case *ast.Function:
+					if _, found := c.getFunctionType(c.qualify(stmt.Signature.Name)); found {
+						c.handleError(fmt.Errorf("%s redeclared in package %s", stmt.Signature.Name, pkg.Name))
+						continue
+					}
+					c.checkAttributes(stmt)
+
+					funcType := c.compileFunctionSignature(stmt.Signature)
+					if pkg == root && stmt.Signature.Name == "main" {
+						c.checkMainSignature(stmt.Signature)
+					}
+
+					c.appendFunction(funcType)
+					c.functions[funcType.name] = &functionDecl{function: stmt, pkgPath: pkg.Path, file: file}
+
+					if exportName, exported := c.exportName(stmt, pkg == root); exported {
+						funcType.exported = true
+						funcType.exportName = exportName
+						c.appendExportEntry(funcType)
+					}
+					if stmt.Attribute(StartAttribute) != nil {
+						c.setStartFunction(funcType)
+					}
+				}
+			}
 		}
 	}
 
-	for _, stmt := range program.Statements {
-		function, ok := stmt.(*ast.Function)
-		if ok {
-			funcBody := c.compileFunctionBody(function)
-			c.appendCodeSection(funcBody)
+	for _, pkg := range packages {
+		c.pkgPath = pkg.Path
+
+		for _, file := range pkg.Files {
+			c.resolveImports(file)
+
+			for _, stmt := range file.Statements {
+				switch stmt := stmt.(type) {
+				case *ast.Function:
+					// test code does not count towards coverage
+					c.skipCoverage = c.isTestFunction(stmt, pkg == root)
+					if !c.skipCoverage {
+						c.coverFunction(stmt)
+					}
+					funcBody := c.compileFunctionBody(stmt)
+					c.appendCodeSection(funcBody)
+					c.skipCoverage = false
+				case *ast.TestBlock:
+					if function, found := c.testFunctions[stmt]; found {
+						// test code does not count towards coverage
+						c.skipCoverage = true
+						funcBody := c.compileFunctionBody(function)
+						c.appendCodeSection(funcBody)
+						c.skipCoverage = false
+					}
+				}
+			}
 		}
 	}
 
-	if c.module.dataSection.count > 0 {
+	c.appendRuntimeFunctions()
+	c.appendCoverageGlobals()
+	c.nameFunctions()
+	c.module.lineTable = c.lineTable
+	c.appendNameSection(root.Name)
+
+	if c.module.dataSection.count > 0 || len(c.runtimeFuncs) > 0 {
 		c.module.memorySection.count = 1
 		memoryType := MemoryType{
 			flags:         uint32(0),
@@ -74,9 +265,159 @@ func (c *Compiler) CompileProgram(program *ast.Program) *Module {
 	return c.module
 }
 
+func (c *Compiler) compileImport(importStatement *ast.ImportStatement) {
+	funcType := c.compileFunctionSignature(importStatement.FuncSignature)
+
+	moduleName := importStatement.Module
+	if moduleName == "" {
+		moduleName = DefaultImportModule
+	}
+	fieldName := importStatement.Field
+	if fieldName == "" {
+		fieldName = importStatement.FuncSignature.Name
+	}
+	c.appendImport(moduleName, fieldName, funcType)
+}
+
+// checkAttributes reports unknown attributes and attributes with invalid arguments
+func (c *Compiler) checkAttributes(function *ast.Function) {
+	name := function.Signature.Name
+
+	for _, attr := range function.Attributes {
+		switch attr.Name {
+		case ExportAttribute:
+			if len(attr.Arguments) > 1 {
+				c.handleError(fmt.Errorf("fn %s: @export takes at most one export name", name))
+			}
+			for _, arg := range attr.Arguments {
+				if _, ok := arg.(*ast.String); !ok {
+					c.handleError(fmt.Errorf("fn %s: @export name must be a string", name))
+				}
+			}
+		case NoExportAttribute, InlineAttribute, StartAttribute:
+			if len(attr.Arguments) > 0 {
+				c.handleError(fmt.Errorf("fn %s: @%s takes no arguments", name, attr.Name))
+			}
+		default:
+			c.handleError(fmt.Errorf("fn %s: unknown attribute @%s", name, attr.Name))
+		}
+	}
+
+	if function.Attribute(ExportAttribute) != nil && function.Attribute(NoExportAttribute) != nil {
+		c.handleError(fmt.Errorf("fn %s: @export and @noexport are mutually exclusive", name))
+	}
+}
+
+// exportName applies the default export rule unless the function has an @export or @noexport attribute
+func (c *Compiler) exportName(function *ast.Function, isRoot bool) (name string, exported bool) {
+	name = function.Signature.Name
+
+	if function.Attribute(NoExportAttribute) != nil {
+		return name, false
+	}
+	if attr := function.Attribute(ExportAttribute); attr != nil {
+		if len(attr.Arguments) == 1 {
+			if str, ok := attr.Arguments[0].(*ast.String); ok {
+				return str.Value, true
+			}
+		}
+		return name, true
+	}
+	return name, isRoot && (isExported(name) || name == "main")
+}
+
+// checkMainSignature records the result of main, which becomes the exit status of a program
+// and so can only be i32 or i32!i32
+func (c *Compiler) checkMainSignature(signature *ast.FunctionSignature) {
+	for _, param := range signature.ReturnParams {
+		c.mainResult = param.String()
+		if c.mainResult != "i32" && c.mainResult != "i32!i32" {
+			c.handleError(fmt.Errorf("fn main(...) : %s main can only return i32 or i32!i32", c.mainResult))
+		}
+	}
+}
+
+// MainResult returns the declared result type of main, empty when it returns nothing
+func (c *Compiler) MainResult() string {
+	return c.mainResult
+}
+
+func (c *Compiler) setStartFunction(funcType *FuncType) {
+	if c.module.startSection != nil {
+		c.handleError(fmt.Errorf("fn %s: @start already declared on %s", funcType.name, c.module.startSection.name))
+		return
+	}
+	if funcType.paramCount > 0 || funcType.resultCount > 0 {
+		c.handleError(fmt.Errorf("fn %s: @start function must not have parameters or results", funcType.name))
+		return
+	}
+	c.module.startSection = &StartSection{name: funcType.name, functionIndex: funcType.functionIndex}
+}
+
+// resolveImports maps package names used as qualifiers in file to import paths
+func (c *Compiler) resolveImports(file *ast.Program) {
+	if imports, found := c.fileImports[file]; found {
+		c.imports = imports
+		return
+	}
+	c.imports = make(map[string]string)
+	c.fileImports[file] = c.imports
+
+	for _, path := range file.Imports() {
+		pkg, found := c.packages[path]
+		if !found {
+			c.handleError(fmt.Errorf("%s: package %q not loaded", file.Filename, path))
+			continue
+		}
+		if _, found := c.imports[pkg.Name]; found {
+			c.handleError(fmt.Errorf("%s: %s redeclared as imported package name", file.Filename, pkg.Name))
+			continue
+		}
+		c.imports[pkg.Name] = path
+	}
+}
+
+// qualify returns the module wide name of a function declared in the current package
+func (c *Compiler) qualify(name string) string {
+	if c.pkgPath == "" {
+		return name
+	}
+	return c.pkgPath + "." + name
+}
+
+// resolveFunction finds the called function by its local name or package qualified name
+func (c *Compiler) resolveFunction(function ast.Expression) (funcType *FuncType, err error) {
+	switch node := function.(type) {
+	case *ast.SelectorExpression:
+		pkgPath, found := c.imports[node.X.String()]
+		if !found {
+			return nil, fmt.Errorf("undefined: %s", node.X.String())
+		}
+		if !isExported(node.Sel.Value) {
+			return nil, fmt.Errorf("cannot refer to unexported name %s", node.String())
+		}
+		funcType, found := c.getFunctionType(pkgPath + "." + node.Sel.Value)
+		if !found {
+			return nil, fmt.Errorf("undefined: %s", node.String())
+		}
+		return funcType, nil
+	}
+
+	funcType, found := c.getFunctionType(c.qualify(function.String()))
+	if !found {
+		return nil, fmt.Errorf("function type for %s not found", function.String())
+	}
+	return funcType, nil
+}
+
+func isExported(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(r)
+}
+
 func (c *Compiler) compileFunctionSignature(functionSignature *ast.FunctionSignature) *FuncType {
 	funcType := &FuncType{
-		name: functionSignature.Name,
+		name: c.qualify(functionSignature.Name),
 	}
 
 	for _, param := range functionSignature.InputParams {
@@ -93,7 +434,18 @@ func (c *Compiler) compileFunctionSignature(functionSignature *ast.FunctionSigna
 	}
 
 	for _, param := range functionSignature.ReturnParams {
+		if param.Type == "string" {
+			c.handleError(fmt.Errorf("fn %s(...) : string results are not implemented", functionSignature.Name))
+		}
 		resultType := &ResultType{typeName: param.Type}
+		if param.ErrorType != "" {
+			if param.Type != "i32" || param.ErrorType != "i32" {
+				c.handleError(fmt.Errorf("fn %s(...) : %s result types other than i32!i32 are not implemented", functionSignature.Name, param.String()))
+			}
+			funcType.okType = param.Type
+			funcType.errorType = param.ErrorType
+			resultType = &ResultType{typeName: wasmType(param.String())}
+		}
 		funcType.resultType = resultType
 		funcType.resultCount = 1
 	}
@@ -113,8 +465,8 @@ func (c *Compiler) compileFunctionSignature(functionSignature *ast.FunctionSigna
 func (c *Compiler) compileFuncInputParam(param *ast.Parameter) []*ValueType {
 	switch param.Type {
 	case "string":
-		offset := &ValueType{name: "offset", typeName: "i32"}
-		strLength := &ValueType{name: "length", typeName: "i32"}
+		offset := &ValueType{name: param.Ident.Value, typeName: "i32"}
+		strLength := &ValueType{name: param.Ident.Value + ".len", typeName: "i32"}
 		return []*ValueType{offset, strLength}
 	default:
 		valueType := &ValueType{name: param.Ident.Value, typeName: param.Type}
@@ -163,64 +515,425 @@ func (c *Compiler) matchResult(resultTypeA *ResultType, resultTypeB *ResultType)
 func (c *Compiler) compileFunctionBody(function *ast.Function) *FunctionBody {
 	c.functionBody = &FunctionBody{}
 
-	funcType, found := c.getFunctionType(function.Signature.Name)
+	funcType, found := c.getFunctionType(c.qualify(function.Signature.Name))
 	if !found {
 		c.errors = append(c.errors, fmt.Errorf("function type for %s not found", function.Signature.Name))
 		return nil
 	}
 
 	c.functionBody.funcName = funcType.name
+	c.function = funcType
 
 	c.enterScope()
+	scope := len(c.scopeVariables)
 
 	for _, param := range function.Signature.InputParams {
-		c.symbolTable.Define(param.Ident.Value, param.Type)
+		c.declareVariable(c.symbolTable.Define(param.Ident.Value, param.Type))
+	}
+
+	c.results = nil
+	c.exit = nil
+	if hasDefer(function.Body.Statements) {
+		c.exit = &functionExit{}
+		if funcType.resultType != nil {
+			result := c.symbolTable.Define("defer.result", funcType.resultType.typeName)
+			c.appendLocal(result)
+			c.exit.result = &result
+		}
 	}
+	c.tailReturn = tailReturn(function.Body)
 
 	operations := c.compileBody(function.Body)
+
+	if c.exit != nil {
+		operations = []Operation{&Block{ops: operations}}
+		operations = append(operations, c.compileDeferredCalls()...)
+
+		if c.exit.result != nil {
+			operations = append(operations, &GetLocal{name: c.exit.result.Name, localIndex: c.exit.result.Index})
+		}
+	}
 	c.functionBody.code = append(c.functionBody.code, operations...)
 
+	for _, binding := range c.results {
+		if !binding.used {
+			c.handleError(fmt.Errorf("result %s is not used", binding.exp.String()))
+		}
+	}
+
+	c.closeScope(scope)
 	c.leaveScope()
 	return c.functionBody
 }
 
+// compileDeferredCalls runs the deferred calls whose defer statement was reached in LIFO order
+func (c *Compiler) compileDeferredCalls() []Operation {
+	var operations []Operation
+
+	for i := len(c.exit.deferred) - 1; i >= 0; i-- {
+		deferred := c.exit.deferred[i]
+
+		ifOp := &If{
+			conditionOps: []Operation{&GetLocal{name: deferred.flag.Name, localIndex: deferred.flag.Index}},
+			thenOps:      deferred.ops,
+		}
+		operations = append(operations, ifOp)
+	}
+	return operations
+}
+
+func (c *Compiler) compileDeferStatement(deferStatement *ast.DeferStatement) []Operation {
+	if len(c.inlining) > 0 {
+		c.handleError(fmt.Errorf("defer is not allowed in @inline functions"))
+		return nil
+	}
+
+	callExpression, ok := deferStatement.Expression.(*ast.CallExpression)
+	if !ok {
+		c.handleError(fmt.Errorf("expression in defer must be function call"))
+		return nil
+	}
+
+	if c.exit == nil {
+		c.handleError(fmt.Errorf("defer %s: function has no exit block", callExpression.String()))
+		return nil
+	}
+	c.checkResultUsed(callExpression)
+
+	operations, call := c.evaluateDeferredArguments(callExpression)
+	ops := c.compileCallExpression(call)
+	if funcType, err := c.resolveFunction(callExpression.Function); err == nil && funcType.resultCount > 0 {
+		ops = append(ops, &Drop{})
+	}
+
+	flag := c.symbolTable.Define(fmt.Sprintf("defer.%d", len(c.exit.deferred)), "i32")
+	c.appendLocal(flag)
+	c.exit.deferred = append(c.exit.deferred, deferredCall{flag: flag, ops: ops})
+
+	return append(operations,
+		&ConstInt{value: 1, typeName: "i32"},
+		&SetLocal{name: flag.Name, localIndex: flag.Index},
+	)
+}
+
+// evaluateDeferredArguments stores the arguments of a deferred call in hidden locals when
+// the defer statement runs, like Go does, so assignments after it do not change them. It
+// returns the call with the arguments replaced by the locals. Built-ins keep their arguments.
+func (c *Compiler) evaluateDeferredArguments(callExpression *ast.CallExpression) ([]Operation, *ast.CallExpression) {
+	for _, builtin := range []string{LenBuiltin, AssertBuiltin, ExpectEqBuiltin} {
+		if c.isBuiltin(callExpression, builtin) {
+			return nil, callExpression
+		}
+	}
+
+	var operations []Operation
+	call := &ast.CallExpression{Token: callExpression.Token, Function: callExpression.Function}
+	call.Extent = callExpression.Extent
+
+	for i, arg := range callExpression.Arguments {
+		argument := c.symbolTable.Define(fmt.Sprintf("defer.%d.%d", len(c.exit.deferred), i), c.inferType(arg))
+		c.appendLocal(argument)
+		operations = append(operations, c.compileExpression(arg)...)
+		operations = append(operations, storeLocal(argument)...)
+
+		ident := &ast.Identifier{Value: argument.Name}
+		ident.Extent = arg.Span()
+		call.Arguments = append(call.Arguments, ident)
+	}
+	return operations, call
+}
+
+func (c *Compiler) compileReturnStatement(returnStatement *ast.ReturnStatement) []Operation {
+	var operations []Operation
+
+	if returnStatement.ReturnValue != nil {
+		operations = append(operations, c.compileReturnValue(returnStatement.ReturnValue)...)
+	}
+
+	if len(c.inlining) > 0 {
+		if returnStatement != c.tailReturn {
+			c.handleError(fmt.Errorf("@inline function can only return at the end of its body"))
+		}
+		return operations
+	}
+	return c.compileReturn(operations, returnStatement == c.tailReturn)
+}
+
+// compileReturn leaves the function with the value computed by operations. Functions
+// with deferred calls branch to their exit block instead of returning directly.
+func (c *Compiler) compileReturn(operations []Operation, tail bool) []Operation {
+	if c.exit != nil {
+		if c.exit.result != nil {
+			operations = append(operations, &SetLocal{name: c.exit.result.Name, localIndex: c.exit.result.Index})
+		}
+		return append(operations, &Br{depth: c.blockDepth})
+	}
+
+	if !tail {
+		operations = append(operations, &Return{})
+	}
+	return operations
+}
+
+// compileReturnValue wraps the returned value into a result when the function returns T!E.
+// Err(e) returns an error, results of the same type are returned as they are.
+func (c *Compiler) compileReturnValue(value ast.Expression) []Operation {
+	if c.function.errorType == "" || len(c.inlining) > 0 {
+		return c.compileExpression(value)
+	}
+
+	if call, ok := value.(*ast.CallExpression); ok && call.Function.String() == ErrConstructor {
+		if len(call.Arguments) != 1 {
+			c.handleError(fmt.Errorf("%s expects exactly one argument", ErrConstructor))
+			return nil
+		}
+		operations := c.compileExpression(call.Arguments[0])
+		return append(operations,
+			&ExtendUnsigned{},
+			&ConstInt{value: 1, typeName: "i64"},
+			&ConstInt{value: 32, typeName: "i64"},
+			&ShiftLeft{typeName: "i64"},
+			&Or{typeName: "i64"},
+		)
+	}
+
+	operations := c.compileResult(value)
+
+	if okType, errorType, isResult := splitResultType(c.inferType(value)); isResult {
+		if okType != c.function.okType || errorType != c.function.errorType {
+			c.handleError(fmt.Errorf("cannot return %s!%s from fn %s with result %s!%s", okType, errorType, c.function.name, c.function.okType, c.function.errorType))
+		}
+		return operations
+	}
+	return append(operations, &ExtendUnsigned{})
+}
+
+// compileTryExpression unwraps the value of a result or returns early with its error
+func (c *Compiler) compileTryExpression(tryExpression *ast.TryExpression) []Operation {
+	if c.function.errorType == "" {
+		c.handleError(fmt.Errorf("? used in fn %s which does not return a result", c.function.name))
+		return nil
+	}
+	if len(c.inlining) > 0 {
+		c.handleError(fmt.Errorf("? is not allowed in @inline functions"))
+		return nil
+	}
+
+	resultType := c.inferType(tryExpression.Expression)
+	_, errorType, isResult := splitResultType(resultType)
+	if !isResult {
+		c.handleError(fmt.Errorf("? applied to %s which is not a result", tryExpression.Expression.String()))
+		return nil
+	}
+	if errorType != c.function.errorType {
+		c.handleError(fmt.Errorf("cannot propagate error %s from fn %s with error %s", errorType, c.function.name, c.function.errorType))
+		return nil
+	}
+
+	result := c.symbolTable.Define(fmt.Sprintf("try.%d", c.functionBody.localCount), resultType)
+	c.appendLocal(result)
+
+	operations := c.compileResult(tryExpression.Expression)
+	operations = append(operations, &SetLocal{name: result.Name, localIndex: result.Index})
+
+	c.blockDepth++
+	propagate := c.compileReturn([]Operation{&GetLocal{name: result.Name, localIndex: result.Index}}, false)
+	c.blockDepth--
+
+	ifError := &If{
+		conditionOps: []Operation{
+			&GetLocal{name: result.Name, localIndex: result.Index},
+			&ConstInt{value: 32, typeName: "i64"},
+			&ShiftRightUnsigned{typeName: "i64"},
+			&Wrap{},
+		},
+		thenOps: propagate,
+	}
+	return append(operations, ifError, &GetLocal{name: result.Name, localIndex: result.Index}, &Wrap{})
+}
+
+// checkResultUsed reports calls whose result is discarded
+func (c *Compiler) checkResultUsed(expression ast.Expression) {
+	if _, _, isResult := splitResultType(c.inferType(expression)); isResult {
+		c.handleError(fmt.Errorf("result of %s is not used", expression.String()))
+	}
+}
+
+// checkResultUnwrapped reports results used as plain values. A result can only be
+// unwrapped with ?, returned or bound to a variable.
+func (c *Compiler) checkResultUnwrapped(expression ast.Expression) {
+	if _, _, isResult := splitResultType(c.inferType(expression)); isResult {
+		c.handleError(fmt.Errorf("result of %s must be unwrapped with ? or returned", expression.String()))
+	}
+}
+
+// compileResult compiles an expression where a result does not need to be unwrapped
+func (c *Compiler) compileResult(expression ast.Expression) []Operation {
+	switch node := expression.(type) {
+	case *ast.CallExpression:
+		return c.compileCallExpression(node)
+	case *ast.Identifier:
+		return c.compileIdentifier(node)
+	}
+	return c.compileExpression(expression)
+}
+
+// hasDefer reports whether a defer statement is nested anywhere in statements,
+// including the blocks of if expressions used as values
+func hasDefer(statements []ast.Statement) bool {
+	for _, stmt := range statements {
+		switch node := stmt.(type) {
+		case *ast.DeferStatement:
+			return true
+		case *ast.BlockStatement:
+			if hasDefer(node.Statements) {
+				return true
+			}
+		case *ast.ExpressionStatement:
+			if expressionHasDefer(node.Expression) {
+				return true
+			}
+		case *ast.ReturnStatement:
+			if expressionHasDefer(node.ReturnValue) {
+				return true
+			}
+		case *ast.SwitchStatement:
+			if expressionHasDefer(node.Value) {
+				return true
+			}
+			for _, clause := range node.Cases {
+				for _, value := range clause.Values {
+					if expressionHasDefer(value) {
+						return true
+					}
+				}
+				if hasDefer(clause.Statements) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// expressionHasDefer reports whether a defer statement is nested in an if expression within expression
+func expressionHasDefer(expression ast.Expression) bool {
+	switch node := expression.(type) {
+	case *ast.IfExpression:
+		if expressionHasDefer(node.Condition) || hasDefer(node.Body.Statements) {
+			return true
+		}
+		switch alternative := node.Alternative.(type) {
+		case *ast.BlockStatement:
+			return hasDefer(alternative.Statements)
+		case *ast.IfExpression:
+			return expressionHasDefer(alternative)
+		}
+	case *ast.InitAssignExpression:
+		return expressionHasDefer(node.Value)
+	case *ast.AssignmentExpression:
+		return expressionHasDefer(node.Expression)
+	case *ast.InfixExpression:
+		return expressionHasDefer(node.Left) || expressionHasDefer(node.Right)
+	case *ast.CallExpression:
+		for _, arg := range node.Arguments {
+			if expressionHasDefer(arg) {
+				return true
+			}
+		}
+	case *ast.TryExpression:
+		return expressionHasDefer(node.Expression)
+	case *ast.IndexExpression:
+		return expressionHasDefer(node.Left) || expressionHasDefer(node.Index)
+	case *ast.SliceExpression:
+		return expressionHasDefer(node.Left) || expressionHasDefer(node.Low) || expressionHasDefer(node.High)
+	}
+	return false
+}
+
+func tailReturn(body *ast.BlockStatement) *ast.ReturnStatement {
+	if len(body.Statements) == 0 {
+		return nil
+	}
+	returnStatement, _ := body.Statements[len(body.Statements)-1].(*ast.ReturnStatement)
+	return returnStatement
+}
+
 func (c *Compiler) compileBody(body *ast.BlockStatement) []Operation {
+	return c.compileStatements(body.Statements)
+}
+
+func (c *Compiler) compileStatements(statements []ast.Statement) []Operation {
 	var operations []Operation
 
-	for _, stmt := range body.Statements {
+	for _, stmt := range statements {
+		operations = append(operations, c.instrumentStatement(stmt)...)
 		ops := c.compileExpression(stmt)
 		operations = append(operations, ops...)
 	}
 	return operations
 }
 
+// instrumentStatement returns the operations run before every statement for the line
+// table, the debugger and coverage
+func (c *Compiler) instrumentStatement(stmt ast.Statement) []Operation {
+	var operations []Operation
+	operations = append(operations, c.markPosition(stmt.Span().Start)...)
+	operations = append(operations, c.callStepHook()...)
+	return append(operations, c.countStatement(stmt)...)
+}
+
 func (c *Compiler) compileExpression(node ast.Node) []Operation {
 	switch node := node.(type) {
 	case *ast.InfixExpression:
 		return c.compileInfixExpression(node)
 	case *ast.ReturnStatement:
-		return c.compileExpression(node.ReturnValue)
+		return c.compileReturnStatement(node)
+	case *ast.DeferStatement:
+		return c.compileDeferStatement(node)
 	case *ast.InitAssignExpression:
 		return c.compileInitAssignExpression(node)
 	case *ast.ExpressionStatement:
+		switch expression := node.Expression.(type) {
+		case *ast.CallExpression:
+			c.checkResultUsed(expression)
+			return c.compileCallExpression(expression)
+		case *ast.AssignmentExpression:
+			return c.compileAssignmentExpression(expression)
+		case *ast.IfExpression:
+			return c.compileIfExpression(expression)
+		}
 		return c.compileExpression(node.Expression)
+	case *ast.IncDecStatement:
+		return c.compileIncDecStatement(node)
+	case *ast.TryExpression:
+		return c.compileTryExpression(node)
 	case *ast.CallExpression:
+		c.checkResultUnwrapped(node)
 		return c.compileCallExpression(node)
 	case *ast.IfExpression:
-		return c.compileIfExpression(node)
+		return c.compileIfValue(node)
+	case *ast.SwitchStatement:
+		return c.compileSwitchStatement(node)
 	case *ast.AssignmentExpression:
-		return c.compileAssignmentExpression(node)
+		return c.compileAssignmentValue(node)
 	case *ast.Identifier:
+		c.checkResultUnwrapped(node)
 		return c.compileIdentifier(node)
 	case *ast.IntegerLiteral:
-		constInt := &ConstInt{value: node.Value, typeName: "i32"}
+		constInt := &ConstInt{value: node.Value, typeName: integerType(node)}
 		return []Operation{constInt}
+	case *ast.FloatLiteral:
+		constFloat := &ConstFloat{value: node.Value, typeName: floatType(node)}
+		return []Operation{constFloat}
 	case *ast.String:
-		c.addData([]byte(node.Value))
-
-		offset := &ConstInt{value: 0, typeName: "i32"}
+		offset := &ConstInt{value: int64(c.addData([]byte(node.Value))), typeName: "i32"}
 		strLength := &ConstInt{value: int64(len(node.Value)), typeName: "i32"}
 		return []Operation{offset, strLength}
+	case *ast.IndexExpression:
+		return c.compileIndexExpression(node)
+	case *ast.SliceExpression:
+		return c.compileSliceExpression(node)
 	}
 	c.handleError(fmt.Errorf("unknown type %s", reflect.TypeOf(node)))
 	return []Operation{}
@@ -231,19 +944,22 @@ func (c *Compiler) compileInitAssignExpression(exp *ast.InitAssignExpression) []
 
 	symbol := c.symbolTable.Define(exp.LeftExp.String(), c.inferType(exp.Value))
 
-	expressionOps := c.compileExpression(exp.Value)
+	expressionOps := c.compileResult(exp.Value)
 	operations = append(operations, expressionOps...)
 
 	if symbol.Scope == GlobalScope {
+		if _, _, isResult := splitResultType(symbol.Type); isResult {
+			c.handleError(fmt.Errorf("result %s cannot be bound to a global", exp.String()))
+		}
 		setGlobal := &SetGlobal{name: symbol.Name, globalIndex: symbol.Index}
 		operations = append(operations, setGlobal)
 	} else {
-		c.functionBody.localCount++
-		localEntry := &LocalEntry{count: 1, valueType: &ValueType{name: symbol.Name, typeName: symbol.Type}}
-		c.functionBody.locals = append(c.functionBody.locals, localEntry)
-
-		setLocal := &SetLocal{name: symbol.Name, localIndex: symbol.Index}
-		operations = append(operations, setLocal)
+		if _, _, isResult := splitResultType(symbol.Type); isResult && len(c.inlining) == 0 {
+			c.results = append(c.results, &resultBinding{symbol: symbol, exp: exp})
+		}
+		c.appendLocal(symbol)
+		operations = append(operations, storeLocal(symbol)...)
+		c.declareVariable(symbol)
 	}
 	return operations
 }
@@ -251,36 +967,487 @@ func (c *Compiler) compileInitAssignExpression(exp *ast.InitAssignExpression) []
 func (c *Compiler) compileCallExpression(callExpression *ast.CallExpression) []Operation {
 	var operations []Operation
 
-	funcName := callExpression.Function.String()
+	if c.isBuiltin(callExpression, LenBuiltin) {
+		return c.compileLen(callExpression)
+	}
+	if c.isBuiltin(callExpression, AssertBuiltin) {
+		return c.compileAssert(callExpression)
+	}
+	if c.isBuiltin(callExpression, ExpectEqBuiltin) {
+		return c.compileExpectEq(callExpression)
+	}
 
-	funcType, found := c.getFunctionType(funcName)
-	if !found {
-		c.errors = append(c.errors, fmt.Errorf("function type for %s not found", funcName))
+	funcType, err := c.resolveFunction(callExpression.Function)
+	if err != nil {
+		c.handleError(err)
 		return nil
 	}
 
-	call := &Call{functionIndex: funcType.functionIndex, name: funcName}
+	if decl, found := c.functions[funcType.name]; found && decl.function.Attribute(InlineAttribute) != nil {
+		if funcType.errorType != "" {
+			c.handleError(fmt.Errorf("fn %s: @inline functions can not return results", funcType.name))
+			return nil
+		}
+		return c.compileInlineCall(decl, callExpression)
+	}
+
+	call := &Call{functionIndex: funcType.functionIndex, name: funcType.name}
 
 	for _, arg := range callExpression.Arguments {
 		operations := c.compileExpression(arg)
 		call.arguments = append(call.arguments, operations...)
 	}
+	call.arguments = append(call.arguments, c.markPosition(callExpression.Span().Start)...)
+	if funcType.functionIndex >= uint32(c.module.importSection.count) {
+		call.arguments = append(call.arguments, c.callEnterHook(funcType)...)
+		operations = append(operations, call)
+		return append(operations, c.callLeaveHook()...)
+	}
 	operations = append(operations, call)
 	return operations
 }
 
+// isBuiltin reports whether the call calls the built-in name which is not shadowed by a function of the package
+func (c *Compiler) isBuiltin(callExpression *ast.CallExpression, name string) bool {
+	ident, ok := callExpression.Function.(*ast.Identifier)
+	if !ok || ident.Value != name {
+		return false
+	}
+	_, found := c.getFunctionType(c.qualify(name))
+	return !found
+}
+
+func (c *Compiler) compileLen(callExpression *ast.CallExpression) []Operation {
+	if len(callExpression.Arguments) != 1 {
+		c.handleError(fmt.Errorf("%s expects exactly one argument", LenBuiltin))
+		return nil
+	}
+	operations, str := c.compileString(callExpression.Arguments[0], "len")
+	return append(operations, stringLength(str))
+}
+
+// compileString evaluates a string expression into a string local. Variables are used
+// as they are, other expressions are stored in a temporary local named after purpose.
+func (c *Compiler) compileString(expression ast.Expression, purpose string) ([]Operation, Symbol) {
+	if valueType := c.inferType(expression); valueType != "string" {
+		c.handleError(fmt.Errorf("%s expects a string but %s is %s", purpose, expression.String(), valueType))
+		return nil, Symbol{}
+	}
+
+	if ident, ok := expression.(*ast.Identifier); ok {
+		if symbol, found := c.symbolTable.Resolve(ident.Value); found && symbol.Type == "string" {
+			return nil, symbol
+		}
+	}
+
+	str := c.symbolTable.Define(fmt.Sprintf("%s.%d", purpose, c.functionBody.localCount), "string")
+	c.appendLocal(str)
+
+	operations := c.compileExpression(expression)
+	return append(operations, storeLocal(str)...), str
+}
+
+// compileTemp stores the value computed by operations in a temporary i32 local
+func (c *Compiler) compileTemp(operations []Operation, purpose string) ([]Operation, *GetLocal) {
+	temp := c.symbolTable.Define(fmt.Sprintf("%s.%d", purpose, c.functionBody.localCount), "i32")
+	c.appendLocal(temp)
+
+	operations = append(operations, &SetLocal{name: temp.Name, localIndex: temp.Index})
+	return operations, &GetLocal{name: temp.Name, localIndex: temp.Index}
+}
+
+// compileIndexExpression loads the byte at an index of a string and traps when the index is out of range
+func (c *Compiler) compileIndexExpression(indexExpression *ast.IndexExpression) []Operation {
+	operations, str := c.compileString(indexExpression.Left, "index")
+
+	indexOps, index := c.compileTemp(c.compileExpression(indexExpression.Index), "index")
+	operations = append(operations, indexOps...)
+
+	operations = append(operations, c.markPosition(indexExpression.Span().Start)...)
+	return append(operations,
+		&If{
+			conditionOps: []Operation{index, stringLength(str), &GreaterEqualUnsigned{}},
+			thenOps:      []Operation{&Unreachable{}},
+		},
+		stringOffset(str), index, &Add{typeName: "i32"}, &Load8Unsigned{},
+	)
+}
+
+// compileSliceExpression takes the bytes from low up to high of a string without copying
+// them and traps unless low <= high <= len(s)
+func (c *Compiler) compileSliceExpression(sliceExpression *ast.SliceExpression) []Operation {
+	operations, str := c.compileString(sliceExpression.Left, "slice")
+
+	lowOps := []Operation{&ConstInt{value: 0, typeName: "i32"}}
+	if sliceExpression.Low != nil {
+		lowOps = c.compileExpression(sliceExpression.Low)
+	}
+	lowOps, low := c.compileTemp(lowOps, "low")
+	operations = append(operations, lowOps...)
+
+	highOps := []Operation{stringLength(str)}
+	if sliceExpression.High != nil {
+		highOps = c.compileExpression(sliceExpression.High)
+	}
+	highOps, high := c.compileTemp(highOps, "high")
+	operations = append(operations, highOps...)
+
+	operations = append(operations, c.markPosition(sliceExpression.Span().Start)...)
+	return append(operations,
+		&If{
+			conditionOps: []Operation{
+				low, high, &GreaterUnsigned{},
+				high, stringLength(str), &GreaterUnsigned{},
+				&Or{typeName: "i32"},
+			},
+			thenOps: []Operation{&Unreachable{}},
+		},
+		stringOffset(str), low, &Add{typeName: "i32"},
+		high, low, &Sub{typeName: "i32"},
+	)
+}
+
+// compileStringInfixExpression compares strings by their content and concatenates them into newly allocated memory
+func (c *Compiler) compileStringInfixExpression(infixExpression *ast.InfixExpression) []Operation {
+	leftType, rightType := c.inferType(infixExpression.Left), c.inferType(infixExpression.Right)
+	if leftType != rightType {
+		c.handleError(fmt.Errorf("mismatched types %s and %s in %s", leftType, rightType, infixExpression.String()))
+		return nil
+	}
+
+	switch infixExpression.Operator {
+	case "==", "!=":
+		operations := c.compileExpression(infixExpression.Left)
+		operations = append(operations, c.compileExpression(infixExpression.Right)...)
+		operations = append(operations, c.callRuntime(runtimeStringEqual))
+		if infixExpression.Operator == "!=" {
+			operations = append(operations, &EqualZero{})
+		}
+		return operations
+	case "+":
+		operations, left := c.compileString(infixExpression.Left, "concat")
+		rightOps, right := c.compileString(infixExpression.Right, "concat")
+		operations = append(operations, rightOps...)
+
+		concat := c.callRuntime(runtimeStringConcat, stringOffset(left), stringLength(left), stringOffset(right), stringLength(right))
+		return append(operations, concat, stringLength(left), stringLength(right), &Add{typeName: "i32"})
+	}
+	c.handleError(fmt.Errorf("operator %s not defined on strings", infixExpression.Operator))
+	return nil
+}
+
+// compileInlineCall expands the body of an @inline function at the call site. Arguments
+// are evaluated in the caller scope and stored in fresh locals bound to the parameter names.
+func (c *Compiler) compileInlineCall(decl *functionDecl, callExpression *ast.CallExpression) []Operation {
+	signature := decl.function.Signature
+
+	if c.inlining[decl] {
+		c.handleError(fmt.Errorf("fn %s: recursive @inline call", signature.Name))
+		return nil
+	}
+	if len(callExpression.Arguments) != len(signature.InputParams) {
+		c.handleError(fmt.Errorf("fn %s: expected %d arguments but got %d", signature.Name, len(signature.InputParams), len(callExpression.Arguments)))
+		return nil
+	}
+
+	var arguments [][]Operation
+	for _, arg := range callExpression.Arguments {
+		arguments = append(arguments, c.compileExpression(arg))
+	}
+
+	pkgPath, imports, tail := c.pkgPath, c.imports, c.tailReturn
+	c.pkgPath = decl.pkgPath
+	c.tailReturn = tailReturn(decl.function.Body)
+	c.resolveImports(decl.file)
+	c.inlining[decl] = true
+	c.symbolTable = NewBlockSymbolTable(c.symbolTable)
+	scope := len(c.scopeVariables)
+
+	var operations []Operation
+	for i, param := range signature.InputParams {
+		if param.Type == "string" {
+			c.handleError(fmt.Errorf("fn %s: string parameters can not be inlined", signature.Name))
+			continue
+		}
+		symbol := c.symbolTable.Define(param.Ident.Value, param.Type)
+		c.appendLocal(symbol)
+
+		operations = append(operations, arguments[i]...)
+		operations = append(operations, &SetLocal{name: symbol.Name, localIndex: symbol.Index})
+		c.declareVariable(symbol)
+	}
+	operations = append(operations, c.compileBody(decl.function.Body)...)
+
+	c.closeScope(scope)
+	c.symbolTable = c.symbolTable.Outer
+	delete(c.inlining, decl)
+	c.pkgPath, c.imports, c.tailReturn = pkgPath, imports, tail
+
+	return operations
+}
+
 func (c *Compiler) compileIfExpression(ifExpression *ast.IfExpression) []Operation {
 	var operations []Operation
 
+	conditionOps := c.compileExpression(ifExpression.Condition)
+
+	c.blockDepth++
+	thenOps := c.compileBody(ifExpression.Body)
+
+	var elseOps []Operation
+	switch alternative := ifExpression.Alternative.(type) {
+	case *ast.BlockStatement:
+		elseOps = c.compileBody(alternative)
+	case *ast.IfExpression:
+		elseOps = c.compileIfExpression(alternative)
+	}
+	c.blockDepth--
+
 	ifOp := &If{
-		conditionOps: c.compileExpression(ifExpression.Condition),
-		thenOps:      c.compileBody(ifExpression.Body),
+		conditionOps: conditionOps,
+		thenOps:      thenOps,
+		elseOps:      elseOps,
 	}
 
 	operations = append(operations, ifOp)
 	return operations
 }
 
+// compileIfValue compiles an if used as a value. Each branch yields the value of
+// its last expression and both branches must agree on its type. A branch ending
+// in return yields no value and takes the type of the other branch.
+func (c *Compiler) compileIfValue(ifExpression *ast.IfExpression) []Operation {
+	if ifExpression.Alternative == nil {
+		c.handleError(fmt.Errorf("if used as value is missing else branch"))
+		return nil
+	}
+
+	conditionOps := c.compileExpression(ifExpression.Condition)
+
+	c.blockDepth++
+	thenOps, thenType := c.compileBlockValue(ifExpression.Body)
+
+	var elseOps []Operation
+	var elseType string
+	switch alternative := ifExpression.Alternative.(type) {
+	case *ast.BlockStatement:
+		elseOps, elseType = c.compileBlockValue(alternative)
+	case *ast.IfExpression:
+		elseOps = c.compileIfValue(alternative)
+		elseType = c.inferType(alternative)
+	}
+	c.blockDepth--
+
+	resultType := thenType
+	if resultType == "" {
+		resultType = elseType
+	}
+	if elseType != "" && elseType != resultType {
+		c.handleError(fmt.Errorf("mismatched types %s and %s in if branches", thenType, elseType))
+		return nil
+	}
+	switch resultType {
+	case "":
+		c.handleError(fmt.Errorf("if used as value has no value in any branch"))
+		return nil
+	case "string":
+		c.handleError(fmt.Errorf("if values of type string are not implemented"))
+		return nil
+	}
+
+	ifOp := &If{
+		conditionOps: conditionOps,
+		thenOps:      thenOps,
+		elseOps:      elseOps,
+		resultType:   resultType,
+	}
+	return []Operation{ifOp}
+}
+
+// compileBlockValue compiles a branch of an if used as a value and returns the
+// type of the value it leaves on the stack, empty when the branch returns.
+func (c *Compiler) compileBlockValue(block *ast.BlockStatement) ([]Operation, string) {
+	statements := block.Statements
+	if len(statements) != 0 {
+		switch last := statements[len(statements)-1].(type) {
+		case *ast.ReturnStatement:
+			return c.compileStatements(statements), ""
+		case *ast.ExpressionStatement:
+			operations := c.compileStatements(statements[:len(statements)-1])
+			operations = append(operations, c.instrumentStatement(last)...)
+			operations = append(operations, c.compileExpression(last.Expression)...)
+			if typeName := c.inferType(last.Expression); typeName != "unknown" {
+				return operations, typeName
+			}
+		}
+	}
+	c.handleError(fmt.Errorf("missing value at end of if branch"))
+	return nil, ""
+}
+
+// blockType returns the type of the value a block yields through its last expression
+func (c *Compiler) blockType(block *ast.BlockStatement) string {
+	if len(block.Statements) == 0 {
+		return "unknown"
+	}
+	if last, ok := block.Statements[len(block.Statements)-1].(*ast.ExpressionStatement); ok {
+		return c.inferType(last.Expression)
+	}
+	return "unknown"
+}
+
+// compileSwitchStatement lowers a switch to a single br_table jump when its case
+// values are dense and to a chain of ifs otherwise. Both forms run at most one
+// clause and fall through to the default clause when no case value matches.
+func (c *Compiler) compileSwitchStatement(switchStatement *ast.SwitchStatement) []Operation {
+	var cases []*ast.CaseClause
+	var defaultClause *ast.CaseClause
+	var values []int64
+
+	seen := make(map[int64]bool)
+	for _, clause := range switchStatement.Cases {
+		if clause.Values == nil {
+			if defaultClause != nil {
+				c.handleError(fmt.Errorf("multiple defaults in switch"))
+				return nil
+			}
+			defaultClause = clause
+			continue
+		}
+
+		for _, value := range clause.Values {
+			literal, ok := value.(*ast.IntegerLiteral)
+			if !ok {
+				c.handleError(fmt.Errorf("case value %s must be an integer constant", value.String()))
+				return nil
+			}
+			if seen[literal.Value] {
+				c.handleError(fmt.Errorf("duplicate case %d in switch", literal.Value))
+				return nil
+			}
+			seen[literal.Value] = true
+			values = append(values, literal.Value)
+		}
+		cases = append(cases, clause)
+	}
+
+	if valueType := c.inferType(switchStatement.Value); valueType != "i32" && valueType != "unknown" {
+		c.handleError(fmt.Errorf("cannot switch on %s of type %s", switchStatement.Value.String(), valueType))
+		return nil
+	}
+
+	if isDense(values) {
+		return c.compileBranchTable(switchStatement.Value, cases, defaultClause, values)
+	}
+	return c.compileSwitchChain(switchStatement.Value, cases, defaultClause)
+}
+
+// compileBranchTable nests a block per case inside a default and an end block. The
+// br_table in the innermost block jumps to the end of the block of the matching case,
+// which is followed by the case body and a branch to the end of the switch.
+func (c *Compiler) compileBranchTable(value ast.Expression, cases []*ast.CaseClause, defaultClause *ast.CaseClause, values []int64) []Operation {
+	min, max := valueRange(values)
+
+	caseCount := uint32(len(cases))
+	targets := make([]uint32, max-min+1)
+	for i := range targets {
+		targets[i] = caseCount
+	}
+	for i, clause := range cases {
+		for _, v := range clause.Values {
+			targets[v.(*ast.IntegerLiteral).Value-min] = uint32(i)
+		}
+	}
+
+	operations := c.compileExpression(value)
+	if min != 0 {
+		operations = append(operations, &ConstInt{value: min, typeName: "i32"}, &Sub{typeName: "i32"})
+	}
+	operations = append(operations, &BrTable{targets: targets, defaultTarget: caseCount})
+
+	for i, clause := range cases {
+		depth := caseCount - uint32(i)
+
+		c.blockDepth += depth + 1
+		body := c.compileStatements(clause.Statements)
+		c.blockDepth -= depth + 1
+
+		operations = append([]Operation{&Block{ops: operations}}, body...)
+		operations = append(operations, &Br{depth: depth})
+	}
+
+	operations = []Operation{&Block{ops: operations}}
+	if defaultClause != nil {
+		c.blockDepth++
+		operations = append(operations, c.compileStatements(defaultClause.Statements)...)
+		c.blockDepth--
+	}
+	return []Operation{&Block{ops: operations}}
+}
+
+// compileSwitchChain compares the switch value against the values of every case in
+// turn. The body of the first matching case branches to the end of the switch.
+func (c *Compiler) compileSwitchChain(value ast.Expression, cases []*ast.CaseClause, defaultClause *ast.CaseClause) []Operation {
+	tmp := c.symbolTable.Define(fmt.Sprintf("switch.%d", c.functionBody.localCount), "i32")
+	c.appendLocal(tmp)
+
+	operations := c.compileExpression(value)
+	operations = append(operations, &SetLocal{name: tmp.Name, localIndex: tmp.Index})
+
+	var chain []Operation
+	for _, clause := range cases {
+		var conditionOps []Operation
+		for i, v := range clause.Values {
+			conditionOps = append(conditionOps,
+				&GetLocal{name: tmp.Name, localIndex: tmp.Index},
+				&ConstInt{value: v.(*ast.IntegerLiteral).Value, typeName: "i32"},
+				&Equal{typeName: "i32"},
+			)
+			if i > 0 {
+				conditionOps = append(conditionOps, &Or{typeName: "i32"})
+			}
+		}
+
+		c.blockDepth += 2
+		thenOps := c.compileStatements(clause.Statements)
+		c.blockDepth -= 2
+
+		chain = append(chain, &If{
+			conditionOps: conditionOps,
+			thenOps:      append(thenOps, &Br{depth: 1}),
+		})
+	}
+
+	if defaultClause != nil {
+		c.blockDepth++
+		chain = append(chain, c.compileStatements(defaultClause.Statements)...)
+		c.blockDepth--
+	}
+	return append(operations, &Block{ops: chain})
+}
+
+// isDense reports whether case values are close enough together for a jump table
+func isDense(values []int64) bool {
+	if len(values) < minBranchTableCases {
+		return false
+	}
+	min, max := valueRange(values)
+	return max-min < int64(len(values))*maxBranchTableSpread
+}
+
+func valueRange(values []int64) (min int64, max int64) {
+	min, max = values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return min, max
+}
+
 func (c *Compiler) compileAssignmentExpression(assignmentExpression *ast.AssignmentExpression) []Operation {
 	var operations []Operation
 
@@ -290,41 +1457,112 @@ func (c *Compiler) compileAssignmentExpression(assignmentExpression *ast.Assignm
 		return operations
 	}
 
-	expressionOperations := c.compileExpression(assignmentExpression.Expression)
+	value := assignmentExpression.Expression
+	if operator := strings.TrimSuffix(assignmentExpression.Operator, "="); operator != "" {
+		// x op= y is compiled as x = x op y
+		value = &ast.InfixExpression{
+			Token:    assignmentExpression.Token,
+			Operator: operator,
+			Left:     assignmentExpression.Identifier,
+			Right:    assignmentExpression.Expression,
+		}
+	}
+
+	expressionOperations := c.compileExpression(value)
 	operations = append(operations, expressionOperations...)
+	operations = append(operations, storeLocal(symbol)...)
+
+	return operations
+}
 
-	setLocal := &SetLocal{name: symbol.Name, localIndex: symbol.Index}
-	operations = append(operations, setLocal)
+// compileAssignmentValue compiles an assignment whose value is used by the enclosing
+// expression. The assigned value is kept on the stack with tee_local.
+func (c *Compiler) compileAssignmentValue(assignmentExpression *ast.AssignmentExpression) []Operation {
+	operations := c.compileAssignmentExpression(assignmentExpression)
+	if len(operations) == 0 {
+		return operations
+	}
 
+	symbol, _ := c.symbolTable.Resolve(assignmentExpression.Identifier.String())
+	if symbol.Type == "string" {
+		return append(operations, loadSymbol(symbol)...)
+	}
+	operations[len(operations)-1] = &TeeLocal{name: symbol.Name, localIndex: symbol.Index}
 	return operations
 }
 
+// compileIncDecStatement compiles x++ and x-- to get_local, add or sub of 1 and set_local
+func (c *Compiler) compileIncDecStatement(stmt *ast.IncDecStatement) []Operation {
+	symbol, ok := c.symbolTable.Resolve(stmt.Operand.String())
+	if !ok {
+		c.handleError(fmt.Errorf("variable %s is undefined", stmt.Operand.String()))
+		return nil
+	}
+	if !isIntegerType(symbol.Type) {
+		c.handleError(fmt.Errorf("invalid operation %s (non-integer variable %s of type %s)", stmt.String(), symbol.Name, symbol.Type))
+		return nil
+	}
+
+	var operation Operation = &Add{typeName: symbol.Type}
+	if stmt.Operator == "--" {
+		operation = &Sub{typeName: symbol.Type}
+	}
+	return []Operation{
+		&GetLocal{name: symbol.Name, localIndex: symbol.Index},
+		&ConstInt{value: 1, typeName: symbol.Type},
+		operation,
+		&SetLocal{name: symbol.Name, localIndex: symbol.Index},
+	}
+}
+
 func (c *Compiler) compileInfixExpression(infixExpression *ast.InfixExpression) []Operation {
 	var operations []Operation
 
+	if c.inferType(infixExpression.Left) == "string" || c.inferType(infixExpression.Right) == "string" {
+		return c.compileStringInfixExpression(infixExpression)
+	}
+
 	expressionOperations := c.compileExpression(infixExpression.Left)
 	operations = append(operations, expressionOperations...)
 
 	expressionOperations = c.compileExpression(infixExpression.Right)
 	operations = append(operations, expressionOperations...)
 
+	typeName, err := c.operandType(infixExpression)
+	if err != nil {
+		c.handleError(err)
+		return operations
+	}
+
 	var operation Operation
-	var err error
 
 	switch infixExpression.Operator {
 	case "+":
-		operation, err = sumTypes(infixExpression.Left, infixExpression.Right)
+		operation, err = sumTypes(typeName)
 	case "-":
-		operation, err = subtractTypes(infixExpression.Left, infixExpression.Right)
+		operation, err = subtractTypes(typeName)
 	case "*":
-		operation, err = multiplyTypes(infixExpression.Left, infixExpression.Right)
+		operation, err = multiplyTypes(typeName)
+	case "/":
+		operations = append(operations, c.markPosition(infixExpression.Token.Pos)...)
+		operation, err = divideTypes(typeName)
+	case "%":
+		operations = append(operations, c.markPosition(infixExpression.Token.Pos)...)
+		operation, err = remainderTypes(typeName)
+	case "&", "|", "^", "<<", ">>":
+		operation, err = bitwiseOperation(infixExpression.Operator, typeName)
+	case "==":
+		operation, err = equal(typeName)
 	case "!=":
-		operation, err = notEqual(infixExpression.Left, infixExpression.Right)
+		operation, err = notEqual(typeName)
 	default:
 		c.handleError(fmt.Errorf("unknown operator %s", infixExpression.Operator))
 		return operations
 	}
-	c.handleError(err)
+	if err != nil {
+		c.handleError(fmt.Errorf("invalid operation %s: %s", infixExpression.String(), err))
+		return operations
+	}
 	operations = append(operations, operation)
 	return operations
 }
@@ -335,8 +1573,12 @@ func (c *Compiler) compileIdentifier(identifier *ast.Identifier) []Operation {
 		c.handleError(fmt.Errorf("undefined variable %s", identifier.Value))
 		return []Operation{}
 	}
-	operation := loadSymbol(symbol)
-	return []Operation{operation}
+	for _, binding := range c.results {
+		if binding.symbol == symbol {
+			binding.used = true
+		}
+	}
+	return loadSymbol(symbol)
 }
 
 func (c *Compiler) getFunctionType(funcName string) (funcType *FuncType, found bool) {
@@ -360,25 +1602,50 @@ func (c *Compiler) getFunctionType(funcName string) (funcType *FuncType, found b
 }
 
 func (c *Compiler) appendExportEntry(funcType *FuncType) {
-	exportEntry := &ExportEntry{index: funcType.typeIndex, field: funcType.name}
+	for _, entry := range c.module.exportSection.entries {
+		if entry.field == funcType.exportName {
+			c.handleError(fmt.Errorf("fn %s: duplicate export name %q", funcType.name, funcType.exportName))
+			return
+		}
+	}
+	exportEntry := &ExportEntry{index: funcType.functionIndex, field: funcType.exportName, funcName: funcType.name}
 
 	c.module.exportSection.entries = append(c.module.exportSection.entries, exportEntry)
 	c.module.exportSection.count++
 }
 
-func (c *Compiler) appendImport(externalKind Type) {
-	importEntry := &ImportEntry{moduleName: "env", kind: externalKind}
-
-	switch node := externalKind.(type) {
-	case *FuncType:
-		importEntry.fieldName = node.name
-	}
+func (c *Compiler) appendImport(moduleName string, fieldName string, externalKind Type) {
+	importEntry := &ImportEntry{moduleName: moduleName, fieldName: fieldName, kind: externalKind}
 
 	c.module.importSection.entries = append(c.module.importSection.entries, importEntry)
 	c.module.importSection.count++
 	c.functionIndex++
 }
 
+// importHostFunction imports field of module as the function name taking params
+func (c *Compiler) importHostFunction(name string, module string, field string, params ...*ValueType) *FuncType {
+	funcType := &FuncType{name: name, paramTypes: params, paramCount: uint32(len(params))}
+
+	if foundFuncType, found := c.findFunctionType(funcType.paramTypes, funcType.resultType); found {
+		funcType.typeIndex = foundFuncType.typeIndex
+	} else {
+		funcType.typeIndex = c.typeIndex
+		c.appendType(funcType)
+	}
+	funcType.functionIndex = c.functionIndex
+	c.appendImport(module, field, funcType)
+	return funcType
+}
+
+// i32Params returns i32 params with names
+func i32Params(names ...string) []*ValueType {
+	var params []*ValueType
+	for _, name := range names {
+		params = append(params, &ValueType{name: name, typeName: "i32"})
+	}
+	return params
+}
+
 func (c *Compiler) appendType(funcType *FuncType) {
 	c.module.typeSection.entries = append(c.module.typeSection.entries, funcType)
 	c.module.typeSection.count++
@@ -391,14 +1658,29 @@ func (c *Compiler) appendFunction(funcType *FuncType) {
 	c.functionIndex++
 }
 
+func (c *Compiler) appendLocal(symbol Symbol) {
+	if symbol.Type == "string" {
+		c.appendLocalEntry(symbol.Name, "i32")
+		c.appendLocalEntry(symbol.Name+".len", "i32")
+		return
+	}
+	c.appendLocalEntry(symbol.Name, wasmType(symbol.Type))
+}
+
+func (c *Compiler) appendLocalEntry(name string, typeName string) {
+	c.functionBody.localCount++
+	localEntry := &LocalEntry{count: 1, valueType: &ValueType{name: name, typeName: typeName}}
+	c.functionBody.locals = append(c.functionBody.locals, localEntry)
+}
+
 func (c *Compiler) appendCodeSection(funcBody *FunctionBody) {
 	c.module.codeSection.bodies = append(c.module.codeSection.bodies, funcBody)
 	c.module.codeSection.count++
 }
 
-func (c *Compiler) addData(data []byte) {
+// addData places data after the previous data segment and returns its offset in linear memory
+func (c *Compiler) addData(data []byte) (offset int32) {
 	dataSegment := DataSegment{
-		index:  c.dataIndex,
 		offset: c.dataOffset,
 		size:   uint32(len(data)),
 		data:   data,
@@ -406,6 +1688,10 @@ func (c *Compiler) addData(data []byte) {
 	c.module.dataSection.entries = append(c.module.dataSection.entries, &dataSegment)
 	c.module.dataSection.count++
 	c.dataIndex++
+
+	offset = c.dataOffset
+	c.dataOffset += int32(len(data))
+	return offset
 }
 
 func (c *Compiler) handleError(err error) {
@@ -426,32 +1712,184 @@ func (c *Compiler) functionSymbol(callExpression ast.Node) (symbol Symbol, found
 func (c *Compiler) inferType(expression ast.Expression) string {
 	switch node := expression.(type) {
 	case *ast.CallExpression:
-		funcType, found := c.getFunctionType(node.Function.String())
-		if !found {
-			c.errors = append(c.errors, fmt.Errorf("function type for %s not found", node.Token.Lit))
+		if c.isBuiltin(node, LenBuiltin) {
+			return "i32"
+		}
+		if c.isBuiltin(node, AssertBuiltin) || c.isBuiltin(node, ExpectEqBuiltin) {
+			return "unknown"
+		}
+		funcType, err := c.resolveFunction(node.Function)
+		if err != nil {
+			c.handleError(err)
+			return "unknown"
+		}
+		if funcType.errorType != "" {
+			return funcType.okType + "!" + funcType.errorType
+		}
+		if funcType.resultType == nil {
 			return "unknown"
 		}
 		return funcType.resultType.typeName
+	case *ast.TryExpression:
+		resultType := c.inferType(node.Expression)
+		if okType, _, isResult := splitResultType(resultType); isResult {
+			return okType
+		}
+		return "unknown"
+	case *ast.Identifier:
+		if symbol, found := c.symbolTable.Resolve(node.Value); found {
+			return symbol.Type
+		}
 	case *ast.IntegerLiteral:
+		return integerType(node)
+	case *ast.FloatLiteral:
+		return floatType(node)
+	case *ast.String:
+		return "string"
+	case *ast.IndexExpression:
 		return "i32"
+	case *ast.SliceExpression:
+		return "string"
+	case *ast.InfixExpression:
+		switch node.Operator {
+		case "==", "!=":
+			return "i32"
+		}
+		return c.inferType(node.Left)
+	case *ast.AssignmentExpression:
+		return c.inferType(node.Identifier)
+	case *ast.IfExpression:
+		if typeName := c.blockType(node.Body); typeName != "unknown" {
+			return typeName
+		}
+		switch alternative := node.Alternative.(type) {
+		case *ast.BlockStatement:
+			return c.blockType(alternative)
+		case *ast.IfExpression:
+			return c.inferType(alternative)
+		}
 	}
 	return "unknown"
 }
 
-func sumTypes(left ast.Node, right ast.Node) (Operation, error) {
-	return &Add{}, nil
+// integerType returns the type of an integer literal which is i32 unless it has a type suffix
+func integerType(literal *ast.IntegerLiteral) string {
+	if literal.Type == "" {
+		return "i32"
+	}
+	return literal.Type
+}
+
+// floatType returns the type of a float literal which is f64 unless it has a type suffix
+func floatType(literal *ast.FloatLiteral) string {
+	if literal.Type == "" {
+		return "f64"
+	}
+	return literal.Type
+}
+
+// splitResultType splits a T!E result type into its value and error type
+func splitResultType(typeName string) (okType string, errorType string, isResult bool) {
+	i := strings.Index(typeName, "!")
+	if i == -1 {
+		return typeName, "", false
+	}
+	return typeName[:i], typeName[i+1:], true
+}
+
+// wasmType returns the wasm value type of a Shift type. T!E results are a tagged i64
+// holding the error flag in the upper and the value or error in the lower 32 bits.
+func wasmType(typeName string) string {
+	if _, _, isResult := splitResultType(typeName); isResult {
+		return "i64"
+	}
+	return typeName
+}
+
+// operandType returns the type of the operands of an infix expression which need to be of the same type
+func (c *Compiler) operandType(infixExpression *ast.InfixExpression) (string, error) {
+	left, right := c.inferType(infixExpression.Left), c.inferType(infixExpression.Right)
+	if left != right {
+		return "", fmt.Errorf("invalid operation %s (mismatched types %s and %s)", infixExpression.String(), left, right)
+	}
+	return left, nil
+}
+
+// isIntegerType reports whether the type is an integer type
+func isIntegerType(typeName string) bool {
+	return typeName == "i32" || typeName == "i64"
+}
+
+// isNumericType reports whether the type is an integer or a floating-point type
+func isNumericType(typeName string) bool {
+	return isIntegerType(typeName) || typeName == "f32" || typeName == "f64"
+}
+
+func sumTypes(typeName string) (Operation, error) {
+	if !isNumericType(typeName) {
+		return nil, fmt.Errorf("operator + not defined on %s", typeName)
+	}
+	return &Add{typeName: typeName}, nil
+}
+
+func subtractTypes(typeName string) (Operation, error) {
+	if !isNumericType(typeName) {
+		return nil, fmt.Errorf("operator - not defined on %s", typeName)
+	}
+	return &Sub{typeName: typeName}, nil
+}
+
+func multiplyTypes(typeName string) (Operation, error) {
+	if !isNumericType(typeName) {
+		return nil, fmt.Errorf("operator * not defined on %s", typeName)
+	}
+	return &Multiply{typeName: typeName}, nil
 }
 
-func subtractTypes(left ast.Node, right ast.Node) (Operation, error) {
-	return &Sub{}, nil
+func divideTypes(typeName string) (Operation, error) {
+	if !isNumericType(typeName) {
+		return nil, fmt.Errorf("operator / not defined on %s", typeName)
+	}
+	return &Divide{typeName: typeName}, nil
 }
 
-func multiplyTypes(left ast.Node, right ast.Node) (Operation, error) {
-	return &Multiply{}, nil
+func remainderTypes(typeName string) (Operation, error) {
+	if !isIntegerType(typeName) {
+		return nil, fmt.Errorf("operator %% not defined on %s", typeName)
+	}
+	return &Remainder{typeName: typeName}, nil
 }
 
-func notEqual(left ast.Node, right ast.Node) (Operation, error) {
-	return &NotEqual{}, nil
+// bitwiseOperation returns the operation of a bitwise operator on integers, >> is an arithmetic shift
+func bitwiseOperation(operator string, typeName string) (Operation, error) {
+	if !isIntegerType(typeName) {
+		return nil, fmt.Errorf("operator %s not defined on %s", operator, typeName)
+	}
+	switch operator {
+	case "&":
+		return &And{typeName: typeName}, nil
+	case "|":
+		return &Or{typeName: typeName}, nil
+	case "^":
+		return &Xor{typeName: typeName}, nil
+	case "<<":
+		return &ShiftLeft{typeName: typeName}, nil
+	}
+	return &ShiftRightSigned{typeName: typeName}, nil
+}
+
+func equal(typeName string) (Operation, error) {
+	if !isNumericType(typeName) {
+		return nil, fmt.Errorf("operator == not defined on %s", typeName)
+	}
+	return &Equal{typeName: typeName}, nil
+}
+
+func notEqual(typeName string) (Operation, error) {
+	if !isNumericType(typeName) {
+		return nil, fmt.Errorf("operator != not defined on %s", typeName)
+	}
+	return &NotEqual{typeName: typeName}, nil
 }
 
 func (c *Compiler) enterScope() {
@@ -462,15 +1900,37 @@ func (c *Compiler) leaveScope() {
 	c.symbolTable = c.symbolTable.Outer
 }
 
-func loadSymbol(s Symbol) Operation {
+func loadSymbol(s Symbol) []Operation {
 	switch s.Scope {
 	case LocalScope:
+		if s.Type == "string" {
+			return []Operation{stringOffset(s), stringLength(s)}
+		}
 		getLocal := &GetLocal{name: s.Name, localIndex: s.Index}
-		return getLocal
+		return []Operation{getLocal}
 	}
 	return nil
 }
 
+// storeLocal pops the value of a local symbol from the stack, for strings their length first
+func storeLocal(s Symbol) []Operation {
+	if s.Type == "string" {
+		return []Operation{
+			&SetLocal{name: s.Name + ".len", localIndex: s.Index + 1},
+			&SetLocal{name: s.Name, localIndex: s.Index},
+		}
+	}
+	return []Operation{&SetLocal{name: s.Name, localIndex: s.Index}}
+}
+
+func stringOffset(s Symbol) *GetLocal {
+	return &GetLocal{name: s.Name, localIndex: s.Index}
+}
+
+func stringLength(s Symbol) *GetLocal {
+	return &GetLocal{name: s.Name + ".len", localIndex: s.Index + 1}
+}
+
 func (c *Compiler) Errors() []error {
 	return c.errors
 }
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/drejca/shift/assert"
+	"github.com/drejca/shift/ast"
 	"github.com/drejca/shift/parser"
 	"github.com/drejca/shift/wasm"
 )
@@ -102,3 +103,736 @@ fn add(a i32, b i32) : i32 {
 		t.Error(err)
 	}
 }
+
+func TestCompileImportModules(t *testing.T) {
+	input := `
+import fn assert(expected i32, actual i32)
+import "console" "log" fn print(value i32)
+import "math" {
+	fn abs(value i32) : i32
+	"max" fn maximum(a i32, b i32) : i32
+}
+
+fn main() {
+	print(maximum(abs(2), 3))
+}
+`
+	p := parser.New(strings.NewReader(input))
+	program, parseErr := p.ParseProgram()
+	if parseErr != nil {
+		t.Fatal(parseErr.Error())
+	}
+
+	compiler := wasm.NewCompiler()
+	wasmModule := compiler.CompileProgram(program)
+
+	for _, err := range compiler.Errors() {
+		t.Error(err)
+	}
+
+	expected := `
+(module 
+	(type $t0 (func (param i32) (param i32)))
+	(type $t1 (func (param i32)))
+	(type $t2 (func (param i32) (result i32)))
+	(type $t3 (func (param i32) (param i32) (result i32)))
+	(type $t4 (func))
+	(import "env" "assert" (func $assert (type $t0)))
+	(import "console" "log" (func $print (type $t1)))
+	(import "math" "abs" (func $abs (type $t2)))
+	(import "math" "max" (func $maximum (type $t3)))
+	(func $main (export "main") (type $t4)
+		(call $print ((call $maximum ((call $abs (i32.const 2))) (i32.const 3)))))
+)`
+
+	err := assert.EqualString(expected, "\n"+wasmModule.String())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompileDefer(t *testing.T) {
+	input := `
+import fn release(handle i32)
+
+fn Open(handle i32) : i32 {
+	defer release(handle)
+	if handle != 0 {
+		return 1
+	}
+	return 0
+}
+`
+	p := parser.New(strings.NewReader(input))
+	program, parseErr := p.ParseProgram()
+	if parseErr != nil {
+		t.Fatal(parseErr.Error())
+	}
+
+	compiler := wasm.NewCompiler()
+	wasmModule := compiler.CompileProgram(program)
+
+	for _, err := range compiler.Errors() {
+		t.Error(err)
+	}
+
+	expected := `
+(module 
+	(type $t0 (func (param i32)))
+	(type $t1 (func (param i32) (result i32)))
+	(import "env" "release" (func $release (type $t0)))
+	(func $Open (export "Open") (type $t1) (param $handle i32) (result i32) (local $defer.result i32) (local $defer.0.0 i32) (local $defer.0 i32)
+		(block
+		get_local $handle
+		set_local $defer.0.0
+		i32.const 1
+		set_local $defer.0
+		(if 
+	get_local $handle	i32.const 0	i32.ne	(then 
+		i32.const 1		set_local $defer.result		br 1	
+)
+)
+		i32.const 0
+		set_local $defer.result
+		br 0)
+		(if 
+	get_local $defer.0	(then 
+		(call $release (get_local $defer.0.0))	
+)
+)
+		get_local $defer.result)
+)`
+
+	err := assert.EqualString(expected, "\n"+wasmModule.String())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompileResultErrors(t *testing.T) {
+	check := "\nfn check(a i32) : i32!i32 {\n\treturn a\n}\n"
+
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "fn main() {\n\tcheck(1)\n}" + check, err: "result of check(1) is not used"},
+		{input: "fn main() {\n\tdefer check(1)\n}" + check, err: "result of check(1) is not used"},
+		{input: "fn main() {\n\ta := check(1)?\n}" + check, err: "? used in fn main which does not return a result"},
+		{input: "fn Run() : i32!i32 {\n\ta := 1\n\treturn a?\n}", err: "? applied to a which is not a result"},
+		{input: "fn Run() : i32!i64 {\n\treturn 1\n}", err: "fn Run(...) : i32!i64 result types other than i32!i32 are not implemented"},
+		{input: "fn Run() : i32!i32 {\n\treturn check(0) + 1\n}" + check, err: "result of check(0) must be unwrapped with ? or returned"},
+		{input: "fn main() {\n\ttrace(check(0))\n}\nfn trace(a i32) {\n}" + check, err: "result of check(0) must be unwrapped with ? or returned"},
+		{input: "fn Run() : i32!i32 {\n\tx := check(0)\n\treturn x + 1\n}" + check, err: "result of x must be unwrapped with ? or returned"},
+		{input: "fn Run() : i32!i32 {\n\tx := check(0)\n\treturn 1\n}" + check, err: "result x := check(0) is not used"},
+		{input: "fn main() : i64 {\n\treturn 1\n}", err: "fn main(...) : i64 main can only return i32 or i32!i32"},
+		{input: "fn main() : f64 {\n\treturn 1.5\n}", err: "fn main(...) : f64 main can only return i32 or i32!i32"},
+	}
+
+	for i, test := range tests {
+		program, parseErr := parser.New(strings.NewReader(test.input)).ParseProgram()
+		if parseErr != nil {
+			t.Fatal(parseErr.Error())
+		}
+
+		compiler := wasm.NewCompiler()
+		compiler.CompileProgram(program)
+
+		errs := compiler.Errors()
+		if len(errs) == 0 || errs[0].Error() != test.err {
+			t.Errorf("%d) expected error %q but got %q", i+1, test.err, errs)
+		}
+	}
+}
+
+func TestCompileMainResult(t *testing.T) {
+	tests := []struct {
+		input  string
+		result string
+	}{
+		{input: "fn main() {\n}", result: ""},
+		{input: "fn main() : i32 {\n\treturn 1\n}", result: "i32"},
+		{input: "fn main() : i32!i32 {\n\treturn 1\n}", result: "i32!i32"},
+	}
+
+	for i, test := range tests {
+		program, parseErr := parser.New(strings.NewReader(test.input)).ParseProgram()
+		if parseErr != nil {
+			t.Fatal(parseErr.Error())
+		}
+
+		compiler := wasm.NewCompiler()
+		compiler.CompileProgram(program)
+
+		for _, err := range compiler.Errors() {
+			t.Error(err)
+		}
+		if compiler.MainResult() != test.result {
+			t.Errorf("%d) expected main result %q but got %q", i+1, test.result, compiler.MainResult())
+		}
+	}
+}
+
+func TestCompileSwitch(t *testing.T) {
+	input := `
+fn Kind(value i32) : i32 {
+	switch value {
+	case 1:
+		return 10
+	case 2, 3:
+		return 20
+	default:
+		return 30
+	}
+	return 0
+}
+`
+	program, parseErr := parser.New(strings.NewReader(input)).ParseProgram()
+	if parseErr != nil {
+		t.Fatal(parseErr.Error())
+	}
+
+	compiler := wasm.NewCompiler()
+	wasmModule := compiler.CompileProgram(program)
+
+	for _, err := range compiler.Errors() {
+		t.Error(err)
+	}
+
+	expected := `
+(module 
+	(type $t0 (func (param i32) (result i32)))
+	(func $Kind (export "Kind") (type $t0) (param $value i32) (result i32)
+		(block
+		(block
+		(block
+		(block
+		get_local $value
+		i32.const 1
+		i32.sub
+		br_table 0 1 1 2)
+		i32.const 10
+		return
+		br 2)
+		i32.const 20
+		return
+		br 1)
+		i32.const 30
+		return)
+		i32.const 0)
+)`
+
+	err := assert.EqualString(expected, "\n"+wasmModule.String())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompileSwitchErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "fn main() {\n\tswitch 1 {\n\tcase 1, 2:\n\tcase 2:\n\t}\n}", err: "duplicate case 2 in switch"},
+		{input: "fn main() {\n\ta := 1\n\tswitch 1 {\n\tcase a:\n\t}\n}", err: "case value a must be an integer constant"},
+		{input: "fn main() {\n\tswitch 1 {\n\tdefault:\n\tdefault:\n\t}\n}", err: "multiple defaults in switch"},
+	}
+
+	for i, test := range tests {
+		program, parseErr := parser.New(strings.NewReader(test.input)).ParseProgram()
+		if parseErr != nil {
+			t.Fatal(parseErr.Error())
+		}
+
+		compiler := wasm.NewCompiler()
+		compiler.CompileProgram(program)
+
+		errs := compiler.Errors()
+		if len(errs) == 0 || errs[0].Error() != test.err {
+			t.Errorf("%d) expected error %q but got %q", i+1, test.err, errs)
+		}
+	}
+}
+
+func TestCompileStringErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "fn main() {\n\ta := 1\n\tb := len(a)\n}", err: "len expects a string but a is i32"},
+		{input: "fn main() {\n\ta := 1\n\tb := a[0]\n}", err: "index expects a string but a is i32"},
+		{input: "fn main() {\n\ta := \"a\" + 1\n}", err: "mismatched types string and i32 in (\"a\" + 1)"},
+		{input: "fn main() {\n\ta := \"a\" * \"b\"\n}", err: "operator * not defined on strings"},
+		{input: "fn Name() : string {\n\treturn \"a\"\n}", err: "fn Name(...) : string results are not implemented"},
+	}
+
+	for i, test := range tests {
+		program, parseErr := parser.New(strings.NewReader(test.input)).ParseProgram()
+		if parseErr != nil {
+			t.Fatal(parseErr.Error())
+		}
+
+		compiler := wasm.NewCompiler()
+		compiler.CompileProgram(program)
+
+		errs := compiler.Errors()
+		if len(errs) == 0 || errs[0].Error() != test.err {
+			t.Errorf("%d) expected error %q but got %q", i+1, test.err, errs)
+		}
+	}
+}
+
+func TestCompileCompoundAssignment(t *testing.T) {
+	input := `
+fn Step(a i32) : i32 {
+	a += 2
+	a <<= 1
+	a++
+	return Step(a = a - 1)
+}
+`
+	program, parseErr := parser.New(strings.NewReader(input)).ParseProgram()
+	if parseErr != nil {
+		t.Fatal(parseErr.Error())
+	}
+
+	compiler := wasm.NewCompiler()
+	wasmModule := compiler.CompileProgram(program)
+
+	for _, err := range compiler.Errors() {
+		t.Error(err)
+	}
+
+	expected := `
+(module 
+	(type $t0 (func (param i32) (result i32)))
+	(func $Step (export "Step") (type $t0) (param $a i32) (result i32)
+		get_local $a
+		i32.const 2
+		i32.add
+		set_local $a
+		get_local $a
+		i32.const 1
+		i32.shl
+		set_local $a
+		get_local $a
+		i32.const 1
+		i32.add
+		set_local $a
+		(call $Step (get_local $a) (i32.const 1) (i32.sub) (tee_local $a)))
+)`
+
+	err := assert.EqualString(expected, "\n"+wasmModule.String())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompileCompoundAssignmentErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "fn main() {\n\ta += 1\n}", err: "variable a is undefined"},
+		{input: "fn main() {\n\ta++\n}", err: "variable a is undefined"},
+		{input: "fn main() {\n\ts := \"a\"\n\ts++\n}", err: "invalid operation s++ (non-integer variable s of type string)"},
+		{input: "fn main() {\n\ts := \"a\"\n\ts -= \"b\"\n}", err: "operator - not defined on strings"},
+		{input: "fn main() {\n\tf := 1.5\n\tf++\n}", err: "invalid operation f++ (non-integer variable f of type f64)"},
+	}
+
+	for i, test := range tests {
+		program, parseErr := parser.New(strings.NewReader(test.input)).ParseProgram()
+		if parseErr != nil {
+			t.Fatal(parseErr.Error())
+		}
+
+		compiler := wasm.NewCompiler()
+		compiler.CompileProgram(program)
+
+		errs := compiler.Errors()
+		if len(errs) == 0 || errs[0].Error() != test.err {
+			t.Errorf("%d) expected error %q but got %q", i+1, test.err, errs)
+		}
+	}
+}
+
+func TestCompileArithmeticErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "fn Run() : i64 {\n\ta := 1i64\n\treturn a + 2\n}", err: "invalid operation (a + 2) (mismatched types i64 and i32)"},
+		{input: "fn Run() : i32 {\n\treturn 1.5 == 1.5f32\n}", err: "invalid operation (1.5 == 1.5f32) (mismatched types f64 and f32)"},
+		{input: "fn Run() : f64 {\n\treturn 7.5 % 2.0\n}", err: "invalid operation (7.5 % 2.0): operator % not defined on f64"},
+		{input: "fn Run() : f32 {\n\treturn 1.0f32 << 2.0f32\n}", err: "invalid operation (1.0f32 << 2.0f32): operator << not defined on f32"},
+	}
+
+	for i, test := range tests {
+		program, parseErr := parser.New(strings.NewReader(test.input)).ParseProgram()
+		if parseErr != nil {
+			t.Fatal(parseErr.Error())
+		}
+
+		compiler := wasm.NewCompiler()
+		compiler.CompileProgram(program)
+
+		errs := compiler.Errors()
+		if len(errs) == 0 || errs[0].Error() != test.err {
+			t.Errorf("%d) expected error %q but got %q", i+1, test.err, errs)
+		}
+	}
+}
+
+func TestCompileIfValue(t *testing.T) {
+	input := `
+fn Pick(a i32, b i32) : i32 {
+	return if a != b { a } else { b }
+}
+`
+	program, parseErr := parser.New(strings.NewReader(input)).ParseProgram()
+	if parseErr != nil {
+		t.Fatal(parseErr.Error())
+	}
+
+	compiler := wasm.NewCompiler()
+	wasmModule := compiler.CompileProgram(program)
+
+	for _, err := range compiler.Errors() {
+		t.Error(err)
+	}
+
+	expected := `
+(module 
+	(type $t0 (func (param i32) (param i32) (result i32)))
+	(func $Pick (export "Pick") (type $t0) (param $a i32) (param $b i32) (result i32)
+		(if (result i32) 
+	get_local $a	get_local $b	i32.ne	(then 
+		get_local $a	
+)	(else 
+		get_local $b	
+)
+))
+)`
+
+	err := assert.EqualString(expected, "\n"+wasmModule.String())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompileIfValueErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "fn main() {\n\tx := if 1 != 2 { 1 }\n}", err: "if used as value is missing else branch"},
+		{input: "fn main() {\n\tx := if 1 != 2 { 1 } else { 2i64 }\n}", err: "mismatched types i32 and i64 in if branches"},
+		{input: "fn main() {\n\tx := if 1 != 2 { 1 } else if 2 != 3 { 2 } else { \"s\" }\n}", err: "mismatched types i32 and string in if branches"},
+		{input: "fn main() {\n\tx := if 1 != 2 { 1 } else { y := 2 }\n}", err: "missing value at end of if branch"},
+		{input: "fn main() {\n\tx := if 1 != 2 { \"a\" } else { \"b\" }\n}", err: "if values of type string are not implemented"},
+	}
+
+	for i, test := range tests {
+		program, parseErr := parser.New(strings.NewReader(test.input)).ParseProgram()
+		if parseErr != nil {
+			t.Fatal(parseErr.Error())
+		}
+
+		compiler := wasm.NewCompiler()
+		compiler.CompileProgram(program)
+
+		errs := compiler.Errors()
+		if len(errs) == 0 || errs[0].Error() != test.err {
+			t.Errorf("%d) expected error %q but got %q", i+1, test.err, errs)
+		}
+	}
+}
+
+func TestCompileAttributes(t *testing.T) {
+	input := `
+@start
+fn init() {
+}
+
+@export("calc_v2")
+fn Calc(a i32, b i32) : i32 {
+	return add(a, b) * 2
+}
+
+@noexport
+@inline
+fn Double(a i32) : i32 {
+	return add(a, a)
+}
+
+@inline
+fn add(a i32, b i32) : i32 {
+	return a + b
+}
+`
+	p := parser.New(strings.NewReader(input))
+	program, parseErr := p.ParseProgram()
+	if parseErr != nil {
+		t.Fatal(parseErr.Error())
+	}
+
+	compiler := wasm.NewCompiler()
+	wasmModule := compiler.CompileProgram(program)
+
+	for _, err := range compiler.Errors() {
+		t.Error(err)
+	}
+
+	expected := `
+(module 
+	(type $t0 (func))
+	(type $t1 (func (param i32) (param i32) (result i32)))
+	(type $t2 (func (param i32) (result i32)))
+	(func $init (type $t0))
+	(func $Calc (export "calc_v2") (type $t1) (param $a i32) (param $b i32) (result i32) (local $a i32) (local $b i32)
+		get_local $a
+		set_local $a
+		get_local $b
+		set_local $b
+		get_local $a
+		get_local $b
+		i32.add
+		i32.const 2
+		i32.mul)
+	(func $Double (type $t2) (param $a i32) (result i32) (local $a i32) (local $b i32)
+		get_local $a
+		set_local $a
+		get_local $a
+		set_local $b
+		get_local $a
+		get_local $b
+		i32.add)
+	(func $add (type $t1) (param $a i32) (param $b i32) (result i32)
+		get_local $a
+		get_local $b
+		i32.add)
+	(start $init)
+)`
+
+	err := assert.EqualString(expected, "\n"+wasmModule.String())
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompileAttributeErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "@unknown\nfn main() {}", err: "fn main: unknown attribute @unknown"},
+		{input: "@export(1)\nfn main() {}", err: "fn main: @export name must be a string"},
+		{input: "@inline(\"always\")\nfn main() {}", err: "fn main: @inline takes no arguments"},
+		{input: "@export\n@noexport\nfn main() {}", err: "fn main: @export and @noexport are mutually exclusive"},
+		{input: "@start\nfn init(a i32) {}", err: "fn init: @start function must not have parameters or results"},
+		{input: "@start\nfn a() {}\n@start\nfn b() {}", err: "fn b: @start already declared on a"},
+		{input: "@export(\"run\")\nfn a() {}\n@export(\"run\")\nfn b() {}", err: "fn b: duplicate export name \"run\""},
+		{input: "@inline\nfn loop() {\n\tloop()\n}\nfn main() {\n\tloop()\n}", err: "fn loop: recursive @inline call"},
+	}
+
+	for i, test := range tests {
+		program, parseErr := parser.New(strings.NewReader(test.input)).ParseProgram()
+		if parseErr != nil {
+			t.Fatal(parseErr.Error())
+		}
+
+		compiler := wasm.NewCompiler()
+		compiler.CompileProgram(program)
+
+		errs := compiler.Errors()
+		if len(errs) == 0 || errs[0].Error() != test.err {
+			t.Errorf("%d) expected error %q but got %q", i+1, test.err, errs)
+		}
+	}
+}
+
+func TestCompilePackageVisibility(t *testing.T) {
+	numbers := `
+package numbers
+
+fn Add(a i32, b i32) : i32 {
+	return add(a, b)
+}
+
+fn add(a i32, b i32) : i32 {
+	return a + b
+}
+
+fn Über(a i32) : i32 {
+	return a
+}
+
+fn ωmega(a i32) : i32 {
+	return a
+}
+`
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: `
+import "numbers"
+
+fn main() {
+	numbers.Add(1, 2)
+}
+`},
+		{input: `
+import "numbers"
+
+fn main() {
+	numbers.add(1, 2)
+}
+`, err: "cannot refer to unexported name numbers.add"},
+		{input: `
+import "numbers"
+
+fn main() {
+	numbers.Über(1)
+}
+`},
+		{input: `
+import "numbers"
+
+fn main() {
+	numbers.ωmega(1)
+}
+`, err: "cannot refer to unexported name numbers.ωmega"},
+		{input: `
+fn main() {
+	numbers.Add(1, 2)
+}
+`, err: "undefined: numbers"},
+	}
+
+	for i, test := range tests {
+		numbersProgram, parseErr := parser.New(strings.NewReader(numbers)).ParseProgram()
+		if parseErr != nil {
+			t.Fatal(parseErr.Error())
+		}
+		mainProgram, parseErr := parser.New(strings.NewReader(test.input)).ParseProgram()
+		if parseErr != nil {
+			t.Fatal(parseErr.Error())
+		}
+
+		packages := []*ast.Package{
+			{Name: "numbers", Path: "numbers", Files: []*ast.Program{numbersProgram}},
+			{Name: "main", Files: []*ast.Program{mainProgram}},
+		}
+
+		compiler := wasm.NewCompiler()
+		compiler.CompilePackages(packages)
+
+		var errs []string
+		for _, err := range compiler.Errors() {
+			errs = append(errs, err.Error())
+		}
+
+		if test.err == "" && len(errs) > 0 {
+			t.Errorf("%d) unexpected errors %q", i+1, errs)
+		}
+		if test.err != "" && (len(errs) == 0 || errs[0] != test.err) {
+			t.Errorf("%d) expected error %q but got %q", i+1, test.err, errs)
+		}
+	}
+}
+
+func TestCompileTestBlocks(t *testing.T) {
+	input := `
+fn Double(a i32) : i32 {
+	return a * 2
+}
+
+test "doubles" {
+	expect_eq(Double(2), 4)
+	assert(Double(0) == 0, "zero")
+}
+`
+	program, parseErr := parser.New(strings.NewReader(input)).ParseProgram()
+	if parseErr != nil {
+		t.Fatal(parseErr.Error())
+	}
+
+	tests := []struct {
+		includeTests bool
+		contains     []string
+		excludes     []string
+	}{
+		{
+			excludes: []string{`"doubles"`, `$test.error`, `$test.expect_eq`},
+		},
+		{
+			includeTests: true,
+			contains: []string{
+				`(import "env" "error" (func $test.error (type $t0)))`,
+				`(import "test" "expect_eq.i32" (func $test.expect_eq.i32 (type $t1)))`,
+				`(func $test "doubles" (export "test:doubles") (type $t7) (local $expect_eq.0 i32) (local $expect_eq.1 i32)`,
+				`(call $test.expect_eq.i32 (i32.const 0) (i32.const 32) (get_local $expect_eq.0) (get_local $expect_eq.1))`,
+				`(data (i32.const 0) "expect_eq failed: Double(2) != 4")`,
+				`(data (i32.const 32) "zero")`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		compiler := wasm.NewCompiler()
+		if test.includeTests {
+			compiler.IncludeTests()
+		}
+		wasmModule := compiler.CompileProgram(program)
+
+		for _, err := range compiler.Errors() {
+			t.Error(err)
+		}
+
+		module := wasmModule.String()
+		for _, s := range test.contains {
+			if !strings.Contains(module, s) {
+				t.Errorf("expected module to contain %s but got\n%s", s, module)
+			}
+		}
+		for _, s := range test.excludes {
+			if strings.Contains(module, s) {
+				t.Errorf("expected module not to contain %s but got\n%s", s, module)
+			}
+		}
+	}
+}
+
+func TestCompileTestBlockErrors(t *testing.T) {
+	tests := []struct {
+		input        string
+		includeTests bool
+		err          string
+	}{
+		{input: "fn main() {\n\tassert(1 == 1, \"one\")\n}", err: "assert is only available in tests"},
+		{input: "test \"a\" {\n\tassert(1 == 1)\n}", includeTests: true, err: "assert expects 2 arguments but got 1"},
+		{input: "test \"a\" {\n\tassert(\"yes\", \"one\")\n}", includeTests: true, err: "assert expects an i32 condition but \"yes\" is string"},
+		{input: "test \"a\" {\n\tassert(1 == 1, 1)\n}", includeTests: true, err: "assert expects a string message but 1 is i32"},
+		{input: "test \"a\" {\n\texpect_eq(1, \"one\")\n}", includeTests: true, err: "mismatched types i32 and string in (1 != \"one\")"},
+		{input: "test \"a\" {}\ntest \"a\" {}", includeTests: true, err: "test \"a\" redeclared"},
+	}
+
+	for i, test := range tests {
+		program, parseErr := parser.New(strings.NewReader(test.input)).ParseProgram()
+		if parseErr != nil {
+			t.Fatal(parseErr.Error())
+		}
+
+		compiler := wasm.NewCompiler()
+		if test.includeTests {
+			compiler.IncludeTests()
+		}
+		compiler.CompileProgram(program)
+
+		errs := compiler.Errors()
+		if len(errs) == 0 || errs[0].Error() != test.err {
+			t.Errorf("%d) expected error %q but got %q", i+1, test.err, errs)
+		}
+	}
+}
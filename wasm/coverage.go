@@ -0,0 +1,89 @@
+package wasm
+
+import (
+	"fmt"
+
+	"github.com/drejca/shift/ast"
+	"github.com/drejca/shift/token"
+)
+
+// Coverage maps the counter globals of an instrumented module to the statements
+// they count. Counter i is the global at index Global+i and counts how often the
+// statement in Statements[i] ran.
+type Coverage struct {
+	Global     uint32
+	Statements []token.Span
+	Functions  []CoveredFunction
+}
+
+// CoveredFunction is a function declared in the instrumented source
+type CoveredFunction struct {
+	Name string
+	Span token.Span
+}
+
+// Cover makes the compiler count how often every statement outside of test blocks runs
+func (c *Compiler) Cover() {
+	c.coverage = &Coverage{}
+	c.counters = make(map[ast.Statement]int)
+}
+
+// Coverage returns the coverage counters of the compiled module or nil when statements are not counted
+func (c *Compiler) Coverage() *Coverage {
+	return c.coverage
+}
+
+// coverFunction records a function whose statements are counted
+func (c *Compiler) coverFunction(function *ast.Function) {
+	if c.coverage == nil {
+		return
+	}
+	c.coverage.Functions = append(c.coverage.Functions, CoveredFunction{Name: c.qualify(function.Signature.Name), Span: function.Span()})
+}
+
+// countStatement returns the operations incrementing the counter of stmt. A statement
+// compiled more than once, like the body of an @inline function, keeps one counter.
+func (c *Compiler) countStatement(stmt ast.Statement) []Operation {
+	if c.coverage == nil || c.skipCoverage {
+		return nil
+	}
+
+	counter, found := c.counters[stmt]
+	if !found {
+		counter = len(c.coverage.Statements)
+		c.counters[stmt] = counter
+		c.coverage.Statements = append(c.coverage.Statements, stmt.Span())
+	}
+
+	// the counter number is offset by the index of the first counter global once it is known
+	name := fmt.Sprintf("cover.%d", counter)
+	getGlobal := &GetGlobal{name: name, globalIndex: uint32(counter)}
+	setGlobal := &SetGlobal{name: name, globalIndex: uint32(counter)}
+	c.counterGets = append(c.counterGets, getGlobal)
+	c.counterSets = append(c.counterSets, setGlobal)
+
+	return []Operation{getGlobal, &ConstInt{value: 1, typeName: "i32"}, &Add{typeName: "i32"}, setGlobal}
+}
+
+// appendCoverageGlobals adds a counter global for every counted statement after the other globals
+func (c *Compiler) appendCoverageGlobals() {
+	if c.coverage == nil {
+		return
+	}
+	c.coverage.Global = c.module.globalSection.count
+	for _, getGlobal := range c.counterGets {
+		getGlobal.globalIndex += c.coverage.Global
+	}
+	for _, setGlobal := range c.counterSets {
+		setGlobal.globalIndex += c.coverage.Global
+	}
+
+	for i := range c.coverage.Statements {
+		c.module.globalSection.entries = append(c.module.globalSection.entries, &GlobalEntry{
+			name:     fmt.Sprintf("cover.%d", i),
+			typeName: "i32",
+			mutable:  true,
+		})
+		c.module.globalSection.count++
+	}
+}
@@ -1,7 +1,9 @@
 package wasm
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
 
 	"bitbucket.org/sheran_gunasekera/leb128"
 )
@@ -10,9 +12,19 @@ type Emmiter struct {
 	buf       []byte
 	sectionId int
 	sections  []section
+	marks     []mark
+	functions [][]int // offsets of the instructions of every function body
+	codeStart int     // offset of the code section content
+	codeEnd   int
 	errors    []error
 }
 
+// mark is the offset of the code following a source position
+type mark struct {
+	offset int
+	entry  *LineEntry
+}
+
 type section struct {
 	id   int
 	pos  int
@@ -41,15 +53,61 @@ func (e *Emmiter) Emit(node Node) error {
 		if node.memorySection.count > 0 {
 			e.Emit(node.memorySection)
 		}
+		if node.globalSection.count > 0 {
+			e.Emit(node.globalSection)
+		}
 		if node.exportSection.count > 0 {
 			e.Emit(node.exportSection)
 		}
+		if node.startSection != nil {
+			e.Emit(node.startSection)
+		}
 		if node.codeSection.count > 0 {
 			e.Emit(node.codeSection)
 		}
 		if node.dataSection.count > 0 {
 			e.Emit(node.dataSection)
 		}
+		if node.nameSection != nil {
+			e.Emit(node.nameSection)
+		}
+
+		// offsets are final once all section sizes are written
+		for _, mark := range e.marks {
+			mark.entry.Offset = mark.offset
+		}
+		if node.lineTable != nil {
+			node.lineTable.instructions = e.functions
+			node.lineTable.CodeOffset = e.codeStart
+			node.lineTable.CodeSize = e.codeEnd - e.codeStart
+		}
+	case *NameSection:
+		e.emit(SECTION_CUSTOM)
+		sectionId := e.startSection()
+		e.emitName(nameSectionName)
+
+		if node.moduleName != "" {
+			e.emit(NAME_MODULE)
+			subsectionId := e.startSection()
+			e.emitName(node.moduleName)
+			e.endSection(subsectionId)
+		}
+
+		e.emit(NAME_FUNCTION)
+		subsectionId := e.startSection()
+		e.emitNameMap(node.functionNames)
+		e.endSection(subsectionId)
+
+		e.emit(NAME_LOCAL)
+		subsectionId = e.startSection()
+		e.emit(leb128.EncodeULeb128(uint32(len(node.localNames)))...)
+		for _, localNames := range node.localNames {
+			e.emit(leb128.EncodeULeb128(localNames.functionIndex)...)
+			e.emitNameMap(localNames.locals)
+		}
+		e.endSection(subsectionId)
+
+		e.endSection(sectionId)
 	case *TypeSection:
 		e.emit(SECTION_TYPE)
 		sectionId := e.startSection()
@@ -86,6 +144,15 @@ func (e *Emmiter) Emit(node Node) error {
 			e.Emit(memoryType)
 		}
 		e.endSection(sectionId)
+	case *GlobalSection:
+		e.emit(SECTION_GLOBAL)
+		sectionId := e.startSection()
+
+		e.emit(leb128.EncodeULeb128(node.count)...)
+		for _, globalEntry := range node.entries {
+			e.Emit(globalEntry)
+		}
+		e.endSection(sectionId)
 	case *ExportSection:
 		e.emit(SECTION_EXPORT)
 		sectionId := e.startSection()
@@ -95,15 +162,23 @@ func (e *Emmiter) Emit(node Node) error {
 			e.Emit(exportEntry)
 		}
 		e.endSection(sectionId)
+	case *StartSection:
+		e.emit(SECTION_START)
+		sectionId := e.startSection()
+
+		e.emit(leb128.EncodeULeb128(node.functionIndex)...)
+		e.endSection(sectionId)
 	case *CodeSection:
 		e.emit(SECTION_CODE)
 		sectionId := e.startSection()
+		e.codeStart = len(e.buf)
 
 		e.emit(byte(node.count))
 		for _, functionBody := range node.bodies {
 			e.Emit(functionBody)
 		}
 		e.endSection(sectionId)
+		e.codeEnd = len(e.buf)
 	case *DataSection:
 		e.emit(SECTION_DATA)
 		sectionId := e.startSection()
@@ -140,6 +215,16 @@ func (e *Emmiter) Emit(node Node) error {
 		e.emit(BODY_END)
 		e.emit(byte(node.size))
 		e.emit(node.data...)
+	case *GlobalEntry:
+		e.emit(e.typeOpCode(node.typeName)...)
+		if node.mutable {
+			e.emit(GLOBAL_MUTABLE)
+		} else {
+			e.emit(ZERO)
+		}
+		e.emit(CONST_I32)
+		e.emit(leb128.EncodeSLeb128(node.init)...)
+		e.emit(BODY_END)
 	case *MemoryType:
 		e.emit(byte(node.flags))
 		e.emit(byte(node.initialLength))
@@ -147,8 +232,25 @@ func (e *Emmiter) Emit(node Node) error {
 			e.emit(byte(node.maximum))
 		}
 	case *ConstInt:
-		e.emit(CONST_I32)
-		e.emit(leb128.EncodeSLeb128(int32(node.value))...)
+		if node.typeName == "i64" {
+			e.instruction(CONST_I64)
+			e.emit(encodeSLeb128(node.value)...)
+		} else {
+			e.instruction(CONST_I32)
+			e.emit(leb128.EncodeSLeb128(int32(node.value))...)
+		}
+	case *ConstFloat:
+		if node.typeName == "f32" {
+			e.instruction(CONST_F32)
+			bits := make([]byte, 4)
+			binary.LittleEndian.PutUint32(bits, math.Float32bits(float32(node.value)))
+			e.emit(bits...)
+		} else {
+			e.instruction(CONST_F64)
+			bits := make([]byte, 8)
+			binary.LittleEndian.PutUint64(bits, math.Float64bits(node.value))
+			e.emit(bits...)
+		}
 	case *ValueType:
 		e.emit(e.typeOpCode(node.typeName)...)
 	case *ResultType:
@@ -160,6 +262,7 @@ func (e *Emmiter) Emit(node Node) error {
 		e.emit(byte(node.index))
 	case *FunctionBody:
 		sectionID := e.startSection()
+		e.functions = append(e.functions, nil)
 
 		e.emit(byte(node.localCount))
 		for _, localEntry := range node.locals {
@@ -176,42 +279,174 @@ func (e *Emmiter) Emit(node Node) error {
 			e.Emit(op)
 		}
 
-		e.emit(CALL)
+		e.instruction(CALL)
 		e.emit(byte(node.functionIndex))
 	case *If:
 		for _, op := range node.conditionOps {
 			e.Emit(op)
 		}
-		e.emit(IF)
-		e.emit(TYPE_EMPTY)
+		e.instruction(IF)
+		if node.resultType != "" {
+			e.emit(e.typeOpCode(wasmType(node.resultType))...)
+		} else {
+			e.emit(TYPE_EMPTY)
+		}
 		for _, op := range node.thenOps {
 			e.Emit(op)
 		}
-		e.emit(END_BLOCK)
+		if node.elseOps != nil {
+			e.instruction(ELSE)
+			for _, op := range node.elseOps {
+				e.Emit(op)
+			}
+		}
+		e.instruction(END_BLOCK)
+	case *Block:
+		e.instruction(BLOCK)
+		e.emit(TYPE_EMPTY)
+		for _, op := range node.ops {
+			e.Emit(op)
+		}
+		e.instruction(END_BLOCK)
+	case *Loop:
+		e.instruction(LOOP)
+		e.emit(TYPE_EMPTY)
+		for _, op := range node.ops {
+			e.Emit(op)
+		}
+		e.instruction(END_BLOCK)
+	case *Br:
+		e.instruction(BR)
+		e.emit(leb128.EncodeULeb128(node.depth)...)
+	case *BrIf:
+		e.instruction(BR_IF)
+		e.emit(leb128.EncodeULeb128(node.depth)...)
+	case *BrTable:
+		e.instruction(BR_TABLE)
+		e.emit(leb128.EncodeULeb128(uint32(len(node.targets)))...)
+		for _, target := range node.targets {
+			e.emit(leb128.EncodeULeb128(target)...)
+		}
+		e.emit(leb128.EncodeULeb128(node.defaultTarget)...)
+	case *SourcePosition:
+		e.marks = append(e.marks, mark{offset: len(e.buf), entry: node.entry})
+	case *Unreachable:
+		e.instruction(UNREACHABLE)
+	case *Return:
+		e.instruction(RETURN)
+	case *Drop:
+		e.instruction(DROP)
 	case *LocalEntry:
 		e.emit(byte(node.count))
 		e.Emit(node.valueType)
+	case *GetGlobal:
+		e.instruction(GET_GLOBAL)
+		e.emit(leb128.EncodeULeb128(node.globalIndex)...)
 	case *SetGlobal:
-		e.emit(SET_GLOBAL)
-		e.emit(byte(node.globalIndex))
+		e.instruction(SET_GLOBAL)
+		e.emit(leb128.EncodeULeb128(node.globalIndex)...)
 	case *SetLocal:
-		e.emit(SET_LOCAL)
-		e.emit(byte(node.localIndex))
+		e.instruction(SET_LOCAL)
+		e.emit(leb128.EncodeULeb128(node.localIndex)...)
 	case *GetLocal:
-		e.emit(GET_LOCAL)
-		e.emit(byte(node.localIndex))
+		e.instruction(GET_LOCAL)
+		e.emit(leb128.EncodeULeb128(node.localIndex)...)
+	case *TeeLocal:
+		e.instruction(TEE_LOCAL)
+		e.emit(leb128.EncodeULeb128(node.localIndex)...)
 	case *Add:
-		e.emit(I32_ADD)
+		e.instruction(numericOpCode(node.typeName, I32_ADD, I64_ADD, F32_ADD, F64_ADD))
 	case *Sub:
-		e.emit(I32_SUB)
+		e.instruction(numericOpCode(node.typeName, I32_SUB, I64_SUB, F32_SUB, F64_SUB))
 	case *Multiply:
-		e.emit(I32_MUL)
+		e.instruction(numericOpCode(node.typeName, I32_MUL, I64_MUL, F32_MUL, F64_MUL))
+	case *Divide:
+		e.instruction(numericOpCode(node.typeName, I32_DIV_S, I64_DIV_S, F32_DIV, F64_DIV))
+	case *Remainder:
+		if node.typeName == "i64" {
+			e.instruction(I64_REM_S)
+		} else {
+			e.instruction(I32_REM_S)
+		}
 	case *NotEqual:
-		e.emit(I32_NOT_EQUAL)
+		e.instruction(numericOpCode(node.typeName, I32_NOT_EQUAL, I64_NOT_EQUAL, F32_NOT_EQUAL, F64_NOT_EQUAL))
+	case *Equal:
+		e.instruction(numericOpCode(node.typeName, I32_EQUAL, I64_EQUAL, F32_EQUAL, F64_EQUAL))
+	case *EqualZero:
+		e.instruction(I32_EQZ)
+	case *GreaterUnsigned:
+		e.instruction(I32_GT_U)
+	case *GreaterEqualUnsigned:
+		e.instruction(I32_GE_U)
+	case *Load8Unsigned:
+		e.instruction(I32_LOAD8_U)
+		e.emit(ZERO, ZERO)
+	case *Store8:
+		e.instruction(I32_STORE8)
+		e.emit(ZERO, ZERO)
+	case *CurrentMemory:
+		e.instruction(CURRENT_MEMORY)
+		e.emit(ZERO)
+	case *GrowMemory:
+		e.instruction(GROW_MEMORY)
+		e.emit(ZERO)
+	case *And:
+		if node.typeName == "i64" {
+			e.instruction(I64_AND)
+		} else {
+			e.instruction(I32_AND)
+		}
+	case *Xor:
+		if node.typeName == "i64" {
+			e.instruction(I64_XOR)
+		} else {
+			e.instruction(I32_XOR)
+		}
+	case *Or:
+		if node.typeName == "i64" {
+			e.instruction(I64_OR)
+		} else {
+			e.instruction(I32_OR)
+		}
+	case *ShiftLeft:
+		if node.typeName == "i64" {
+			e.instruction(I64_SHL)
+		} else {
+			e.instruction(I32_SHL)
+		}
+	case *ShiftRightSigned:
+		if node.typeName == "i64" {
+			e.instruction(I64_SHR_S)
+		} else {
+			e.instruction(I32_SHR_S)
+		}
+	case *ShiftRightUnsigned:
+		if node.typeName == "i64" {
+			e.instruction(I64_SHR_U)
+		} else {
+			e.instruction(I32_SHR_U)
+		}
+	case *Wrap:
+		e.instruction(I32_WRAP_I64)
+	case *ExtendUnsigned:
+		e.instruction(I64_EXTEND_U_I32)
 	}
 	return nil
 }
 
+// numericOpCode picks the opcode of a numeric operation on operands of the type
+func numericOpCode(typeName string, i32 byte, i64 byte, f32 byte, f64 byte) byte {
+	switch typeName {
+	case "i64":
+		return i64
+	case "f32":
+		return f32
+	case "f64":
+		return f64
+	}
+	return i32
+}
+
 func (e *Emmiter) typeOpCode(typeName string) []byte {
 	switch typeName {
 	case "i32":
@@ -219,6 +454,10 @@ func (e *Emmiter) typeOpCode(typeName string) []byte {
 	case "int":
 	case "i64":
 		return []byte{TYPE_I64}
+	case "f32":
+		return []byte{TYPE_F32}
+	case "f64":
+		return []byte{TYPE_F64}
 	case "string":
 		return []byte{TYPE_I32, TYPE_I32}
 	}
@@ -236,10 +475,18 @@ func (e *Emmiter) startSection() (sectionId int) {
 	return e.sectionId
 }
 
+// endSection writes the size of a finished section into its placeholder byte.
+// Sizes that need more than one LEB128 byte shift the section content right,
+// which also grows the sections enclosing it.
 func (e *Emmiter) endSection(sectionId int) {
 	if section, found := e.findSection(sectionId); found {
-		e.fixup(section.pos, byte(section.size))
 		e.removeSection(sectionId)
+
+		size := leb128.EncodeULeb128(uint32(section.size))
+		if len(size) > 1 {
+			e.insert(section.pos+1, size[1:]...)
+		}
+		e.fixup(section.pos, size...)
 	}
 }
 
@@ -265,7 +512,35 @@ func (e *Emmiter) externalKind(node Node) {
 	switch node := node.(type) {
 	case *FuncType:
 		e.emit(byte(EXT_KIND_FUNC))
-		e.emit(byte(node.functionIndex))
+		e.emit(byte(node.typeIndex))
+	}
+}
+
+// AppendCustomSection appends a custom section with payload to an emitted module.
+// Custom sections describing the emitted code, like debug info, are added this way
+// once the offsets of the code are known.
+func AppendCustomSection(module []byte, name string, payload []byte) []byte {
+	e := &Emmiter{buf: append([]byte{}, module...)}
+	e.emit(SECTION_CUSTOM)
+	sectionId := e.startSection()
+	e.emitName(name)
+	e.emit(payload...)
+	e.endSection(sectionId)
+	return e.buf
+}
+
+// emitName emits a name as its length in bytes followed by its UTF-8 bytes
+func (e *Emmiter) emitName(name string) {
+	e.emit(leb128.EncodeULeb128(uint32(len(name)))...)
+	e.emit([]byte(name)...)
+}
+
+// emitNameMap emits the names of indices in increasing order of index
+func (e *Emmiter) emitNameMap(names []*Naming) {
+	e.emit(leb128.EncodeULeb128(uint32(len(names)))...)
+	for _, naming := range names {
+		e.emit(leb128.EncodeULeb128(naming.index)...)
+		e.emitName(naming.name)
 	}
 }
 
@@ -275,10 +550,52 @@ func (e *Emmiter) fixup(pos int, bytes ...byte) {
 	}
 }
 
+func (e *Emmiter) insert(pos int, bytes ...byte) {
+	e.buf = append(e.buf[:pos], append(append([]byte{}, bytes...), e.buf[pos:]...)...)
+	for i := range e.sections {
+		e.sections[i].size += len(bytes)
+	}
+	for i := range e.marks {
+		if e.marks[i].offset >= pos {
+			e.marks[i].offset += len(bytes)
+		}
+	}
+	for _, offsets := range e.functions {
+		for i := range offsets {
+			if offsets[i] >= pos {
+				offsets[i] += len(bytes)
+			}
+		}
+	}
+	if e.codeStart >= pos {
+		e.codeStart += len(bytes)
+	}
+}
+
+// encodeSLeb128 encodes a 64 bit signed integer as the leb128 package only encodes 32 bit values
+func encodeSLeb128(value int64) []byte {
+	var out []byte
+	for {
+		b := byte(value & 0x7f)
+		value >>= 7
+		if (value == 0 && b&0x40 == 0) || (value == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
 func (e *Emmiter) Bytes() []byte {
 	return e.buf
 }
 
+// instruction emits the opcode starting an instruction of the function body being
+// emitted and records its offset
+func (e *Emmiter) instruction(opcode byte) {
+	body := len(e.functions) - 1
+	e.functions[body] = append(e.functions[body], e.emit(opcode))
+}
+
 func (e *Emmiter) emit(bytes ...byte) (pos int) {
 	pos = len(e.buf)
 	e.buf = append(e.buf, bytes...)
@@ -1,18 +1,23 @@
 package wasm_test
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/drejca/shift/loader"
 	"github.com/drejca/shift/parser"
 	"github.com/drejca/shift/print"
 	"github.com/drejca/shift/wasm"
+	wagon "github.com/go-interpreter/wagon/wasm"
 	"github.com/perlin-network/life/exec"
 )
 
 type Resolver struct {
-	t *testing.T
+	t     *testing.T
+	trace []int64
 }
 
 func (r *Resolver) ResolveFunc(module string, field string) exec.FunctionImport {
@@ -23,10 +28,15 @@ func (r *Resolver) ResolveFunc(module string, field string) exec.FunctionImport
 			return func(vm *exec.VirtualMachine) int64 {
 				offset := uint32(vm.GetCurrentFrame().Locals[0])
 				msgLength := uint32(vm.GetCurrentFrame().Locals[1])
-				msg := string(vm.Memory[offset:msgLength])
+				msg := string(vm.Memory[offset : offset+msgLength])
 				r.t.Error(msg)
 				return 0
 			}
+		case "trace":
+			return func(vm *exec.VirtualMachine) int64 {
+				r.trace = append(r.trace, vm.GetCurrentFrame().Locals[0])
+				return 0
+			}
 		default:
 			panic(fmt.Errorf("unknown import resolved: %s", field))
 		}
@@ -56,33 +66,37 @@ func TestCompilingFromFile(t *testing.T) {
 			name: "operators tests",
 			file: "../testprogram/operators.sf",
 		},
+		{
+			name: "function attributes",
+			file: "../testprogram/attributes.sf",
+		},
+		{
+			name: "string operations",
+			file: "../testprogram/strings.sf",
+		},
+		{
+			name: "package with imported package",
+			file: "../testprogram/packages/calc",
+		},
 	}
 
 	for _, tc := range testCases {
-
-		file, err := os.Open(tc.file)
+		packages, err := loader.Load(tc.file)
 		if err != nil {
-			t.Fatal(err)
-		}
+			if parseErr, ok := err.(*loader.ParseError); ok {
+				refile, err := os.Open(parseErr.Filename)
+				if err != nil {
+					t.Fatal(err)
+				}
 
-		p := parser.New(file)
-		program, parseErr := p.ParseProgram()
-
-		file.Close()
-
-		if parseErr != nil {
-			refile, err := os.Open(tc.file)
-			if err != nil {
-				t.Fatal(err)
+				printer := print.New(refile)
+				t.Fatal(printer.PrintError(parseErr.Err))
 			}
-
-			printer := print.New(refile)
-			t.Fatal(printer.PrintError(parseErr))
+			t.Fatal(err)
 		}
-		file.Close()
 
 		compiler := wasm.NewCompiler()
-		wasmModule := compiler.CompileProgram(program)
+		wasmModule := compiler.CompilePackages(packages)
 
 		for _, err := range compiler.Errors() {
 			t.Fatal(err)
@@ -113,3 +127,603 @@ func TestCompilingFromFile(t *testing.T) {
 		}
 	}
 }
+
+func TestDeferOrder(t *testing.T) {
+	input := `
+import fn trace(value i32)
+
+fn main() {
+	trace(Release(1))
+	trace(Release(2))
+	Reassign(40)
+}
+
+fn Reassign(handle i32) {
+	defer trace(handle + 1)
+	handle = 50
+	trace(handle)
+}
+
+fn Release(early i32) : i32 {
+	defer trace(10)
+	if early != 2 {
+		defer trace(20)
+		if early != 3 {
+			return 1
+		}
+	}
+	defer trace(30)
+	return 2
+}
+`
+	resolver := &Resolver{t: t}
+	vm := newVirtualMachine(t, input, resolver)
+
+	entryID, ok := vm.GetFunctionExport("main")
+	if !ok {
+		t.Fatal("entry function not found")
+	}
+
+	_, err := vm.Run(entryID)
+	if err != nil {
+		vm.PrintStackTrace()
+		t.Fatal(err)
+	}
+
+	expected := []int64{20, 10, 1, 30, 10, 2, 50, 41}
+	if fmt.Sprint(resolver.trace) != fmt.Sprint(expected) {
+		t.Errorf("expected trace %v but got %v", expected, resolver.trace)
+	}
+}
+
+func TestNestedDefer(t *testing.T) {
+	input := `
+import fn trace(value i32)
+
+fn main() {
+	trace(Release(1))
+	trace(Release(2))
+	Pick(1)
+}
+
+fn Release(value i32) : i32 {
+	return if value != 2 {
+		defer trace(20)
+		value
+	} else {
+		0
+	}
+}
+
+fn Pick(value i32) {
+	trace(if value != 0 {
+		defer trace(30)
+		1
+	} else {
+		2
+	})
+}
+`
+	resolver := &Resolver{t: t}
+	vm := newVirtualMachine(t, input, resolver)
+
+	entryID, ok := vm.GetFunctionExport("main")
+	if !ok {
+		t.Fatal("entry function not found")
+	}
+
+	_, err := vm.Run(entryID)
+	if err != nil {
+		vm.PrintStackTrace()
+		t.Fatal(err)
+	}
+
+	expected := []int64{20, 1, 0, 1, 30}
+	if fmt.Sprint(resolver.trace) != fmt.Sprint(expected) {
+		t.Errorf("expected trace %v but got %v", expected, resolver.trace)
+	}
+}
+
+func TestResultPropagation(t *testing.T) {
+	input := `
+fn check(value i32) : i32!i32 {
+	if value != 0 {
+		return value * 2
+	}
+	return Err(7)
+}
+
+fn Sum(a i32, b i32) : i32!i32 {
+	x := check(a)?
+	y := check(b)?
+	return x + y
+}
+`
+	vm := newVirtualMachine(t, input, &Resolver{t: t})
+
+	sumID, ok := vm.GetFunctionExport("Sum")
+	if !ok {
+		t.Fatal("Sum function not found")
+	}
+
+	tests := []struct {
+		a, b     int64
+		isErr    bool
+		expected int64
+	}{
+		{a: 1, b: 2, expected: 6},
+		{a: 1, b: 0, isErr: true, expected: 7},
+		{a: 0, b: 2, isErr: true, expected: 7},
+	}
+
+	for _, test := range tests {
+		res, err := vm.Run(sumID, test.a, test.b)
+		if err != nil {
+			vm.PrintStackTrace()
+			t.Fatal(err)
+		}
+
+		isErr := res>>32 == 1
+		value := int64(int32(res))
+		if isErr != test.isErr || value != test.expected {
+			t.Errorf("Sum(%d, %d) expected error=%t value=%d but got error=%t value=%d", test.a, test.b, test.isErr, test.expected, isErr, value)
+		}
+	}
+}
+
+func TestSwitch(t *testing.T) {
+	input := `
+fn Dense(value i32) : i32 {
+	result := 0
+	switch value {
+	case 3, 4:
+		result = 10
+	case 5:
+		return 20
+	case 7:
+		result = 30
+	default:
+		result = 40
+	}
+	return result
+}
+
+fn Sparse(value i32) : i32 {
+	switch value {
+	case 1, 100:
+		return 10
+	case 1000:
+		return 20
+	}
+	return 0
+}
+`
+	vm := newVirtualMachine(t, input, &Resolver{t: t})
+
+	tests := []struct {
+		function string
+		value    int64
+		expected int64
+	}{
+		{function: "Dense", value: 3, expected: 10},
+		{function: "Dense", value: 4, expected: 10},
+		{function: "Dense", value: 5, expected: 20},
+		{function: "Dense", value: 6, expected: 40},
+		{function: "Dense", value: 7, expected: 30},
+		{function: "Dense", value: 2, expected: 40},
+		{function: "Dense", value: 8, expected: 40},
+		{function: "Sparse", value: 1, expected: 10},
+		{function: "Sparse", value: 100, expected: 10},
+		{function: "Sparse", value: 1000, expected: 20},
+		{function: "Sparse", value: 2, expected: 0},
+	}
+
+	for _, test := range tests {
+		funcID, ok := vm.GetFunctionExport(test.function)
+		if !ok {
+			t.Fatalf("%s function not found", test.function)
+		}
+
+		res, err := vm.Run(funcID, test.value)
+		if err != nil {
+			vm.PrintStackTrace()
+			t.Fatal(err)
+		}
+		if res != test.expected {
+			t.Errorf("%s(%d) expected %d but got %d", test.function, test.value, test.expected, res)
+		}
+	}
+}
+
+func TestStrings(t *testing.T) {
+	input := `
+import fn trace(value i32)
+
+fn main() {
+	s := "shift"
+	trace(len(s))
+	trace(s[1])
+	trace(len(s[1:4]))
+	trace(s[1:4] == "hif")
+	trace(s[:2] != "sh")
+
+	t := s + " lang"
+	trace(len(t))
+	trace(t[6])
+	trace(t == "shift lang")
+	trace(t[len(s):] == " lang")
+	trace(Equal(s, "shift"))
+}
+
+fn Equal(a string, b string) : i32 {
+	return a == b
+}
+
+fn Index(s string, i i32) : i32 {
+	return s[i]
+}
+`
+	resolver := &Resolver{t: t}
+	vm := newVirtualMachine(t, input, resolver)
+
+	entryID, ok := vm.GetFunctionExport("main")
+	if !ok {
+		t.Fatal("entry function not found")
+	}
+
+	_, err := vm.Run(entryID)
+	if err != nil {
+		vm.PrintStackTrace()
+		t.Fatal(err)
+	}
+
+	expected := []int64{5, 'h', 3, 1, 0, 10, 'l', 1, 1, 1}
+	if fmt.Sprint(resolver.trace) != fmt.Sprint(expected) {
+		t.Errorf("expected trace %v but got %v", expected, resolver.trace)
+	}
+
+	indexID, ok := vm.GetFunctionExport("Index")
+	if !ok {
+		t.Fatal("Index function not found")
+	}
+
+	_, err = vm.Run(indexID, 0, 5, 5)
+	if err == nil {
+		t.Error("expected index out of range to trap")
+	}
+}
+
+func TestNumberLiterals(t *testing.T) {
+	input := `
+fn Bits() : i32 {
+	return 0b1010 + 0o17 + 0xFF + 1_000
+}
+
+fn Big() : i64 {
+	return 0x1_0000_0000i64
+}
+
+fn Max() : i64 {
+	return 0x7fff_ffff_ffff_ffffi64
+}
+
+fn Wide() : i64 {
+	a := 0x1_0000_0000i64
+	a++
+	b := a*3i64 - 1i64
+	return b/2i64 + (a << 1i64)
+}
+
+fn Float() : i32 {
+	x := 1.5
+	y := x*2.0 - 0.5
+	z := 0.25f32
+	if y/2.5 == 1.0 {
+		if z+z != 0.5f32 {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+`
+	vm := newVirtualMachine(t, input, &Resolver{t: t})
+
+	tests := []struct {
+		function string
+		expected int64
+	}{
+		{function: "Bits", expected: 1280},
+		{function: "Big", expected: 4294967296},
+		{function: "Max", expected: 9223372036854775807},
+		{function: "Wide", expected: 12884901890/2 + 4294967297<<1},
+		{function: "Float", expected: 1},
+	}
+
+	for _, test := range tests {
+		funcID, ok := vm.GetFunctionExport(test.function)
+		if !ok {
+			t.Fatalf("%s function not found", test.function)
+		}
+
+		res, err := vm.Run(funcID)
+		if err != nil {
+			vm.PrintStackTrace()
+			t.Fatal(err)
+		}
+		if res != test.expected {
+			t.Errorf("%s() expected %d but got %d", test.function, test.expected, res)
+		}
+	}
+}
+
+func TestCompoundAssignment(t *testing.T) {
+	input := `
+import fn trace(value i32)
+
+fn main() {
+	a := 7
+	a += 5
+	trace(a)
+	a -= 2
+	trace(a)
+	a *= 3
+	trace(a)
+	a /= 4
+	trace(a)
+	a %= 4
+	trace(a)
+	a |= 12
+	trace(a)
+	a &= 10
+	trace(a)
+	a ^= 3
+	trace(a)
+	a <<= 4
+	trace(a)
+	a >>= 2
+	trace(a)
+	a++
+	trace(a)
+	a--
+	a--
+	trace(a)
+
+	b := 0 - 16
+	b >>= 2
+	trace(b)
+	trace(7 / 2 + 7 % 2 * 10)
+	trace(1 | 2 ^ 7 & 3 << 1)
+	trace(Twice(a = 5) + a)
+
+	s := "a"
+	s += "bc"
+	trace(len(s))
+}
+
+fn Twice(value i32) : i32 {
+	return value * 2
+}
+`
+	resolver := &Resolver{t: t}
+	vm := newVirtualMachine(t, input, resolver)
+
+	entryID, ok := vm.GetFunctionExport("main")
+	if !ok {
+		t.Fatal("entry function not found")
+	}
+
+	_, err := vm.Run(entryID)
+	if err != nil {
+		vm.PrintStackTrace()
+		t.Fatal(err)
+	}
+
+	expected := []int64{12, 10, 30, 7, 3, 15, 10, 9, 144, 36, 37, 35, -4, 13, 5, 15, 3}
+	if fmt.Sprint(resolver.trace) != fmt.Sprint(expected) {
+		t.Errorf("expected trace %v but got %v", expected, resolver.trace)
+	}
+}
+
+func TestIfValue(t *testing.T) {
+	input := `
+import fn trace(value i32)
+
+fn main() {
+	a := 3
+	b := 4
+	x := if a != b { 1 } else { 2 }
+	trace(x)
+	trace(if a != 3 { 10 } else if b != 4 { 20 } else { a + b })
+	trace(Sign(0 - 5) + Sign(0) * 10 + Sign(7) * 100)
+	if a != b {
+		trace(5)
+	} else {
+		trace(6)
+	}
+	trace(Release())
+}
+
+fn Release() : i32 {
+	x := if 1 != 2 {
+		defer trace(3)
+		1
+	} else {
+		2
+	}
+	trace(x)
+	return x
+}
+
+fn Sign(value i32) : i32 {
+	if value == 0 {
+		return 0
+	}
+	return if value >> 31 != 0 {
+		0 - 1
+	} else {
+		1
+	}
+}
+
+fn Clamp(value i32) : i32 {
+	limited := if value != 0 {
+		limit := 8
+		if value >> 3 != 0 { limit } else { value }
+	} else {
+		return 0 - 1
+	}
+	return limited
+}
+`
+	resolver := &Resolver{t: t}
+	vm := newVirtualMachine(t, input, resolver)
+
+	entryID, ok := vm.GetFunctionExport("main")
+	if !ok {
+		t.Fatal("entry function not found")
+	}
+
+	_, err := vm.Run(entryID)
+	if err != nil {
+		vm.PrintStackTrace()
+		t.Fatal(err)
+	}
+
+	expected := []int64{1, 7, 99, 5, 1, 3, 1}
+	if fmt.Sprint(resolver.trace) != fmt.Sprint(expected) {
+		t.Errorf("expected trace %v but got %v", expected, resolver.trace)
+	}
+
+	clampID, ok := vm.GetFunctionExport("Clamp")
+	if !ok {
+		t.Fatal("Clamp function not found")
+	}
+
+	for value, expected := range map[int64]int64{0: -1, 5: 5, 20: 8} {
+		res, err := vm.Run(clampID, value)
+		if err != nil {
+			vm.PrintStackTrace()
+			t.Fatal(err)
+		}
+		if int64(int32(res)) != expected {
+			t.Errorf("Clamp(%d) expected %d but got %d", value, expected, int64(int32(res)))
+		}
+	}
+}
+
+func TestNameSection(t *testing.T) {
+	input := `package calc
+
+import fn print(msg string)
+
+fn Add(a i32, b i32) : i32 {
+	sum := a + b
+	return sum
+}
+
+fn Greet(name string) {
+	print(name + "!")
+}
+`
+	for _, strip := range []bool{false, true} {
+		program, parseErr := parser.New(strings.NewReader(input)).ParseProgram()
+		if parseErr != nil {
+			t.Fatal(parseErr.Error())
+		}
+
+		compiler := wasm.NewCompiler()
+		if strip {
+			compiler.StripNames()
+		}
+		wasmModule := compiler.CompileProgram(program)
+		for _, err := range compiler.Errors() {
+			t.Fatal(err)
+		}
+
+		emitter := wasm.NewEmitter()
+		if err := emitter.Emit(wasmModule); err != nil {
+			t.Fatal(err)
+		}
+
+		module, err := wagon.ReadModule(bytes.NewReader(emitter.Bytes()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names *wagon.NameSection
+		for _, custom := range module.Customs {
+			if custom.Name == wagon.CustomSectionName {
+				names = &wagon.NameSection{}
+				if err := names.UnmarshalWASM(bytes.NewReader(custom.Data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if strip {
+			if names != nil {
+				t.Error("expected no name section after stripping names")
+			}
+			continue
+		}
+		if names == nil {
+			t.Fatal("name section not found")
+		}
+
+		moduleName, err := names.Decode(wagon.NameModule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := moduleName.(*wagon.ModuleName).Name; name != "calc" {
+			t.Errorf("expected module name calc but got %s", name)
+		}
+
+		functionNames, err := names.Decode(wagon.NameFunction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "map[0:print 1:Add 2:Greet 3:runtime.stringConcat 4:runtime.alloc 5:runtime.copy]"
+		if actual := fmt.Sprint(functionNames.(*wagon.FunctionNames).Names); actual != expected {
+			t.Errorf("expected function names %s but got %s", expected, actual)
+		}
+
+		localNames, err := names.Decode(wagon.NameLocal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		locals := localNames.(*wagon.LocalNames).Funcs
+		if actual := fmt.Sprint(locals[1]); actual != "map[0:a 1:b 2:sum]" {
+			t.Errorf("expected locals of Add map[0:a 1:b 2:sum] but got %s", actual)
+		}
+		if actual := fmt.Sprint(locals[2]); actual != "map[0:name 1:name.len 2:concat.0 3:concat.0.len]" {
+			t.Errorf("expected locals of Greet map[0:name 1:name.len 2:concat.0 3:concat.0.len] but got %s", actual)
+		}
+	}
+}
+
+func newVirtualMachine(t *testing.T, input string, resolver exec.ImportResolver) *exec.VirtualMachine {
+	p := parser.New(strings.NewReader(input))
+	program, parseErr := p.ParseProgram()
+	if parseErr != nil {
+		t.Fatal(parseErr.Error())
+	}
+
+	compiler := wasm.NewCompiler()
+	wasmModule := compiler.CompileProgram(program)
+
+	for _, err := range compiler.Errors() {
+		t.Fatal(err)
+	}
+
+	emitter := wasm.NewEmitter()
+	err := emitter.Emit(wasmModule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm, err := exec.NewVirtualMachine(emitter.Bytes(), exec.VMConfig{}, resolver, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
@@ -0,0 +1,208 @@
+package wasm
+
+import (
+	"strings"
+
+	"github.com/drejca/shift/token"
+)
+
+// Step hooks are imported from the debug module, where Shift imports can not be declared
+const (
+	DebugImportModule = "debug"
+	StepImport        = "step"
+)
+
+// LineTable maps emitted code to the Shift source it was compiled from. Every
+// statement, call and trapping operation starts an entry. Tracking positions adds
+// no code, the emitter records the offsets of the entries and of every instruction,
+// so the instruction a function on the call stack of a stopped program is at can
+// be looked up.
+type LineTable struct {
+	Entries      []*LineEntry
+	CodeOffset   int // byte offset of the code section content in the emitted module
+	CodeSize     int
+	functions    []string // function names by function index
+	imports      int      // number of imported functions
+	instructions [][]int  // offsets of the instructions of every function body
+	variables    map[uint32][]*Variable
+}
+
+// Variable is a Shift variable held in a local of a function. Strings are held
+// in two locals, the offset in Local and the length in the local following it.
+type Variable struct {
+	Name  string
+	Type  string
+	Local uint32
+	first int // entries the variable is in scope for
+	last  int
+}
+
+// CodeAddress returns the offset of entry relative to the code section content as used
+// by DWARF for wasm
+func (lt *LineTable) CodeAddress(entry *LineEntry) int {
+	return entry.Offset - lt.CodeOffset
+}
+
+// LineEntry is the source position of the code starting at Offset
+type LineEntry struct {
+	Function uint32 // index of the function containing the code
+	Offset   int    // byte offset of the code in the emitted module
+	Pos      token.Position
+}
+
+// FunctionName returns the Shift name of the function with index
+func (lt *LineTable) FunctionName(index int) string {
+	if index < 0 || index >= len(lt.functions) {
+		return ""
+	}
+	return lt.functions[index]
+}
+
+// IsImport reports whether the function with index is imported from the host
+func (lt *LineTable) IsImport(index int) bool {
+	return index < lt.imports
+}
+
+// Entry returns the number of the entry containing instruction number instruction of
+// the function with index, counting the instructions of the function body in the order
+// they are emitted. Entries are numbered from 1, code before the first entry of a
+// function and runtime functions, which are not compiled from source, have entry 0.
+func (lt *LineTable) Entry(index int, instruction int) int64 {
+	body := index - lt.imports
+	if body < 0 || body >= len(lt.instructions) || instruction < 0 || instruction >= len(lt.instructions[body]) {
+		return 0
+	}
+	offset := lt.instructions[body][instruction]
+
+	var n int64
+	start := -1
+	for i, entry := range lt.Entries {
+		if entry.Function == uint32(index) && entry.Offset <= offset && entry.Offset >= start {
+			n, start = int64(i+1), entry.Offset
+		}
+	}
+	return n
+}
+
+// Position returns the position of entry number n
+func (lt *LineTable) Position(n int64) (pos token.Position, found bool) {
+	if n < 1 || n > int64(len(lt.Entries)) {
+		return token.Position{}, false
+	}
+	return lt.Entries[n-1].Pos, true
+}
+
+// Variables returns the variables of the function with index in scope at entry number n
+// in the order they were declared. A redeclared name refers to the latest variable.
+func (lt *LineTable) Variables(index int, n int64) []*Variable {
+	var variables []*Variable
+	declared := make(map[string]int)
+	for _, variable := range lt.variables[uint32(index)] {
+		if n < int64(variable.first) || n > int64(variable.last) {
+			continue
+		}
+		if i, found := declared[variable.Name]; found {
+			variables[i] = variable
+			continue
+		}
+		declared[variable.Name] = len(variables)
+		variables = append(variables, variable)
+	}
+	return variables
+}
+
+// SourcePosition marks where the code compiled from a position starts. It emits no
+// code itself, the emitter records the offset of the code following it in the entry.
+type SourcePosition struct {
+	entry *LineEntry
+}
+
+func (s *SourcePosition) operationNode() {}
+func (s *SourcePosition) String() string {
+	return ";; " + s.entry.Pos.String()
+}
+
+// TrackPositions makes the compiler build a line table of the compiled module
+func (c *Compiler) TrackPositions() {
+	c.lineTable = &LineTable{variables: make(map[uint32][]*Variable)}
+}
+
+// InsertStepHooks makes the compiler call the step hook imported from the debug module
+// before every statement, so a debugger can stop the program at any statement. It
+// tracks positions as the stopped statement is found in the line table.
+func (c *Compiler) InsertStepHooks() {
+	c.stepHooks = true
+	if c.lineTable == nil {
+		c.TrackPositions()
+	}
+}
+
+// LineTable returns the line table of the compiled module or nil when positions are not tracked
+func (c *Compiler) LineTable() *LineTable {
+	return c.lineTable
+}
+
+// importStepHook imports the step hook under a name no Shift code can refer to
+func (c *Compiler) importStepHook() {
+	c.stepHook = c.importHostFunction(DebugImportModule+"."+StepImport, DebugImportModule, StepImport)
+}
+
+// callStepHook returns the call of the step hook before a statement
+func (c *Compiler) callStepHook() []Operation {
+	if c.stepHook == nil || c.function == nil {
+		return nil
+	}
+	return []Operation{&Call{functionIndex: c.stepHook.functionIndex, name: c.stepHook.name}}
+}
+
+// declareVariable records a variable which is in scope from the next entry on. Locals
+// the compiler defines for itself have dotted names and are left out.
+func (c *Compiler) declareVariable(symbol Symbol) {
+	if c.lineTable == nil || c.function == nil || symbol.Scope != LocalScope || strings.Contains(symbol.Name, ".") {
+		return
+	}
+	variable := &Variable{Name: symbol.Name, Type: symbol.Type, Local: symbol.Index, first: len(c.lineTable.Entries) + 1}
+	c.lineTable.variables[c.function.functionIndex] = append(c.lineTable.variables[c.function.functionIndex], variable)
+	c.scopeVariables = append(c.scopeVariables, variable)
+}
+
+// closeScope ends the scope of the variables declared after the first scope variables
+// at the last entry compiled
+func (c *Compiler) closeScope(scope int) {
+	if c.lineTable == nil {
+		return
+	}
+	for _, variable := range c.scopeVariables[scope:] {
+		variable.last = len(c.lineTable.Entries)
+	}
+	c.scopeVariables = c.scopeVariables[:scope]
+}
+
+// markPosition starts a line table entry at pos with the code following the returned
+// marker, which emits no code
+func (c *Compiler) markPosition(pos token.Position) []Operation {
+	if c.lineTable == nil || c.function == nil {
+		return nil
+	}
+	entry := &LineEntry{Function: c.function.functionIndex, Pos: pos}
+	c.lineTable.Entries = append(c.lineTable.Entries, entry)
+	return []Operation{&SourcePosition{entry: entry}}
+}
+
+// nameFunctions records the names of all functions in the line table by function index
+func (c *Compiler) nameFunctions() {
+	if c.lineTable == nil {
+		return
+	}
+	for _, importEntry := range c.module.importSection.entries {
+		if funcType, ok := importEntry.kind.(*FuncType); ok {
+			c.lineTable.functions = append(c.lineTable.functions, funcType.name)
+			c.lineTable.imports++
+		}
+	}
+	for _, entry := range c.module.functionSection.entries {
+		if funcType, ok := entry.(*FuncType); ok {
+			c.lineTable.functions = append(c.lineTable.functions, funcType.name)
+		}
+	}
+}
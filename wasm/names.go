@@ -0,0 +1,80 @@
+package wasm
+
+// Subsections of the name custom section
+const (
+	nameSectionName = "name"
+
+	NAME_MODULE   = 0x00
+	NAME_FUNCTION = 0x01
+	NAME_LOCAL    = 0x02
+)
+
+// NameSection is the standard name custom section giving disassemblers and
+// virtual machines the Shift names of the module, its functions and their locals
+type NameSection struct {
+	moduleName    string
+	functionNames []*Naming
+	localNames    []*LocalNames
+}
+
+func (n *NameSection) sectionNode()   {}
+func (n *NameSection) String() string { return "" }
+
+// Naming names the function or local at index
+type Naming struct {
+	index uint32
+	name  string
+}
+
+// LocalNames names the params and locals of the function at functionIndex
+type LocalNames struct {
+	functionIndex uint32
+	locals        []*Naming
+}
+
+// StripNames makes the compiler leave the name section out of the module
+func (c *Compiler) StripNames() {
+	c.stripNames = true
+}
+
+// appendNameSection names the module after its root package and every function
+// and local after the Shift symbol it was compiled from
+func (c *Compiler) appendNameSection(moduleName string) {
+	if c.stripNames {
+		return
+	}
+	names := &NameSection{moduleName: moduleName}
+
+	for _, importEntry := range c.module.importSection.entries {
+		if funcType, ok := importEntry.kind.(*FuncType); ok {
+			names.functionNames = append(names.functionNames, &Naming{index: funcType.functionIndex, name: funcType.name})
+		}
+	}
+
+	bodies := make(map[string]*FunctionBody)
+	for _, body := range c.module.codeSection.bodies {
+		bodies[body.funcName] = body
+	}
+	for _, entry := range c.module.functionSection.entries {
+		funcType, ok := entry.(*FuncType)
+		if !ok {
+			continue
+		}
+		names.functionNames = append(names.functionNames, &Naming{index: funcType.functionIndex, name: funcType.name})
+
+		localNames := &LocalNames{functionIndex: funcType.functionIndex}
+		for _, param := range funcType.paramTypes {
+			localNames.locals = append(localNames.locals, &Naming{index: uint32(len(localNames.locals)), name: param.name})
+		}
+		if body, found := bodies[funcType.name]; found {
+			index := uint32(len(localNames.locals))
+			for _, local := range body.locals {
+				localNames.locals = append(localNames.locals, &Naming{index: index, name: local.valueType.name})
+				index += local.count
+			}
+		}
+		names.localNames = append(names.localNames, localNames)
+	}
+
+	c.module.nameSection = names
+}
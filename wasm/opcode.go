@@ -2,6 +2,7 @@ package wasm
 
 import (
 	"bytes"
+	"encoding/hex"
 	"strconv"
 )
 
@@ -17,11 +18,14 @@ const (
 	BODY_END = 0x0b
 
 	// Module sections
+	SECTION_CUSTOM = 0x00
 	SECTION_TYPE   = 0x01
 	SECTION_IMPORT = 0x02
 	SECTION_FUNC   = 0x03
 	SECTION_MEMORY = 0x05
+	SECTION_GLOBAL = 0x06
 	SECTION_EXPORT = 0x07
+	SECTION_START  = 0x08
 	SECTION_CODE   = 0x0a
 	SECTION_DATA   = 0x0b
 
@@ -31,19 +35,38 @@ const (
 	// Value Types
 	TYPE_I32   = 0x7f
 	TYPE_I64   = 0x7e
+	TYPE_F32   = 0x7d
+	TYPE_F64   = 0x7c
 	TYPE_EMPTY = 0x40
 
 	// Variable access
 	GET_LOCAL  = 0x20
 	SET_LOCAL  = 0x21
+	TEE_LOCAL  = 0x22
 	GET_GLOBAL = 0x23
 	SET_GLOBAL = 0x24
 
 	// Control flow operators
-	NOP       = 0x01
-	IF        = 0x04
-	ELSE      = 0x05
-	END_BLOCK = 0x0b
+	UNREACHABLE = 0x00
+	NOP         = 0x01
+	BLOCK       = 0x02
+	LOOP        = 0x03
+	IF          = 0x04
+	ELSE        = 0x05
+	END_BLOCK   = 0x0b
+	BR          = 0x0c
+	BR_IF       = 0x0d
+	BR_TABLE    = 0x0e
+	RETURN      = 0x0f
+
+	// Parametric operators
+	DROP = 0x1a
+
+	// Memory-related operators
+	I32_LOAD8_U    = 0x2d
+	I32_STORE8     = 0x3a
+	CURRENT_MEMORY = 0x3f
+	GROW_MEMORY    = 0x40
 
 	// Call operators
 	CALL = 0x10
@@ -52,13 +75,60 @@ const (
 	I32_ADD       = 0x6a
 	I32_SUB       = 0x6b
 	I32_MUL       = 0x6c
+	I32_DIV_S     = 0x6d
+	I32_REM_S     = 0x6f
+	I32_AND       = 0x71
+	I32_EQZ       = 0x45
+	I32_EQUAL     = 0x46
 	I32_NOT_EQUAL = 0x47
+	I32_GT_U      = 0x4b
+	I32_GE_U      = 0x4f
+	I32_OR        = 0x72
+	I32_XOR       = 0x73
+	I32_SHL       = 0x74
+	I32_SHR_S     = 0x75
+	I32_SHR_U     = 0x76
+	I64_EQUAL     = 0x51
+	I64_NOT_EQUAL = 0x52
+	I64_ADD       = 0x7c
+	I64_SUB       = 0x7d
+	I64_MUL       = 0x7e
+	I64_DIV_S     = 0x7f
+	I64_REM_S     = 0x81
+	I64_AND       = 0x83
+	I64_OR        = 0x84
+	I64_XOR       = 0x85
+	I64_SHL       = 0x86
+	I64_SHR_S     = 0x87
+	I64_SHR_U     = 0x88
+	F32_EQUAL     = 0x5b
+	F32_NOT_EQUAL = 0x5c
+	F64_EQUAL     = 0x61
+	F64_NOT_EQUAL = 0x62
+	F32_ADD       = 0x92
+	F32_SUB       = 0x93
+	F32_MUL       = 0x94
+	F32_DIV       = 0x95
+	F64_ADD       = 0xa0
+	F64_SUB       = 0xa1
+	F64_MUL       = 0xa2
+	F64_DIV       = 0xa3
+
+	// Conversions
+	I32_WRAP_I64     = 0xa7
+	I64_EXTEND_U_I32 = 0xad
+
+	// Global mutability
+	GLOBAL_MUTABLE = 0x01
 
 	// external_kind kind for import/export
 	EXT_KIND_FUNC = 0x00
 
 	// Constants
 	CONST_I32 = 0x41
+	CONST_I64 = 0x42
+	CONST_F32 = 0x43
+	CONST_F64 = 0x44
 )
 
 type Node interface {
@@ -86,9 +156,13 @@ type Module struct {
 	importSection   *ImportSection
 	functionSection *FunctionSection
 	memorySection   *MemorySection
+	globalSection   *GlobalSection
 	exportSection   *ExportSection
+	startSection    *StartSection
 	codeSection     *CodeSection
 	dataSection     *DataSection
+	nameSection     *NameSection
+	lineTable       *LineTable
 }
 
 func (m *Module) String() string {
@@ -111,9 +185,15 @@ func (m *Module) String() string {
 		}
 	}
 
+	if m.startSection != nil {
+		out.WriteString(m.startSection.String())
+	}
 	if m.memorySection != nil {
 		out.WriteString(m.memorySection.String())
 	}
+	if m.globalSection != nil {
+		out.WriteString(m.globalSection.String())
+	}
 	if m.dataSection != nil {
 		out.WriteString(m.dataSection.String())
 	}
@@ -154,6 +234,9 @@ type FuncType struct {
 	typeIndex     uint32
 	name          string
 	exported      bool
+	exportName    string
+	okType        string // value type of a T!E result lowered to a tagged i64
+	errorType     string // error type of a T!E result, empty for plain results
 	paramCount    uint32
 	paramTypes    []*ValueType
 	resultCount   uint32
@@ -234,7 +317,7 @@ func (ie *ImportEntry) String() string {
 	out.WriteString(`" "`)
 	out.WriteString(ie.fieldName)
 	out.WriteString(`" `)
-	out.WriteString(printImportKind(ie.fieldName, ie.kind))
+	out.WriteString(printImportKind(ie.kind))
 	out.WriteString(")")
 	return out.String()
 }
@@ -302,12 +385,18 @@ func (c *Call) String() string {
 type If struct {
 	conditionOps []Operation
 	thenOps      []Operation
+	elseOps      []Operation
+	resultType   string // empty when the if produces no value
 }
 
 func (i *If) operationNode() {}
 func (i *If) String() string {
 	var out bytes.Buffer
-	out.WriteString("(if \n")
+	out.WriteString("(if ")
+	if i.resultType != "" {
+		out.WriteString("(result " + wasmType(i.resultType) + ") ")
+	}
+	out.WriteString("\n")
 	for _, op := range i.conditionOps {
 		out.WriteString("	")
 		out.WriteString(op.String())
@@ -318,10 +407,120 @@ func (i *If) String() string {
 		out.WriteString(op.String())
 	}
 	out.WriteString("	\n)")
+	if i.elseOps != nil {
+		out.WriteString("	(else \n")
+		for _, op := range i.elseOps {
+			out.WriteString("		")
+			out.WriteString(op.String())
+		}
+		out.WriteString("	\n)")
+	}
 	out.WriteString("\n)")
 	return out.String()
 }
 
+type Block struct {
+	ops []Operation
+}
+
+func (b *Block) operationNode() {}
+func (b *Block) String() string {
+	var out bytes.Buffer
+	out.WriteString("(block")
+	for _, op := range b.ops {
+		out.WriteString("\n		")
+		out.WriteString(op.String())
+	}
+	out.WriteString(")")
+	return out.String()
+}
+
+type Loop struct {
+	ops []Operation
+}
+
+func (l *Loop) operationNode() {}
+func (l *Loop) String() string {
+	var out bytes.Buffer
+	out.WriteString("(loop")
+	for _, op := range l.ops {
+		out.WriteString("\n		")
+		out.WriteString(op.String())
+	}
+	out.WriteString(")")
+	return out.String()
+}
+
+type Br struct {
+	depth uint32
+}
+
+func (b *Br) operationNode() {}
+func (b *Br) String() string {
+	var out bytes.Buffer
+	out.WriteString("br ")
+	out.WriteString(strconv.Itoa(int(b.depth)))
+	return out.String()
+}
+
+type BrIf struct {
+	depth uint32
+}
+
+func (b *BrIf) operationNode() {}
+func (b *BrIf) String() string {
+	var out bytes.Buffer
+	out.WriteString("br_if ")
+	out.WriteString(strconv.Itoa(int(b.depth)))
+	return out.String()
+}
+
+type BrTable struct {
+	targets       []uint32
+	defaultTarget uint32
+}
+
+func (b *BrTable) operationNode() {}
+func (b *BrTable) String() string {
+	var out bytes.Buffer
+	out.WriteString("br_table")
+	for _, target := range b.targets {
+		out.WriteString(" ")
+		out.WriteString(strconv.Itoa(int(target)))
+	}
+	out.WriteString(" ")
+	out.WriteString(strconv.Itoa(int(b.defaultTarget)))
+	return out.String()
+}
+
+type Unreachable struct {
+}
+
+func (u *Unreachable) operationNode() {}
+func (u *Unreachable) String() string {
+	return "unreachable"
+}
+
+type Return struct {
+}
+
+func (r *Return) operationNode() {}
+func (r *Return) String() string {
+	var out bytes.Buffer
+	out.WriteString("return")
+	return out.String()
+}
+
+type Drop struct {
+}
+
+func (d *Drop) operationNode() {}
+func (d *Drop) String() string {
+	var out bytes.Buffer
+	out.WriteString("drop")
+	return out.String()
+}
+
 type LocalEntry struct {
 	count     uint32
 	valueType *ValueType
@@ -351,6 +550,19 @@ func (g *GetLocal) String() string {
 	return out.String()
 }
 
+type GetGlobal struct {
+	name        string
+	globalIndex uint32
+}
+
+func (g *GetGlobal) operationNode() {}
+func (g *GetGlobal) String() string {
+	var out bytes.Buffer
+	out.WriteString("get_global $")
+	out.WriteString(g.name)
+	return out.String()
+}
+
 type SetGlobal struct {
 	name        string
 	globalIndex uint32
@@ -377,43 +589,254 @@ func (s *SetLocal) String() string {
 	return out.String()
 }
 
+type TeeLocal struct {
+	name       string
+	localIndex uint32
+}
+
+func (t *TeeLocal) operationNode() {}
+func (t *TeeLocal) String() string {
+	var out bytes.Buffer
+	out.WriteString("tee_local $")
+	out.WriteString(t.name)
+	return out.String()
+}
+
 type Add struct {
+	typeName string
 }
 
 func (a *Add) operationNode() {}
 func (a *Add) String() string {
 	var out bytes.Buffer
-	out.WriteString("i32.add")
+	out.WriteString(a.typeName)
+	out.WriteString(".add")
 	return out.String()
 }
 
 type Sub struct {
+	typeName string
 }
 
 func (s *Sub) operationNode() {}
 func (s *Sub) String() string {
 	var out bytes.Buffer
-	out.WriteString("i32.sub")
+	out.WriteString(s.typeName)
+	out.WriteString(".sub")
 	return out.String()
 }
 
 type Multiply struct {
+	typeName string
 }
 
 func (m *Multiply) operationNode() {}
 func (m *Multiply) String() string {
 	var out bytes.Buffer
-	out.WriteString("i32.mul")
+	out.WriteString(m.typeName)
+	out.WriteString(".mul")
+	return out.String()
+}
+
+type Divide struct {
+	typeName string
+}
+
+func (d *Divide) operationNode() {}
+func (d *Divide) String() string {
+	var out bytes.Buffer
+	out.WriteString(d.typeName)
+	out.WriteString(".div")
+	if isIntegerType(d.typeName) {
+		out.WriteString("_s")
+	}
 	return out.String()
 }
 
+type Remainder struct {
+	typeName string
+}
+
+func (r *Remainder) operationNode() {}
+func (r *Remainder) String() string {
+	var out bytes.Buffer
+	out.WriteString(r.typeName)
+	out.WriteString(".rem")
+	if isIntegerType(r.typeName) {
+		out.WriteString("_s")
+	}
+	return out.String()
+}
+
+type Equal struct {
+	typeName string
+}
+
+func (e *Equal) operationNode() {}
+func (e *Equal) String() string {
+	var out bytes.Buffer
+	out.WriteString(e.typeName)
+	out.WriteString(".eq")
+	return out.String()
+}
+
+type EqualZero struct {
+}
+
+func (e *EqualZero) operationNode() {}
+func (e *EqualZero) String() string {
+	return "i32.eqz"
+}
+
+type GreaterUnsigned struct {
+}
+
+func (g *GreaterUnsigned) operationNode() {}
+func (g *GreaterUnsigned) String() string {
+	return "i32.gt_u"
+}
+
+type GreaterEqualUnsigned struct {
+}
+
+func (g *GreaterEqualUnsigned) operationNode() {}
+func (g *GreaterEqualUnsigned) String() string {
+	return "i32.ge_u"
+}
+
+type Load8Unsigned struct {
+}
+
+func (l *Load8Unsigned) operationNode() {}
+func (l *Load8Unsigned) String() string {
+	return "i32.load8_u"
+}
+
+type Store8 struct {
+}
+
+func (s *Store8) operationNode() {}
+func (s *Store8) String() string {
+	return "i32.store8"
+}
+
+type CurrentMemory struct {
+}
+
+func (c *CurrentMemory) operationNode() {}
+func (c *CurrentMemory) String() string {
+	return "current_memory"
+}
+
+type GrowMemory struct {
+}
+
+func (g *GrowMemory) operationNode() {}
+func (g *GrowMemory) String() string {
+	return "grow_memory"
+}
+
 type NotEqual struct {
+	typeName string
 }
 
 func (n *NotEqual) operationNode() {}
 func (n *NotEqual) String() string {
 	var out bytes.Buffer
-	out.WriteString("i32.ne")
+	out.WriteString(n.typeName)
+	out.WriteString(".ne")
+	return out.String()
+}
+
+type And struct {
+	typeName string
+}
+
+func (a *And) operationNode() {}
+func (a *And) String() string {
+	var out bytes.Buffer
+	out.WriteString(a.typeName)
+	out.WriteString(".and")
+	return out.String()
+}
+
+type Or struct {
+	typeName string
+}
+
+func (o *Or) operationNode() {}
+func (o *Or) String() string {
+	var out bytes.Buffer
+	out.WriteString(o.typeName)
+	out.WriteString(".or")
+	return out.String()
+}
+
+type Xor struct {
+	typeName string
+}
+
+func (x *Xor) operationNode() {}
+func (x *Xor) String() string {
+	var out bytes.Buffer
+	out.WriteString(x.typeName)
+	out.WriteString(".xor")
+	return out.String()
+}
+
+type ShiftLeft struct {
+	typeName string
+}
+
+func (s *ShiftLeft) operationNode() {}
+func (s *ShiftLeft) String() string {
+	var out bytes.Buffer
+	out.WriteString(s.typeName)
+	out.WriteString(".shl")
+	return out.String()
+}
+
+type ShiftRightSigned struct {
+	typeName string
+}
+
+func (s *ShiftRightSigned) operationNode() {}
+func (s *ShiftRightSigned) String() string {
+	var out bytes.Buffer
+	out.WriteString(s.typeName)
+	out.WriteString(".shr_s")
+	return out.String()
+}
+
+type ShiftRightUnsigned struct {
+	typeName string
+}
+
+func (s *ShiftRightUnsigned) operationNode() {}
+func (s *ShiftRightUnsigned) String() string {
+	var out bytes.Buffer
+	out.WriteString(s.typeName)
+	out.WriteString(".shr_u")
+	return out.String()
+}
+
+type Wrap struct {
+}
+
+func (w *Wrap) operationNode() {}
+func (w *Wrap) String() string {
+	var out bytes.Buffer
+	out.WriteString("i32.wrap/i64")
+	return out.String()
+}
+
+type ExtendUnsigned struct {
+}
+
+func (e *ExtendUnsigned) operationNode() {}
+func (e *ExtendUnsigned) String() string {
+	var out bytes.Buffer
+	out.WriteString("i64.extend_u/i32")
 	return out.String()
 }
 
@@ -446,6 +869,48 @@ func (mt *MemoryType) String() string {
 	return out.String()
 }
 
+type GlobalSection struct {
+	count   uint32
+	entries []*GlobalEntry
+}
+
+func (gs *GlobalSection) sectionNode() {}
+func (gs *GlobalSection) String() string {
+	var out bytes.Buffer
+	for _, globalEntry := range gs.entries {
+		out.WriteString("\n	")
+		out.WriteString(globalEntry.String())
+	}
+	return out.String()
+}
+
+type GlobalEntry struct {
+	name     string
+	typeName string
+	mutable  bool
+	init     int32
+}
+
+func (ge *GlobalEntry) String() string {
+	var out bytes.Buffer
+	out.WriteString("(global $")
+	out.WriteString(ge.name)
+	if ge.mutable {
+		out.WriteString(" (mut ")
+		out.WriteString(ge.typeName)
+		out.WriteString(")")
+	} else {
+		out.WriteString(" ")
+		out.WriteString(ge.typeName)
+	}
+	out.WriteString(" (")
+	out.WriteString(ge.typeName)
+	out.WriteString(".const ")
+	out.WriteString(strconv.FormatInt(int64(ge.init), 10))
+	out.WriteString("))")
+	return out.String()
+}
+
 type ExportSection struct {
 	count   uint32
 	entries []*ExportEntry
@@ -462,8 +927,9 @@ func (e *ExportSection) String() string {
 }
 
 type ExportEntry struct {
-	field string
-	index uint32
+	field    string
+	funcName string
+	index    uint32
 }
 
 func (e *ExportEntry) String() string {
@@ -471,11 +937,25 @@ func (e *ExportEntry) String() string {
 	out.WriteString("(export \"")
 	out.WriteString(e.field)
 	out.WriteString(`" (func $`)
-	out.WriteString(e.field)
+	out.WriteString(e.funcName)
 	out.WriteString("))")
 	return out.String()
 }
 
+type StartSection struct {
+	name          string
+	functionIndex uint32
+}
+
+func (s *StartSection) sectionNode() {}
+func (s *StartSection) String() string {
+	var out bytes.Buffer
+	out.WriteString("\n	(start $")
+	out.WriteString(s.name)
+	out.WriteString(")")
+	return out.String()
+}
+
 type ConstInt struct {
 	value    int64
 	typeName string
@@ -484,11 +964,26 @@ type ConstInt struct {
 func (c *ConstInt) operationNode() {}
 func (c *ConstInt) String() string {
 	var out bytes.Buffer
-	out.WriteString("i32.const ")
+	out.WriteString(c.typeName)
+	out.WriteString(".const ")
 	out.WriteString(strconv.FormatInt(c.value, 10))
 	return out.String()
 }
 
+type ConstFloat struct {
+	value    float64
+	typeName string
+}
+
+func (c *ConstFloat) operationNode() {}
+func (c *ConstFloat) String() string {
+	var out bytes.Buffer
+	out.WriteString(c.typeName)
+	out.WriteString(".const ")
+	out.WriteString(strconv.FormatFloat(c.value, 'g', -1, 64))
+	return out.String()
+}
+
 type DataSection struct {
 	count   uint32
 	entries []*DataSegment
@@ -516,7 +1011,14 @@ func (ds *DataSegment) String() string {
 	out.WriteString("(data (i32.const ")
 	out.WriteString(strconv.FormatInt(int64(ds.offset), 10))
 	out.WriteString(`) "`)
-	out.WriteString(string(ds.data))
+	for _, b := range ds.data {
+		if b < 0x20 || b >= 0x7f || b == '"' || b == '\\' {
+			out.WriteString(`\`)
+			out.WriteString(hex.EncodeToString([]byte{b}))
+			continue
+		}
+		out.WriteByte(b)
+	}
 	out.WriteString(`")`)
 	return out.String()
 }
@@ -530,7 +1032,7 @@ func printFunctionSignature(typeKind Type) string {
 		out.WriteString(node.name)
 		if node.exported {
 			out.WriteString(` (export "`)
-			out.WriteString(node.name)
+			out.WriteString(node.exportName)
 			out.WriteString(`")`)
 		}
 		out.WriteString(" (type $t")
@@ -563,15 +1065,15 @@ func printFunctionCode(codeSection *CodeSection, funcName string) string {
 	return ""
 }
 
-func printImportKind(fieldName string, typeKind Type) string {
+func printImportKind(typeKind Type) string {
 	var out bytes.Buffer
 
 	switch node := typeKind.(type) {
 	case *FuncType:
 		out.WriteString("(func $")
-		out.WriteString(fieldName)
+		out.WriteString(node.name)
 		out.WriteString(" (type $t")
-		out.WriteString(strconv.Itoa(int(node.functionIndex)))
+		out.WriteString(strconv.Itoa(int(node.typeIndex)))
 		out.WriteString("))")
 		return out.String()
 	}
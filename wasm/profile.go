@@ -0,0 +1,81 @@
+package wasm
+
+import (
+	"sort"
+
+	"github.com/drejca/shift/token"
+)
+
+// Profile hooks are imported from the profile module, where Shift imports can not be declared
+const (
+	ProfileImportModule = "profile"
+	EnterImport         = "enter"
+	LeaveImport         = "leave"
+)
+
+// ProfiledFunction is a function whose calls are reported to the profile hooks
+type ProfiledFunction struct {
+	Index uint32 // function index passed to the enter hook
+	Name  string
+	Pos   token.Position // position of the declaration
+}
+
+// InsertProfileHooks makes the compiler report every call of a Shift function to the
+// hooks imported from the profile module. The caller calls enter with the index of
+// the called function right before the call and leave right after it returned, so
+// all code of the called function runs between the two. Calls of host functions and
+// @inline functions are not reported, runtime functions count towards their caller.
+func (c *Compiler) InsertProfileHooks() {
+	c.profileHooks = true
+}
+
+// ProfiledFunctions returns the functions whose calls are reported to the profile hooks
+// in the order of their index or nil when no profile hooks are inserted
+func (c *Compiler) ProfiledFunctions() []ProfiledFunction {
+	if c.enterHook == nil {
+		return nil
+	}
+
+	var functions []ProfiledFunction
+	for name, decl := range c.functions {
+		funcType, found := c.getFunctionType(name)
+		if !found {
+			continue
+		}
+		functions = append(functions, ProfiledFunction{
+			Index: funcType.functionIndex,
+			Name:  name,
+			Pos:   decl.function.Span().Start,
+		})
+	}
+	sort.Slice(functions, func(a, b int) bool {
+		return functions[a].Index < functions[b].Index
+	})
+	return functions
+}
+
+// importProfileHooks imports the enter and leave hooks under names no Shift code can refer to
+func (c *Compiler) importProfileHooks() {
+	c.enterHook = c.importHostFunction(ProfileImportModule+"."+EnterImport, ProfileImportModule, EnterImport, i32Params("function")...)
+	c.leaveHook = c.importHostFunction(ProfileImportModule+"."+LeaveImport, ProfileImportModule, LeaveImport)
+}
+
+// callEnterHook returns the call of the enter hook before a call of funcType
+func (c *Compiler) callEnterHook(funcType *FuncType) []Operation {
+	if c.enterHook == nil {
+		return nil
+	}
+	return []Operation{&Call{
+		functionIndex: c.enterHook.functionIndex,
+		name:          c.enterHook.name,
+		arguments:     []Operation{&ConstInt{value: int64(funcType.functionIndex), typeName: "i32"}},
+	}}
+}
+
+// callLeaveHook returns the call of the leave hook after a call returned
+func (c *Compiler) callLeaveHook() []Operation {
+	if c.leaveHook == nil {
+		return nil
+	}
+	return []Operation{&Call{functionIndex: c.leaveHook.functionIndex, name: c.leaveHook.name}}
+}
@@ -0,0 +1,211 @@
+package wasm
+
+import "fmt"
+
+// Runtime functions are generated into the module the first time compiled code calls them
+const (
+	runtimeAlloc        = "runtime.alloc"
+	runtimeCopy         = "runtime.copy"
+	runtimeStringEqual  = "runtime.stringEqual"
+	runtimeStringConcat = "runtime.stringConcat"
+)
+
+// heapGlobal holds the address of the first free byte of linear memory after the data segments
+const heapGlobal = "heap"
+
+// callRuntime calls a runtime function with the values computed by arguments
+func (c *Compiler) callRuntime(name string, arguments ...Operation) *Call {
+	funcType, found := c.runtime[name]
+	if !found {
+		funcType = c.defineRuntimeFunction(name)
+	}
+	return &Call{name: funcType.name, functionIndex: funcType.functionIndex, arguments: arguments}
+}
+
+func (c *Compiler) defineRuntimeFunction(name string) *FuncType {
+	switch name {
+	case runtimeAlloc:
+		funcType := c.runtimeSignature(name, []string{"size"}, true)
+		c.runtimeBodies[name] = c.allocBody()
+		return funcType
+	case runtimeCopy:
+		funcType := c.runtimeSignature(name, []string{"dst", "src", "length"}, false)
+		c.runtimeBodies[name] = copyBody()
+		return funcType
+	case runtimeStringEqual:
+		funcType := c.runtimeSignature(name, []string{"a", "a.len", "b", "b.len"}, true)
+		c.runtimeBodies[name] = stringEqualBody()
+		return funcType
+	case runtimeStringConcat:
+		funcType := c.runtimeSignature(name, []string{"a", "a.len", "b", "b.len"}, true)
+		c.runtimeBodies[name] = c.stringConcatBody()
+		return funcType
+	}
+	panic(fmt.Sprintf("unknown runtime function %s", name))
+}
+
+// runtimeSignature declares a runtime function with i32 params and an optional i32 result
+func (c *Compiler) runtimeSignature(name string, params []string, hasResult bool) *FuncType {
+	funcType := &FuncType{name: name}
+
+	for _, param := range params {
+		funcType.paramTypes = append(funcType.paramTypes, &ValueType{name: param, typeName: "i32"})
+		funcType.paramCount++
+	}
+	if hasResult {
+		funcType.resultType = &ResultType{typeName: "i32"}
+		funcType.resultCount = 1
+	}
+
+	if foundFuncType, found := c.findFunctionType(funcType.paramTypes, funcType.resultType); found {
+		funcType.typeIndex = foundFuncType.typeIndex
+	} else {
+		funcType.typeIndex = c.typeIndex
+		c.appendType(funcType)
+	}
+	funcType.functionIndex = c.functionIndex
+	c.appendFunction(funcType)
+
+	c.runtime[name] = funcType
+	c.runtimeFuncs = append(c.runtimeFuncs, funcType)
+	return funcType
+}
+
+// appendRuntimeFunctions adds the bodies of the used runtime functions in the order they were declared
+func (c *Compiler) appendRuntimeFunctions() {
+	for _, funcType := range c.runtimeFuncs {
+		c.appendCodeSection(c.runtimeBodies[funcType.name])
+	}
+
+	if len(c.runtimeFuncs) > 0 {
+		c.module.globalSection.entries = append(c.module.globalSection.entries, &GlobalEntry{
+			name:     heapGlobal,
+			typeName: "i32",
+			mutable:  true,
+			init:     c.dataOffset,
+		})
+		c.module.globalSection.count++
+	}
+}
+
+// allocBody bumps the heap pointer by size bytes and grows the memory when the
+// heap runs past its end. It returns the address of the allocated bytes.
+func (c *Compiler) allocBody() *FunctionBody {
+	size := &GetLocal{name: "size", localIndex: 0}
+	ptr := &GetLocal{name: "ptr", localIndex: 1}
+	heap := &GetGlobal{name: heapGlobal, globalIndex: 0}
+	memorySize := []Operation{&CurrentMemory{}, &ConstInt{value: 16, typeName: "i32"}, &ShiftLeft{typeName: "i32"}}
+
+	grow := []Operation{heap}
+	grow = append(grow, memorySize...)
+	grow = append(grow,
+		&Sub{typeName: "i32"},
+		&ConstInt{value: 16, typeName: "i32"},
+		&ShiftRightUnsigned{typeName: "i32"},
+		&ConstInt{value: 1, typeName: "i32"},
+		&Add{typeName: "i32"},
+		&GrowMemory{},
+		&ConstInt{value: -1, typeName: "i32"},
+		&Equal{typeName: "i32"},
+	)
+
+	return &FunctionBody{
+		funcName:   runtimeAlloc,
+		localCount: 1,
+		locals:     []*LocalEntry{{count: 1, valueType: &ValueType{name: "ptr", typeName: "i32"}}},
+		code: []Operation{
+			heap,
+			&SetLocal{name: "ptr", localIndex: 1},
+			ptr,
+			size,
+			&Add{typeName: "i32"},
+			&SetGlobal{name: heapGlobal, globalIndex: 0},
+			&If{
+				conditionOps: append(append([]Operation{heap}, memorySize...), &GreaterUnsigned{}),
+				thenOps: []Operation{
+					&If{conditionOps: grow, thenOps: []Operation{&Unreachable{}}},
+				},
+			},
+			ptr,
+		},
+	}
+}
+
+// copyBody copies length bytes from src to dst
+func copyBody() *FunctionBody {
+	dst := &GetLocal{name: "dst", localIndex: 0}
+	src := &GetLocal{name: "src", localIndex: 1}
+	length := &GetLocal{name: "length", localIndex: 2}
+	i := &GetLocal{name: "i", localIndex: 3}
+
+	return &FunctionBody{
+		funcName:   runtimeCopy,
+		localCount: 1,
+		locals:     []*LocalEntry{{count: 1, valueType: &ValueType{name: "i", typeName: "i32"}}},
+		code: []Operation{
+			&Block{ops: []Operation{
+				&Loop{ops: []Operation{
+					i, length, &GreaterEqualUnsigned{}, &BrIf{depth: 1},
+					dst, i, &Add{typeName: "i32"},
+					src, i, &Add{typeName: "i32"}, &Load8Unsigned{},
+					&Store8{},
+					i, &ConstInt{value: 1, typeName: "i32"}, &Add{typeName: "i32"}, &SetLocal{name: "i", localIndex: 3},
+					&Br{depth: 0},
+				}},
+			}},
+		},
+	}
+}
+
+// stringEqualBody compares two strings byte by byte
+func stringEqualBody() *FunctionBody {
+	a := &GetLocal{name: "a", localIndex: 0}
+	aLength := &GetLocal{name: "a.len", localIndex: 1}
+	b := &GetLocal{name: "b", localIndex: 2}
+	bLength := &GetLocal{name: "b.len", localIndex: 3}
+	i := &GetLocal{name: "i", localIndex: 4}
+	notEqual := []Operation{&ConstInt{value: 0, typeName: "i32"}, &Return{}}
+
+	return &FunctionBody{
+		funcName:   runtimeStringEqual,
+		localCount: 1,
+		locals:     []*LocalEntry{{count: 1, valueType: &ValueType{name: "i", typeName: "i32"}}},
+		code: []Operation{
+			&If{conditionOps: []Operation{aLength, bLength, &NotEqual{typeName: "i32"}}, thenOps: notEqual},
+			&Block{ops: []Operation{
+				&Loop{ops: []Operation{
+					i, aLength, &GreaterEqualUnsigned{}, &BrIf{depth: 1},
+					&If{
+						conditionOps: []Operation{a, i, &Add{typeName: "i32"}, &Load8Unsigned{}, b, i, &Add{typeName: "i32"}, &Load8Unsigned{}, &NotEqual{typeName: "i32"}},
+						thenOps:      notEqual,
+					},
+					i, &ConstInt{value: 1, typeName: "i32"}, &Add{typeName: "i32"}, &SetLocal{name: "i", localIndex: 4},
+					&Br{depth: 0},
+				}},
+			}},
+			&ConstInt{value: 1, typeName: "i32"},
+		},
+	}
+}
+
+// stringConcatBody copies two strings into newly allocated memory and returns its address
+func (c *Compiler) stringConcatBody() *FunctionBody {
+	a := &GetLocal{name: "a", localIndex: 0}
+	aLength := &GetLocal{name: "a.len", localIndex: 1}
+	b := &GetLocal{name: "b", localIndex: 2}
+	bLength := &GetLocal{name: "b.len", localIndex: 3}
+	dst := &GetLocal{name: "dst", localIndex: 4}
+
+	return &FunctionBody{
+		funcName:   runtimeStringConcat,
+		localCount: 1,
+		locals:     []*LocalEntry{{count: 1, valueType: &ValueType{name: "dst", typeName: "i32"}}},
+		code: []Operation{
+			c.callRuntime(runtimeAlloc, aLength, bLength, &Add{typeName: "i32"}),
+			&SetLocal{name: "dst", localIndex: 4},
+			c.callRuntime(runtimeCopy, dst, a, aLength),
+			c.callRuntime(runtimeCopy, dst, aLength, &Add{typeName: "i32"}, b, bLength),
+			dst,
+		},
+	}
+}
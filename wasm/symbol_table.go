@@ -19,6 +19,7 @@ type SymbolTable struct {
 
 	store map[string]Symbol
 	numDefinitions uint32
+	block bool
 }
 
 func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
@@ -27,13 +28,24 @@ func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 	return s
 }
 
+// NewBlockSymbolTable returns a nested scope sharing local indexes with the enclosing function scope
+func NewBlockSymbolTable(outer *SymbolTable) *SymbolTable {
+	s := NewEnclosedSymbolTable(outer)
+	s.block = true
+	return s
+}
+
 func NewSymbolTable() *SymbolTable {
 	s := make(map[string]Symbol)
 	return &SymbolTable{store: s}
 }
 
 func (s *SymbolTable) Define(name string, varType string) Symbol {
-	symbol := Symbol{Name: name, Index: s.numDefinitions, Type: varType}
+	symbol := Symbol{Name: name, Index: s.nextIndex(), Type: varType}
+	if varType == "string" {
+		// the length of a string is kept in the local following its offset
+		s.nextIndex()
+	}
 	if s.Outer == nil {
 		symbol.Scope = GlobalScope
 	} else {
@@ -41,10 +53,18 @@ func (s *SymbolTable) Define(name string, varType string) Symbol {
 	}
 
 	s.store[name] = symbol
-	s.numDefinitions++
 	return symbol
 }
 
+func (s *SymbolTable) nextIndex() uint32 {
+	if s.block {
+		return s.Outer.nextIndex()
+	}
+	index := s.numDefinitions
+	s.numDefinitions++
+	return index
+}
+
 func (s *SymbolTable) Resolve(name string) (symbol Symbol, found bool) {
 	obj, ok := s.store[name]
 	if !ok && s.Outer != nil {
@@ -32,3 +32,45 @@ func TestDefine(t *testing.T) {
 		t.Errorf("expected c=%+v, got=%+v", expected["c"], c)
 	}
 }
+
+func TestDefineInBlock(t *testing.T) {
+	global := wasm.NewSymbolTable()
+	local := wasm.NewEnclosedSymbolTable(global)
+	local.Define("a", "i32")
+
+	block := wasm.NewBlockSymbolTable(local)
+
+	shadowed := block.Define("a", "i32")
+	expected := wasm.Symbol{Name: "a", Type: "i32", Scope: wasm.LocalScope, Index: 1}
+	if shadowed != expected {
+		t.Errorf("expected a=%+v, got=%+v", expected, shadowed)
+	}
+
+	b := local.Define("b", "i32")
+	expected = wasm.Symbol{Name: "b", Type: "i32", Scope: wasm.LocalScope, Index: 2}
+	if b != expected {
+		t.Errorf("expected b=%+v, got=%+v", expected, b)
+	}
+
+	a, _ := local.Resolve("a")
+	if a.Index != 0 {
+		t.Errorf("expected a outside of block to have index 0, got=%d", a.Index)
+	}
+}
+
+func TestDefineString(t *testing.T) {
+	global := wasm.NewSymbolTable()
+	local := wasm.NewEnclosedSymbolTable(global)
+
+	s := local.Define("s", "string")
+	expected := wasm.Symbol{Name: "s", Type: "string", Scope: wasm.LocalScope, Index: 0}
+	if s != expected {
+		t.Errorf("expected s=%+v, got=%+v", expected, s)
+	}
+
+	a := local.Define("a", "i32")
+	expected = wasm.Symbol{Name: "a", Type: "i32", Scope: wasm.LocalScope, Index: 2}
+	if a != expected {
+		t.Errorf("expected a=%+v, got=%+v", expected, a)
+	}
+}
@@ -0,0 +1,192 @@
+package wasm
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/drejca/shift/ast"
+	"github.com/drejca/shift/token"
+)
+
+// Built-ins available in a test module. A failed check calls the error host
+// function with a message, so the test runner can report it at the check.
+const (
+	AssertBuiltin   = "assert"
+	ExpectEqBuiltin = "expect_eq"
+)
+
+// TestImportModule is the module of the host functions a failed expect_eq calls
+// with its message and the values that differ. Their field is ExpectEqBuiltin
+// and the type of the values, as in expect_eq.i64.
+const TestImportModule = "test"
+
+// expectEqTypes are the types expect_eq can compare
+var expectEqTypes = []string{"i32", "i64", "f32", "f64", "string"}
+
+// TestExportPrefix prefixes the test name in the export name of a test block
+const TestExportPrefix = "test:"
+
+// testErrorImport is the imported error host function called by failed checks
+const testErrorImport = "test.error"
+
+// IncludeTests makes the compiler build a test module. The test blocks of the
+// root package are compiled into functions exported as TestExportPrefix and
+// their name, and the assert and expect_eq built-ins become available.
+func (c *Compiler) IncludeTests() {
+	c.tests = true
+}
+
+// IsTestFunc reports whether name is the name of a test or benchmark function.
+// Like in Go it is prefix optionally followed by a name which does not start
+// with a lower case letter.
+func IsTestFunc(name string, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) == len(prefix) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+	return !unicode.IsLower(r)
+}
+
+// isTestFunction reports whether function is an exported Test function of a test module
+func (c *Compiler) isTestFunction(function *ast.Function, isRoot bool) bool {
+	exportName, exported := c.exportName(function, isRoot)
+	return c.tests && exported && IsTestFunc(exportName, "Test")
+}
+
+// importTestFunctions imports the error host function under a name no Shift code can
+// refer to and the failure of expect_eq for every type it compares
+func (c *Compiler) importTestFunctions() {
+	c.testError = c.importHostFunction(testErrorImport, DefaultImportModule, "error", i32Params("msg", "msg.len")...)
+
+	c.expectEq = make(map[string]*FuncType)
+	for _, typeName := range expectEqTypes {
+		params := i32Params("msg", "msg.len")
+		for _, value := range []string{"left", "right"} {
+			if typeName == "string" {
+				params = append(params, i32Params(value, value+".len")...)
+			} else {
+				params = append(params, &ValueType{name: value, typeName: typeName})
+			}
+		}
+		field := ExpectEqBuiltin + "." + typeName
+		c.expectEq[typeName] = c.importHostFunction(TestImportModule+"."+field, TestImportModule, field, params...)
+	}
+}
+
+// declareTest declares the function a test block is compiled into and exports it
+func (c *Compiler) declareTest(test *ast.TestBlock, file *ast.Program) {
+	function := &ast.Function{
+		Signature: &ast.FunctionSignature{Name: fmt.Sprintf("test %q", test.Name)},
+		Body:      test.Body,
+	}
+	function.Extent = test.Extent
+	function.Signature.Extent = test.Token.Span()
+
+	if _, found := c.getFunctionType(function.Signature.Name); found {
+		c.handleError(fmt.Errorf("test %q redeclared", test.Name))
+		return
+	}
+
+	funcType := c.compileFunctionSignature(function.Signature)
+	c.appendFunction(funcType)
+	c.functions[funcType.name] = &functionDecl{function: function, pkgPath: c.pkgPath, file: file}
+	c.testFunctions[test] = function
+
+	funcType.exported = true
+	funcType.exportName = TestExportPrefix + test.Name
+	c.appendExportEntry(funcType)
+}
+
+// compileAssert calls the error host function with the message when the condition is false
+//
+//	assert(cond, msg)
+func (c *Compiler) compileAssert(callExpression *ast.CallExpression) []Operation {
+	if !c.checkTestBuiltin(callExpression, AssertBuiltin, 2) {
+		return nil
+	}
+	cond, msg := callExpression.Arguments[0], callExpression.Arguments[1]
+
+	if condType := c.inferType(cond); condType != "i32" {
+		c.handleError(fmt.Errorf("%s expects an i32 condition but %s is %s", AssertBuiltin, cond.String(), condType))
+		return nil
+	}
+	if msgType := c.inferType(msg); msgType != "string" {
+		c.handleError(fmt.Errorf("%s expects a string message but %s is %s", AssertBuiltin, msg.String(), msgType))
+		return nil
+	}
+
+	conditionOps := append(c.compileExpression(cond), &EqualZero{})
+	return []Operation{&If{
+		conditionOps: conditionOps,
+		thenOps:      []Operation{c.testFailure(c.testError, c.compileExpression(msg), callExpression.Span().Start)},
+	}}
+}
+
+// compileExpectEq calls the expect_eq host function of their type with both values when
+// two values of the same type differ. The values are evaluated once into hidden locals.
+//
+//	expect_eq(a, b)
+func (c *Compiler) compileExpectEq(callExpression *ast.CallExpression) []Operation {
+	if !c.checkTestBuiltin(callExpression, ExpectEqBuiltin, 2) {
+		return nil
+	}
+	a, b := callExpression.Arguments[0], callExpression.Arguments[1]
+
+	differ := &ast.InfixExpression{Left: a, Operator: "!=", Right: b}
+	differ.Extent = callExpression.Extent
+
+	typeName := c.inferType(a)
+	failure, found := c.expectEq[typeName]
+	if !found || typeName != c.inferType(b) {
+		// reports why a and b cannot be compared
+		return c.compileExpression(differ)
+	}
+
+	var operations []Operation
+	var locals []ast.Expression
+	for _, value := range []ast.Expression{a, b} {
+		local := c.symbolTable.Define(fmt.Sprintf("%s.%d", ExpectEqBuiltin, c.functionBody.localCount), typeName)
+		c.appendLocal(local)
+		operations = append(operations, c.compileExpression(value)...)
+		operations = append(operations, storeLocal(local)...)
+
+		ident := &ast.Identifier{Value: local.Name}
+		ident.Extent = value.Span()
+		locals = append(locals, ident)
+	}
+	differ.Left, differ.Right = locals[0], locals[1]
+
+	msgOps := c.compileExpression(&ast.String{Value: fmt.Sprintf("%s failed: %s != %s", ExpectEqBuiltin, a.String(), b.String())})
+	for _, local := range locals {
+		msgOps = append(msgOps, c.compileExpression(local)...)
+	}
+	return append(operations, &If{
+		conditionOps: c.compileExpression(differ),
+		thenOps:      []Operation{c.testFailure(failure, msgOps, callExpression.Span().Start)},
+	})
+}
+
+// checkTestBuiltin reports a test built-in used outside a test module or with the wrong number of arguments
+func (c *Compiler) checkTestBuiltin(callExpression *ast.CallExpression, name string, args int) bool {
+	if c.testError == nil {
+		c.handleError(fmt.Errorf("%s is only available in tests", name))
+		return false
+	}
+	if len(callExpression.Arguments) != args {
+		c.handleError(fmt.Errorf("%s expects %d arguments but got %d", name, args, len(callExpression.Arguments)))
+		return false
+	}
+	return true
+}
+
+// testFailure calls the host function failure with the message and values computed by arguments
+func (c *Compiler) testFailure(failure *FuncType, arguments []Operation, pos token.Position) *Call {
+	call := &Call{functionIndex: failure.functionIndex, name: failure.name, arguments: arguments}
+	call.arguments = append(call.arguments, c.markPosition(pos)...)
+	return call
+}
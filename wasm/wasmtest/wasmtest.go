@@ -0,0 +1,37 @@
+// Package wasmtest compiles Shift programs for the tests of packages running them
+package wasmtest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/drejca/shift/parser"
+	"github.com/drejca/shift/wasm"
+)
+
+// Compile parses source as the file filename and compiles it into a module with a
+// compiler set up by options, like (*wasm.Compiler).TrackPositions. The test fails
+// on any error. The compiler is returned for the tables it built.
+func Compile(t testing.TB, filename string, source string, options ...func(*wasm.Compiler)) ([]byte, *wasm.Compiler) {
+	t.Helper()
+
+	program, parseErr := parser.NewFile(filename, strings.NewReader(source)).ParseProgram()
+	if parseErr != nil {
+		t.Fatal(parseErr.Error())
+	}
+
+	compiler := wasm.NewCompiler()
+	for _, option := range options {
+		option(compiler)
+	}
+	wasmModule := compiler.CompileProgram(program)
+	for _, err := range compiler.Errors() {
+		t.Fatal(err)
+	}
+
+	emitter := wasm.NewEmitter()
+	if err := emitter.Emit(wasmModule); err != nil {
+		t.Fatal(err)
+	}
+	return emitter.Bytes(), compiler
+}